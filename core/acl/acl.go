@@ -0,0 +1,401 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+// Package acl decides whether a destination can be dialed according to an
+// ordered list of rules. Rules are written one per line as
+//
+//	<allow|deny> <matcher> [port:<ranges>]
+//
+// where matcher is one of
+//
+//	all                   matches any destination
+//	cidr:<prefix>         matches IPs, including resolved IPs of domains
+//	domain:<suffix>       matches the domain and its subdomains
+//	glob:<pattern>        matches the host with path.Match
+//	geoip:<code>          matches IPs located in the country of code, see GeoIP
+//
+// and ranges are comma separated ports or port ranges like 80,443,8000-9000.
+// Lines starting with '#' are comments. The first matching rule wins.
+package acl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrDenied = errors.New("Destination is denied by ACL")
+
+type Action int
+
+const (
+	ALLOW Action = iota
+	DENY
+)
+
+type Matcher interface {
+	// Match tells if the destination matches. ips are the IPs of host. If host
+	// is a domain, ips are its resolved IPs, which might be empty.
+	Match(host string, ips []net.IP) bool
+	// NeedIPs tells if the matcher inspects IPs.
+	NeedIPs() bool
+}
+
+type AnyMatcher struct{}
+
+func (self AnyMatcher) Match(string, []net.IP) bool { return true }
+
+func (self AnyMatcher) NeedIPs() bool { return false }
+
+type CIDRMatcher struct {
+	N *net.IPNet
+}
+
+func (self CIDRMatcher) Match(host string, ips []net.IP) bool {
+	for _, ip := range ips {
+		if self.N.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self CIDRMatcher) NeedIPs() bool { return true }
+
+// DomainSuffixMatcher matches the domain and its subdomains.
+type DomainSuffixMatcher string
+
+func (self DomainSuffixMatcher) Match(host string, ips []net.IP) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	suffix := strings.ToLower(strings.Trim(string(self), "."))
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
+
+func (self DomainSuffixMatcher) NeedIPs() bool { return false }
+
+type GlobMatcher string
+
+func (self GlobMatcher) Match(host string, ips []net.IP) bool {
+	matched, _ := path.Match(strings.ToLower(string(self)), strings.ToLower(strings.TrimSuffix(host, ".")))
+	return matched
+}
+
+func (self GlobMatcher) NeedIPs() bool { return false }
+
+type PortRange struct {
+	Lo, Hi uint16
+}
+
+type Rule struct {
+	Action Action
+	M      Matcher
+	// Empty means any port.
+	Ports []PortRange
+}
+
+// PortsContain tells if port is in ranges. Empty ranges contain any port.
+func PortsContain(ranges []PortRange, port uint16) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if port >= r.Lo && port <= r.Hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Rule) Match(host string, ips []net.IP, port uint16) bool {
+	return PortsContain(self.Ports, port) && self.M.Match(host, ips)
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// DefaultRules deny loopback, link-local and unspecified addresses, which
+// usually refer to the relayer host itself, and allow anything else.
+var DefaultRules = []Rule{
+	{Action: DENY, M: CIDRMatcher{mustParseCIDR("127.0.0.0/8")}},
+	{Action: DENY, M: CIDRMatcher{mustParseCIDR("::1/128")}},
+	{Action: DENY, M: CIDRMatcher{mustParseCIDR("169.254.0.0/16")}},
+	{Action: DENY, M: CIDRMatcher{mustParseCIDR("fe80::/10")}},
+	{Action: DENY, M: CIDRMatcher{mustParseCIDR("0.0.0.0/32")}},
+	{Action: DENY, M: CIDRMatcher{mustParseCIDR("::/128")}},
+	{Action: ALLOW, M: AnyMatcher{}},
+}
+
+// IPResolver resolves hosts to IPs. *net.Resolver is an IPResolver.
+type IPResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ACL evaluates Rules followed by DefaultRules.
+type ACL struct {
+	Rules []Rule
+	// net.DefaultResolver is used if it's nil.
+	Resolver IPResolver
+}
+
+func (self *ACL) rules() [][]Rule {
+	return [][]Rule{self.Rules, DefaultRules}
+}
+
+func (self *ACL) needIPs() bool {
+	for _, rules := range self.rules() {
+		for _, r := range rules {
+			if r.M.NeedIPs() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Decide returns the action of the first rule matching the destination.
+func (self *ACL) Decide(host string, ips []net.IP, port uint16) Action {
+	for _, rules := range self.rules() {
+		for _, r := range rules {
+			if r.Match(host, ips, port) {
+				return r.Action
+			}
+		}
+	}
+	return ALLOW
+}
+
+// SplitHostPort splits addr into host and numeric port.
+func SplitHostPort(addr string) (string, uint16, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, uint16(port), nil
+}
+
+func (self *ACL) check(host string, ips []net.IP, port uint16) error {
+	if self.Decide(host, ips, port) == DENY {
+		return fmt.Errorf("%w: %s", ErrDenied, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+	return nil
+}
+
+// Check decides whether addr can be dialed. Domains are resolved if any rule
+// inspects IPs.
+func (self *ACL) Check(ctx context.Context, network, addr string) error {
+	_, err := self.CheckIPs(ctx, network, addr)
+	return err
+}
+
+// CheckIPs is Check returning the IPs addr is checked against, which are nil
+// if its domain isn't resolved. Dialing them saves resolving the domain
+// again.
+func (self *ACL) CheckIPs(ctx context.Context, network, addr string) ([]net.IP, error) {
+	host, port, err := SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := LookupIPs(ctx, self.Resolver, host, self.needIPs())
+	if err != nil {
+		return nil, err
+	}
+	return ips, self.check(host, ips, port)
+}
+
+// LookupIPs returns IPs of host. If host is a domain, it's resolved by r only
+// if resolve is true.
+func LookupIPs(ctx context.Context, r IPResolver, host string, resolve bool) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if !resolve {
+		return nil, nil
+	}
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+// Control returns a net.Dialer control function which rechecks the ACL
+// against the IP being connected, so that a domain can't resolve to a denied
+// IP after Check.
+func (self *ACL) Control(host string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		ipStr, port, err := SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return fmt.Errorf("Invalid IP: %s", ipStr)
+		}
+		return self.check(host, []net.IP{ip}, port)
+	}
+}
+
+func (self *ACL) Dialer(host string) *net.Dialer {
+	return &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: self.Control(host),
+	}
+}
+
+func (self *ACL) Dial(network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return self.Dialer(host).Dial(network, addr)
+}
+
+func ParsePortRanges(s string) ([]PortRange, error) {
+	var l []PortRange
+	for _, item := range strings.Split(s, ",") {
+		lohi := strings.SplitN(item, "-", 2)
+		lo, err := strconv.ParseUint(lohi[0], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if len(lohi) == 2 {
+			if hi, err = strconv.ParseUint(lohi[1], 10, 16); err != nil {
+				return nil, err
+			}
+		}
+		if lo > hi {
+			return nil, fmt.Errorf("Invalid port range: %s", item)
+		}
+		l = append(l, PortRange{uint16(lo), uint16(hi)})
+	}
+	return l, nil
+}
+
+// ParseMatcher parses matchers listed in the package doc except geoip.
+func ParseMatcher(s string) (Matcher, error) {
+	return ParseMatcherWithGeoIP(s, nil)
+}
+
+// ParseMatcherWithGeoIP parses matchers listed in the package doc. geoip
+// matchers look up db.
+func ParseMatcherWithGeoIP(s string, db *GeoIP) (Matcher, error) {
+	if s == "all" {
+		return AnyMatcher{}, nil
+	}
+	kv := strings.SplitN(s, ":", 2)
+	if len(kv) != 2 {
+		return nil, fmt.Errorf("Invalid matcher: %s", s)
+	}
+	switch kv[0] {
+	case "cidr":
+		_, n, err := net.ParseCIDR(kv[1])
+		if err != nil {
+			if ip := net.ParseIP(kv[1]); ip != nil {
+				return CIDRMatcher{&net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}}, nil
+			}
+			return nil, err
+		}
+		return CIDRMatcher{n}, nil
+	case "domain":
+		return DomainSuffixMatcher(kv[1]), nil
+	case "glob":
+		if _, err := path.Match(kv[1], ""); err != nil {
+			return nil, err
+		}
+		return GlobMatcher(kv[1]), nil
+	case "geoip":
+		if db == nil {
+			return nil, fmt.Errorf("GeoIP database is not loaded")
+		}
+		return GeoIPMatcher{DB: db, Code: kv[1]}, nil
+	default:
+		return nil, fmt.Errorf("Unknown matcher: %s", kv[0])
+	}
+}
+
+// ParseRule parses a rule. geoip matchers look up db, which can be nil if
+// there are none.
+func ParseRule(line string, db *GeoIP) (Rule, error) {
+	var r Rule
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return r, fmt.Errorf("Invalid rule: %s", line)
+	}
+	switch fields[0] {
+	case "allow":
+		r.Action = ALLOW
+	case "deny":
+		r.Action = DENY
+	default:
+		return r, fmt.Errorf("Unknown action: %s", fields[0])
+	}
+	m, err := ParseMatcherWithGeoIP(fields[1], db)
+	if err != nil {
+		return r, err
+	}
+	r.M = m
+	if len(fields) == 3 {
+		if !strings.HasPrefix(fields[2], "port:") {
+			return r, fmt.Errorf("Invalid port ranges: %s", fields[2])
+		}
+		if r.Ports, err = ParsePortRanges(strings.TrimPrefix(fields[2], "port:")); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// Parse parses rules listed in the package doc, looking up geoip matchers in
+// db.
+func Parse(in io.Reader, db *GeoIP) (*ACL, error) {
+	acl := &ACL{}
+	s := bufio.NewScanner(in)
+	n := 0
+	for s.Scan() {
+		n += 1
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRule(line, db)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %w", n, err)
+		}
+		acl.Rules = append(acl.Rules, r)
+	}
+	return acl, s.Err()
+}
+
+func Load(file string, db *GeoIP) (*ACL, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f, db)
+}
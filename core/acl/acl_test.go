@@ -0,0 +1,140 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+const rules = `
+# Comments are ignored.
+allow cidr:127.0.0.1 port:8080
+deny domain:example.com port:1-1024
+allow glob:*.example.*
+deny cidr:10.0.0.0/8
+`
+
+func TestDecide(t *testing.T) {
+	acl, err := Parse(strings.NewReader(rules), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		host   string
+		ips    []net.IP
+		port   uint16
+		action Action
+	}{
+		{"127.0.0.1", []net.IP{net.ParseIP("127.0.0.1")}, 8080, ALLOW},
+		{"127.0.0.1", []net.IP{net.ParseIP("127.0.0.1")}, 8081, DENY},
+		{"www.example.com", nil, 443, DENY},
+		{"www.example.com", nil, 8443, ALLOW},
+		{"notexample.com", nil, 443, ALLOW},
+		{"www.example.org", []net.IP{net.ParseIP("10.1.1.1")}, 80, ALLOW},
+		{"internal", []net.IP{net.ParseIP("10.1.1.1")}, 80, DENY},
+		{"169.254.169.254", []net.IP{net.ParseIP("169.254.169.254")}, 80, DENY},
+		{"::1", []net.IP{net.ParseIP("::1")}, 80, DENY},
+		{"1.1.1.1", []net.IP{net.ParseIP("1.1.1.1")}, 53, ALLOW},
+	}
+	for _, c := range cases {
+		if a := acl.Decide(c.host, c.ips, c.port); a != c.action {
+			t.Errorf("%s:%d: expected %d, got %d", c.host, c.port, c.action, a)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	acl := &ACL{}
+	if err := acl.Check(context.Background(), "tcp", "localhost:80"); !errors.Is(err, ErrDenied) {
+		t.Fatal(err)
+	}
+	if err := acl.Check(context.Background(), "tcp", "1.1.1.1:80"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	acl := &ACL{}
+	if _, err := acl.Dial("tcp", ln.Addr().String()); !errors.Is(err, ErrDenied) {
+		t.Fatal(err)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, r := range []string{"permit all", "allow cidr:x", "allow all port:2-1", "allow foo:bar"} {
+		if _, err := Parse(strings.NewReader(r), nil); err == nil {
+			t.Error(r)
+		}
+	}
+}
+
+const geoip = `
+# cidr code
+1.0.0.0/24 AU
+1.0.4.0/22,au
+36.0.0.0/8 CN
+2001:db8::/32 XX
+`
+
+func TestGeoIP(t *testing.T) {
+	db, err := ParseGeoIP(strings.NewReader(geoip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ip   string
+		code string
+		in   bool
+	}{
+		{"1.0.0.1", "AU", true},
+		{"1.0.5.255", "au", true},
+		{"1.0.1.0", "AU", false},
+		{"36.1.2.3", "CN", true},
+		{"36.1.2.3", "AU", false},
+		{"2001:db8::1", "XX", true},
+		{"2001:db9::1", "XX", false},
+	}
+	for _, c := range cases {
+		if db.In(net.ParseIP(c.ip), c.code) != c.in {
+			t.Errorf("%s in %s: expected %v", c.ip, c.code, c.in)
+		}
+	}
+	m, err := ParseMatcherWithGeoIP("geoip:cn", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Match("example.cn", []net.IP{net.ParseIP("36.0.0.1")}) {
+		t.Error("geoip:cn should match 36.0.0.1")
+	}
+	if _, err := ParseMatcher("geoip:cn"); err == nil {
+		t.Error("geoip matcher should require a database")
+	}
+}
+
+func TestParseGeoIPRules(t *testing.T) {
+	db, err := ParseGeoIP(strings.NewReader(geoip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := "deny geoip:cn\nallow all\n"
+	if _, err := Parse(strings.NewReader(rules), nil); err == nil {
+		t.Fatal("Expected geoip rules to require a database")
+	}
+	acl, err := Parse(strings.NewReader(rules), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Check(context.Background(), "tcp", "36.0.0.1:443"); !errors.Is(err, ErrDenied) {
+		t.Fatalf("Expected %v, got %v", ErrDenied, err)
+	}
+	if err := acl.Check(context.Background(), "tcp", "1.0.0.1:443"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package acl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+type ipRange struct {
+	lo, hi net.IP
+}
+
+// GeoIP maps IP ranges to country codes. The database is a text file with one
+// "<cidr> <code>" or "<cidr>,<code>" per line. Lines starting with '#' are
+// comments. Ranges of the same code shouldn't overlap.
+type GeoIP struct {
+	ranges map[string][]ipRange
+}
+
+func lastIP(n *net.IPNet) net.IP {
+	ip := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		ip[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return ip.To16()
+}
+
+func ParseGeoIP(in io.Reader) (*GeoIP, error) {
+	db := &GeoIP{ranges: make(map[string][]ipRange)}
+	s := bufio.NewScanner(in)
+	n := 0
+	for s.Scan() {
+		n += 1
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Line %d: Invalid GeoIP entry: %s", n, line)
+		}
+		_, ipn, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %w", n, err)
+		}
+		code := strings.ToUpper(fields[1])
+		db.ranges[code] = append(db.ranges[code], ipRange{ipn.IP.To16(), lastIP(ipn)})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	for _, l := range db.ranges {
+		sort.Slice(l, func(i, j int) bool { return bytes.Compare(l[i].lo, l[j].lo) < 0 })
+	}
+	return db, nil
+}
+
+func LoadGeoIP(file string) (*GeoIP, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseGeoIP(f)
+}
+
+// In tells if ip belongs to the country of code.
+func (self *GeoIP) In(ip net.IP, code string) bool {
+	l := self.ranges[strings.ToUpper(code)]
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	// Find the last range starting no later than ip.
+	i := sort.Search(len(l), func(i int) bool { return bytes.Compare(l[i].lo, ip) > 0 })
+	return i > 0 && bytes.Compare(ip, l[i-1].hi) <= 0
+}
+
+type GeoIPMatcher struct {
+	DB   *GeoIP
+	Code string
+}
+
+func (self GeoIPMatcher) Match(host string, ips []net.IP) bool {
+	for _, ip := range ips {
+		if self.DB.In(ip, self.Code) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self GeoIPMatcher) NeedIPs() bool { return true }
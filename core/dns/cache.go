@@ -0,0 +1,179 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bzEq/bx/core/metrics"
+)
+
+const (
+	DEFAULT_CACHE_SIZE = 4096
+	// TTLs are capped to refresh records now and then.
+	MAX_CACHE_TTL = 24 * 60 * 60
+)
+
+var cacheLookups = metrics.Default.CounterVec("bx_dns_cache_lookups_total",
+	"Number of DNS cache lookups by result", "result")
+
+// ExchangeFunc sends query and returns the response.
+type ExchangeFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+type cacheEntry struct {
+	msg     []byte
+	ttls    []int
+	stored  time.Time
+	expires time.Time
+}
+
+// Cache caches responses until the least TTL of their records expires.
+// Responses without records, like NODATA without SOA, are not cached.
+type Cache struct {
+	Size    int
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+func keyOf(m *Message) (cacheKey, bool) {
+	if len(m.Questions) != 1 {
+		return cacheKey{}, false
+	}
+	q := m.Questions[0]
+	return cacheKey{strings.ToLower(q.Name), q.Type, q.Class}, true
+}
+
+// Get returns a cached response to query with the query's ID and TTLs
+// reduced by the time it has been cached.
+func (self *Cache) Get(query []byte) ([]byte, bool) {
+	m, err := Parse(query)
+	if err != nil {
+		return nil, false
+	}
+	key, ok := keyOf(m)
+	if !ok {
+		return nil, false
+	}
+	self.mu.Lock()
+	e, in := self.entries[key]
+	if in && time.Now().After(e.expires) {
+		delete(self.entries, key)
+		in = false
+	}
+	self.mu.Unlock()
+	if !in {
+		cacheLookups.With("miss").Inc()
+		return nil, false
+	}
+	cacheLookups.With("hit").Inc()
+	msg := make([]byte, len(e.msg))
+	copy(msg, e.msg)
+	SetID(msg, m.ID)
+	elapsed := uint32(time.Since(e.stored).Seconds())
+	for _, off := range e.ttls {
+		ttl := binary.BigEndian.Uint32(msg[off:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(msg[off:], ttl)
+	}
+	return msg, true
+}
+
+// Put caches resp if it's a successful or NXDOMAIN response.
+func (self *Cache) Put(resp []byte) {
+	m, err := Parse(resp)
+	if err != nil || !m.IsResponse() || m.Flags&FLAG_TC != 0 {
+		return
+	}
+	if m.RCode() != RCODE_SUCCESS && m.RCode() != RCODE_NAME_ERROR {
+		return
+	}
+	key, ok := keyOf(m)
+	if !ok {
+		return
+	}
+	var ttls []int
+	minTTL := uint32(MAX_CACHE_TTL)
+	for _, rrs := range [][]RR{m.Answers, m.Authorities, m.Additionals} {
+		for _, rr := range rrs {
+			// TTL of OPT is extended flags.
+			if rr.Type == TYPE_OPT {
+				continue
+			}
+			ttls = append(ttls, rr.ttlOffset)
+			if rr.TTL < minTTL {
+				minTTL = rr.TTL
+			}
+		}
+	}
+	if len(ttls) == 0 || minTTL == 0 {
+		return
+	}
+	msg := make([]byte, len(resp))
+	copy(msg, resp)
+	now := time.Now()
+	e := &cacheEntry{
+		msg:     msg,
+		ttls:    ttls,
+		stored:  now,
+		expires: now.Add(time.Duration(minTTL) * time.Second),
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.entries == nil {
+		self.entries = make(map[cacheKey]*cacheEntry)
+	}
+	size := self.Size
+	if size <= 0 {
+		size = DEFAULT_CACHE_SIZE
+	}
+	if _, in := self.entries[key]; !in && len(self.entries) >= size {
+		self.evict(now)
+	}
+	self.entries[key] = e
+}
+
+// evict drops expired entries, or an arbitrary one if none is expired.
+func (self *Cache) evict(now time.Time) {
+	n := len(self.entries)
+	for k, e := range self.entries {
+		if now.After(e.expires) {
+			delete(self.entries, k)
+		}
+	}
+	if len(self.entries) < n {
+		return
+	}
+	for k := range self.entries {
+		delete(self.entries, k)
+		return
+	}
+}
+
+// Wrap returns an ExchangeFunc answering from the cache before calling f.
+func (self *Cache) Wrap(f ExchangeFunc) ExchangeFunc {
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		if resp, ok := self.Get(query); ok {
+			return resp, nil
+		}
+		resp, err := f(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		self.Put(resp)
+		return resp, nil
+	}
+}
@@ -0,0 +1,366 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bx/core"
+)
+
+// newResponse answers query with records of ips matching the query type.
+func newResponse(query []byte, ip net.IP, ttl uint32, more ...net.IP) []byte {
+	m, _ := Parse(query)
+	resp := make([]byte, len(query))
+	copy(resp, query)
+	binary.BigEndian.PutUint16(resp[2:], FLAG_QR|FLAG_RD|FLAG_RA)
+	n := 0
+	for _, ip := range append([]net.IP{ip}, more...) {
+		data := []byte(ip.To4())
+		if m.Questions[0].Type == TYPE_AAAA {
+			if ip.To4() != nil {
+				continue
+			}
+			data = ip.To16()
+		} else if data == nil {
+			continue
+		}
+		n += 1
+		// Name refers to the question.
+		resp = append(resp, 0xc0, HEADER_SIZE)
+		resp = appendUint16(resp, m.Questions[0].Type)
+		resp = appendUint16(resp, CLASS_INET)
+		resp = append(resp, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl))
+		resp = appendUint16(resp, uint16(len(data)))
+		resp = append(resp, data...)
+	}
+	binary.BigEndian.PutUint16(resp[6:], uint16(n))
+	return resp
+}
+
+func TestParse(t *testing.T) {
+	q := NewQuery(42, "www.example.com", TYPE_A)
+	resp := newResponse(q, net.ParseIP("1.2.3.4"), 300)
+	m, err := Parse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 42 || !m.IsResponse() || m.RCode() != RCODE_SUCCESS {
+		t.Fatalf("Unexpected header: %+v", m)
+	}
+	if len(m.Questions) != 1 || m.Questions[0].Name != "www.example.com." {
+		t.Fatalf("Unexpected questions: %+v", m.Questions)
+	}
+	if len(m.Answers) != 1 || m.Answers[0].Name != "www.example.com." || m.Answers[0].TTL != 300 ||
+		!net.IP(m.Answers[0].Data).Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("Unexpected answers: %+v", m.Answers)
+	}
+	if _, err := Parse(resp[:len(resp)-1]); err == nil {
+		t.Fatal("Truncated message should be malformed")
+	}
+}
+
+func TestCache(t *testing.T) {
+	var c Cache
+	q := NewQuery(1, "www.example.com", TYPE_A)
+	c.Put(newResponse(q, net.ParseIP("1.2.3.4"), 300))
+	resp, ok := c.Get(NewQuery(2, "WWW.example.com", TYPE_A))
+	if !ok {
+		t.Fatal("Expected cache hit")
+	}
+	m, err := Parse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 2 || m.Answers[0].TTL > 300 {
+		t.Fatalf("Unexpected cached response: %+v", m)
+	}
+	if _, ok := c.Get(NewQuery(3, "www.example.com", TYPE_AAAA)); ok {
+		t.Fatal("Expected cache miss")
+	}
+	q = NewQuery(4, "zero.example.com", TYPE_A)
+	c.Put(newResponse(q, net.ParseIP("1.2.3.4"), 0))
+	if _, ok := c.Get(q); ok {
+		t.Fatal("Response with zero TTL shouldn't be cached")
+	}
+}
+
+func TestServer(t *testing.T) {
+	n := 0
+	var cache Cache
+	s := &Server{
+		Addr: "127.0.0.1:0",
+		Exchange: cache.Wrap(func(ctx context.Context, query []byte) ([]byte, error) {
+			n += 1
+			return newResponse(query, net.ParseIP("1.2.3.4"), 300), nil
+		}),
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, network := range []string{"udp", "tcp"} {
+		resp, err := exchangeOver(ctx, network, s.Addr, NewQuery(7, "www.example.com", TYPE_A))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := Parse(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.ID != 7 || len(m.Answers) != 1 {
+			t.Fatalf("Unexpected response over %s: %+v", network, m)
+		}
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 exchange, got %d", n)
+	}
+	resp, err := ClassicExchange([]string{s.Addr})(ctx, NewQuery(8, "www.example.com", TYPE_A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := Parse(resp); err != nil || m.ID != 8 {
+		t.Fatal(err)
+	}
+}
+
+func answerA(ctx context.Context, query []byte) ([]byte, error) {
+	return newResponse(query, net.ParseIP("1.2.3.4"), 300), nil
+}
+
+func checkExchange(t *testing.T, exchange ExchangeFunc) {
+	for id := uint16(1); id <= 2; id++ {
+		resp, err := exchange(context.Background(), NewQuery(id, "www.example.com", TYPE_A))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := Parse(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.ID != id || len(m.Answers) != 1 {
+			t.Fatalf("Unexpected response: %+v", m)
+		}
+	}
+}
+
+func TestDoH(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "Bad content type", http.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(req.Body)
+		resp, _ := answerA(req.Context(), query)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(resp)
+	}))
+	defer server.Close()
+	checkExchange(t, DoHExchange(server.URL+"/dns-query", server.Client()))
+}
+
+// serveDoT answers queries over TLS, closing connections after answering
+// max queries if max isn't 0.
+func serveDoT(t *testing.T, max int) string {
+	config, err := core.CreateBarebonesTLSConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				for n := 0; max == 0 || n < max; n++ {
+					query, err := ReadTCPMessage(c)
+					if err != nil {
+						return
+					}
+					resp, _ := answerA(context.Background(), query)
+					WriteTCPMessage(c, resp)
+				}
+			}(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDoT(t *testing.T) {
+	checkExchange(t, DoTExchange(serveDoT(t, 0), &tls.Config{InsecureSkipVerify: true}))
+}
+
+func TestDoTRetry(t *testing.T) {
+	// Idle connections are closed by the server.
+	checkExchange(t, DoTExchange(serveDoT(t, 1), &tls.Config{InsecureSkipVerify: true}))
+}
+
+func TestResolver(t *testing.T) {
+	n := 0
+	r := &Resolver{
+		Exchange: func(ctx context.Context, query []byte) ([]byte, error) {
+			n += 1
+			return newResponse(query, net.ParseIP("1.2.3.4"), 300, net.ParseIP("::1")), nil
+		},
+	}
+	for _, c := range []struct {
+		prefer Preference
+		ips    []string
+	}{
+		{PREFER_IPV4, []string{"1.2.3.4", "::1"}},
+		{PREFER_IPV6, []string{"::1", "1.2.3.4"}},
+		{IPV4_ONLY, []string{"1.2.3.4"}},
+		{IPV6_ONLY, []string{"::1"}},
+	} {
+		r.Prefer = c.prefer
+		ips, err := r.LookupIP(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != len(c.ips) {
+			t.Fatalf("Expected %v, got %v", c.ips, ips)
+		}
+		for i := range ips {
+			if !ips[i].Equal(net.ParseIP(c.ips[i])) {
+				t.Fatalf("Expected %v, got %v", c.ips, ips)
+			}
+		}
+	}
+	if n != 2 {
+		t.Fatalf("Responses should be cached, got %d exchanges", n)
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	// 192.0.2.1 is reserved for documentation and blackholes connections.
+	d := &Dialer{
+		Resolver: &Resolver{
+			Exchange: func(ctx context.Context, query []byte) ([]byte, error) {
+				return newResponse(query, net.ParseIP("192.0.2.1"), 300, net.ParseIP("127.0.0.1")), nil
+			},
+		},
+		Timeout:       5 * time.Second,
+		FallbackDelay: 50 * time.Millisecond,
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	start := time.Now()
+	c, err := d.Dial("tcp", net.JoinHostPort("www.example.com", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Fallback took too long: %v", d)
+	}
+}
+
+func TestDialIPs(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	// IPs resolved already are raced the way resolved ones are, without a
+	// Resolver.
+	d := &Dialer{Timeout: 5 * time.Second, FallbackDelay: 50 * time.Millisecond}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	start := time.Now()
+	c, err := d.DialIPs(context.Background(), "tcp", []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("127.0.0.1")}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Fallback took too long: %v", d)
+	}
+}
+
+func TestFakeIP(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.IP("a.example.com.")
+	if !a.Equal(net.ParseIP("198.18.0.1")) || !p.IP("A.example.com").Equal(a) {
+		t.Fatalf("Unexpected fake IP: %v", a)
+	}
+	b := p.IP("b.example.com")
+	if addr, err := p.RestoreAddr(net.JoinHostPort(b.String(), "443")); err != nil || addr != "b.example.com:443" {
+		t.Fatalf("Unexpected restored address: %s", addr)
+	}
+	// Range is used up, the first one is recycled.
+	if c := p.IP("c.example.com"); !c.Equal(a) {
+		t.Fatalf("Expected %v recycled, got %v", a, c)
+	}
+	if d, _ := p.Domain(a); d != "c.example.com" {
+		t.Fatalf("Unexpected domain: %s", d)
+	}
+	if addr, err := p.RestoreAddr("1.2.3.4:80"); err != nil || addr != "1.2.3.4:80" {
+		t.Fatalf("Unexpected restored address: %s", addr)
+	}
+	if _, err := p.RestoreAddr("198.18.0.3:80"); err == nil {
+		t.Fatal("Fake IP not handed out shouldn't be restored")
+	}
+	n := 0
+	exchange := p.Wrap(func(ctx context.Context, query []byte) ([]byte, error) {
+		n += 1
+		return NewErrorResponse(query, RCODE_NAME_ERROR)
+	})
+	resp, err := exchange(context.Background(), NewQuery(1, "b.example.com", TYPE_A))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Parse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 1 || len(m.Answers) != 1 || !net.IP(m.Answers[0].Data).Equal(b) {
+		t.Fatalf("Unexpected response: %+v", m)
+	}
+	resp, _ = exchange(context.Background(), NewQuery(2, "b.example.com", TYPE_AAAA))
+	if m, err := Parse(resp); err != nil || m.RCode() != RCODE_SUCCESS || len(m.Answers) != 0 {
+		t.Fatalf("Unexpected response: %+v", m)
+	}
+	exchange(context.Background(), NewQuery(3, "b.example.com", TYPE_NS))
+	if n != 1 {
+		t.Fatalf("Expected 1 exchange, got %d", n)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const DEFAULT_EXCHANGE_TIMEOUT = 5
+
+const RESOLV_CONF = "/etc/resolv.conf"
+
+// SystemServers returns nameservers listed in resolv.conf, or the local
+// nameserver if there is none.
+func SystemServers() []string {
+	var servers []string
+	if f, err := os.Open(RESOLV_CONF); err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+// ReadTCPMessage reads a message prefixed by its length as DNS over TCP does.
+func ReadTCPMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func WriteTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return fmt.Errorf("DNS message too large: %d", len(msg))
+	}
+	b := make([]byte, 0, 2+len(msg))
+	b = appendUint16(b, uint16(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+func exchangeOver(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DEFAULT_EXCHANGE_TIMEOUT * time.Second)
+	}
+	c.SetDeadline(deadline)
+	if network == "tcp" {
+		if err := WriteTCPMessage(c, query); err != nil {
+			return nil, err
+		}
+		return ReadTCPMessage(c)
+	}
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(query)
+	buf := make([]byte, 0xffff)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray responses.
+		if n >= HEADER_SIZE && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+// ClassicExchange returns an ExchangeFunc sending queries to servers in order
+// over UDP, retrying over TCP if responses are truncated.
+func ClassicExchange(servers []string) ExchangeFunc {
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		if len(query) < HEADER_SIZE {
+			return nil, ErrMalformed
+		}
+		err := fmt.Errorf("No DNS server")
+		for _, server := range servers {
+			var resp []byte
+			resp, err = exchangeOver(ctx, "udp", server, query)
+			if err != nil {
+				continue
+			}
+			if binary.BigEndian.Uint16(resp[2:])&FLAG_TC == 0 {
+				return resp, nil
+			}
+			if resp, err = exchangeOver(ctx, "tcp", server, query); err == nil {
+				return resp, nil
+			}
+		}
+		return nil, err
+	}
+}
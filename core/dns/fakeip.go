@@ -0,0 +1,151 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DEFAULT_FAKE_IP_RANGE is reserved for benchmarking by RFC 2544, so it's
+// unlikely to collide with real destinations.
+const DEFAULT_FAKE_IP_RANGE = "198.18.0.0/15"
+
+// Fake IPs are only meaningful to the relayer handing them out, so they
+// shouldn't be cached long by clients.
+const FAKE_IP_TTL = 1
+
+// FakeIPPool hands out IPv4 addresses of a reserved range to domains and maps
+// them back. When the range is used up, addresses are recycled in the order
+// they were handed out.
+type FakeIPPool struct {
+	base     uint32
+	size     uint32
+	mu       sync.Mutex
+	next     uint32
+	byDomain map[string]uint32
+	byOffset map[uint32]string
+}
+
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip := ipnet.IP.To4()
+	ones, bits := ipnet.Mask.Size()
+	if ip == nil || bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("Invalid fake IP range: %s", cidr)
+	}
+	return &FakeIPPool{
+		base:     binary.BigEndian.Uint32(ip),
+		size:     1 << (32 - ones),
+		byDomain: make(map[string]uint32),
+		byOffset: make(map[uint32]string),
+	}, nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+func (self *FakeIPPool) ipOf(off uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, self.base+off)
+	return ip
+}
+
+// IP returns the fake IP of domain, handing out one if there is none.
+func (self *FakeIPPool) IP(domain string) net.IP {
+	domain = normalizeDomain(domain)
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if off, in := self.byDomain[domain]; in {
+		return self.ipOf(off)
+	}
+	// Network and broadcast addresses are skipped.
+	off := self.next%(self.size-2) + 1
+	self.next += 1
+	if old, in := self.byOffset[off]; in {
+		delete(self.byDomain, old)
+	}
+	self.byDomain[domain] = off
+	self.byOffset[off] = domain
+	return self.ipOf(off)
+}
+
+func (self *FakeIPPool) Contains(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	return binary.BigEndian.Uint32(ip4)-self.base < self.size
+}
+
+// Domain returns the domain ip was handed out to.
+func (self *FakeIPPool) Domain(ip net.IP) (string, bool) {
+	if !self.Contains(ip) {
+		return "", false
+	}
+	off := binary.BigEndian.Uint32(ip.To4()) - self.base
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	domain, in := self.byOffset[off]
+	return domain, in
+}
+
+// RestoreAddr replaces the fake IP in addr with its domain. addr is returned
+// unchanged if it doesn't target a fake IP. It's an error if the fake IP isn't
+// handed out, e.g., it has been recycled.
+func (self *FakeIPPool) RestoreAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !self.Contains(ip) {
+		return addr, nil
+	}
+	domain, ok := self.Domain(ip)
+	if !ok {
+		return "", fmt.Errorf("Unknown fake IP: %s", host)
+	}
+	return net.JoinHostPort(domain, port), nil
+}
+
+// Wrap answers A queries with fake IPs and AAAA queries with no record, so
+// that clients connect to fake IPs. Other queries are answered by f.
+func (self *FakeIPPool) Wrap(f ExchangeFunc) ExchangeFunc {
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		m, err := Parse(query)
+		if err != nil {
+			return nil, err
+		}
+		if len(m.Questions) != 1 || m.Questions[0].Class != CLASS_INET || normalizeDomain(m.Questions[0].Name) == "" {
+			return f(ctx, query)
+		}
+		q := m.Questions[0]
+		switch q.Type {
+		case TYPE_A:
+			resp, err := NewErrorResponse(query, RCODE_SUCCESS)
+			if err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint16(resp[6:], 1)
+			resp = appendName(resp, q.Name)
+			resp = appendUint16(resp, TYPE_A)
+			resp = appendUint16(resp, CLASS_INET)
+			resp = append(resp, 0, 0, 0, FAKE_IP_TTL)
+			resp = appendUint16(resp, net.IPv4len)
+			return append(resp, self.IP(q.Name)...), nil
+		case TYPE_AAAA:
+			return NewErrorResponse(query, RCODE_SUCCESS)
+		default:
+			return f(ctx, query)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+// Package dns implements just enough of the DNS wire format to forward and
+// cache messages.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+const (
+	TYPE_A    = 1
+	TYPE_NS   = 2
+	TYPE_SOA  = 6
+	TYPE_AAAA = 28
+	TYPE_OPT  = 41
+)
+
+const CLASS_INET = 1
+
+const (
+	RCODE_SUCCESS         = 0
+	RCODE_FORMAT_ERROR    = 1
+	RCODE_SERVER_FAILURE  = 2
+	RCODE_NAME_ERROR      = 3
+	RCODE_NOT_IMPLEMENTED = 4
+	RCODE_REFUSED         = 5
+)
+
+const (
+	FLAG_QR = 1 << 15
+	FLAG_TC = 1 << 9
+	FLAG_RD = 1 << 8
+	FLAG_RA = 1 << 7
+)
+
+const HEADER_SIZE = 12
+
+// Max size of messages over UDP without EDNS.
+const MAX_UDP_SIZE = 512
+
+var ErrMalformed = errors.New("Malformed DNS message")
+
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+	// Offset of TTL in the message.
+	ttlOffset int
+}
+
+type Message struct {
+	ID          uint16
+	Flags       uint16
+	Questions   []Question
+	Answers     []RR
+	Authorities []RR
+	Additionals []RR
+}
+
+func (self *Message) RCode() int {
+	return int(self.Flags & 0xf)
+}
+
+func (self *Message) IsResponse() bool {
+	return self.Flags&FLAG_QR != 0
+}
+
+// readName reads the name at off and returns it along with the offset right
+// after the name.
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	// Guard against pointer loops.
+	for jumps := 0; jumps < 64; {
+		if off >= len(b) {
+			return "", 0, ErrMalformed
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(b) {
+				return "", 0, ErrMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			jumps += 1
+		case l&0xc0 != 0:
+			return "", 0, ErrMalformed
+		default:
+			if off+1+l > len(b) {
+				return "", 0, ErrMalformed
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", 0, ErrMalformed
+}
+
+func readRRs(b []byte, off int, n int) ([]RR, int, error) {
+	var rrs []RR
+	for i := 0; i < n; i++ {
+		var rr RR
+		var err error
+		if rr.Name, off, err = readName(b, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(b) {
+			return nil, 0, ErrMalformed
+		}
+		rr.Type = binary.BigEndian.Uint16(b[off:])
+		rr.Class = binary.BigEndian.Uint16(b[off+2:])
+		rr.ttlOffset = off + 4
+		rr.TTL = binary.BigEndian.Uint32(b[off+4:])
+		l := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if off+l > len(b) {
+			return nil, 0, ErrMalformed
+		}
+		rr.Data = b[off : off+l]
+		off += l
+		rrs = append(rrs, rr)
+	}
+	return rrs, off, nil
+}
+
+// Parse parses b. Data of RRs refer to b.
+func Parse(b []byte) (*Message, error) {
+	if len(b) < HEADER_SIZE {
+		return nil, ErrMalformed
+	}
+	m := &Message{
+		ID:    binary.BigEndian.Uint16(b),
+		Flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	an := int(binary.BigEndian.Uint16(b[6:]))
+	ns := int(binary.BigEndian.Uint16(b[8:]))
+	ar := int(binary.BigEndian.Uint16(b[10:]))
+	off := HEADER_SIZE
+	for i := 0; i < qd; i++ {
+		var q Question
+		var err error
+		if q.Name, off, err = readName(b, off); err != nil {
+			return nil, err
+		}
+		if off+4 > len(b) {
+			return nil, ErrMalformed
+		}
+		q.Type = binary.BigEndian.Uint16(b[off:])
+		q.Class = binary.BigEndian.Uint16(b[off+2:])
+		off += 4
+		m.Questions = append(m.Questions, q)
+	}
+	var err error
+	if m.Answers, off, err = readRRs(b, off, an); err != nil {
+		return nil, err
+	}
+	if m.Authorities, off, err = readRRs(b, off, ns); err != nil {
+		return nil, err
+	}
+	if m.Additionals, _, err = readRRs(b, off, ar); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if l == "" {
+			continue
+		}
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+// NewQuery builds a recursive query of a single question.
+func NewQuery(id uint16, name string, qtype uint16) []byte {
+	b := make([]byte, HEADER_SIZE, HEADER_SIZE+len(name)+6)
+	binary.BigEndian.PutUint16(b, id)
+	binary.BigEndian.PutUint16(b[2:], FLAG_RD)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	b = appendName(b, name)
+	b = appendUint16(b, qtype)
+	return appendUint16(b, CLASS_INET)
+}
+
+// NewErrorResponse builds a response to query with rcode and no records.
+func NewErrorResponse(query []byte, rcode int) ([]byte, error) {
+	m, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, HEADER_SIZE)
+	binary.BigEndian.PutUint16(b, m.ID)
+	binary.BigEndian.PutUint16(b[2:], FLAG_QR|FLAG_RA|(m.Flags&FLAG_RD)|uint16(rcode&0xf))
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	for _, q := range m.Questions {
+		b = appendName(b, q.Name)
+		b = appendUint16(b, q.Type)
+		b = appendUint16(b, q.Class)
+	}
+	return b, nil
+}
+
+// SetID sets ID of message b in place.
+func SetID(b []byte, id uint16) {
+	binary.BigEndian.PutUint16(b, id)
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type Preference int
+
+const (
+	PREFER_NONE Preference = iota
+	PREFER_IPV4
+	PREFER_IPV6
+	IPV4_ONLY
+	IPV6_ONLY
+)
+
+func ParsePreference(s string) (Preference, error) {
+	switch s {
+	case "":
+		return PREFER_NONE, nil
+	case "ipv4":
+		return PREFER_IPV4, nil
+	case "ipv6":
+		return PREFER_IPV6, nil
+	case "ipv4_only":
+		return IPV4_ONLY, nil
+	case "ipv6_only":
+		return IPV6_ONLY, nil
+	default:
+		return PREFER_NONE, fmt.Errorf("Unknown IP preference: %s", s)
+	}
+}
+
+// Resolver looks up IPs via Exchange and caches responses. It implements
+// acl.IPResolver.
+type Resolver struct {
+	Exchange ExchangeFunc
+	Prefer   Preference
+	cache    Cache
+}
+
+func (self *Resolver) lookup(ctx context.Context, host string, qtype uint16) ([]net.IP, error) {
+	query := NewQuery(uint16(rand.Uint32()), host, qtype)
+	resp, ok := self.cache.Get(query)
+	if !ok {
+		var err error
+		if resp, err = self.Exchange(ctx, query); err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: host, IsTemporary: true}
+		}
+		self.cache.Put(resp)
+	}
+	m, err := Parse(resp)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	switch m.RCode() {
+	case RCODE_SUCCESS:
+	case RCODE_NAME_ERROR:
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: fmt.Sprintf("rcode %d", m.RCode()), Name: host, IsTemporary: true}
+	}
+	var ips []net.IP
+	for _, rr := range m.Answers {
+		if rr.Type == qtype && rr.Class == CLASS_INET && (len(rr.Data) == net.IPv4len || len(rr.Data) == net.IPv6len) {
+			ips = append(ips, append(net.IP(nil), rr.Data...))
+		}
+	}
+	return ips, nil
+}
+
+// LookupIP returns IPs of host, ordered by Prefer. A and AAAA records are
+// queried concurrently.
+func (self *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	var v4, v6 chan result
+	if self.Prefer != IPV6_ONLY {
+		v4 = make(chan result, 1)
+		go func() {
+			ips, err := self.lookup(ctx, host, TYPE_A)
+			v4 <- result{ips, err}
+		}()
+	}
+	if self.Prefer != IPV4_ONLY {
+		v6 = make(chan result, 1)
+		go func() {
+			ips, err := self.lookup(ctx, host, TYPE_AAAA)
+			v6 <- result{ips, err}
+		}()
+	}
+	var r4, r6 result
+	if v4 != nil {
+		r4 = <-v4
+	}
+	if v6 != nil {
+		r6 = <-v6
+	}
+	var ips []net.IP
+	if self.Prefer == PREFER_IPV6 || self.Prefer == IPV6_ONLY {
+		ips = append(r6.ips, r4.ips...)
+	} else {
+		ips = append(r4.ips, r6.ips...)
+	}
+	if len(ips) == 0 {
+		if r4.err != nil {
+			return nil, r4.err
+		}
+		if r6.err != nil {
+			return nil, r6.err
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func (self *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, err := self.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+// DEFAULT_FALLBACK_DELAY is the delay between connection attempts in
+// milliseconds, as RFC 8305 recommends.
+const DEFAULT_FALLBACK_DELAY = 250
+
+// Dialer resolves hosts by Resolver and dials their IPs in the Happy Eyeballs
+// manner. IPs are tried in interleaved address families starting with the
+// preferred one, each attempt starting FallbackDelay after the previous one
+// unless the previous one fails earlier.
+type Dialer struct {
+	Resolver      *Resolver
+	Timeout       time.Duration
+	FallbackDelay time.Duration
+	Control       func(network, address string, c syscall.RawConn) error
+}
+
+// interleave alternates IPs of different families, keeping the family of
+// the first IP first.
+func interleave(ips []net.IP) []net.IP {
+	if len(ips) == 0 {
+		return ips
+	}
+	var first, second []net.IP
+	isV4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == isV4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	l := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			l = append(l, first[i])
+		}
+		if i < len(second) {
+			l = append(l, second[i])
+		}
+	}
+	return l
+}
+
+func (self *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return self.DialContext(context.Background(), network, addr)
+}
+
+func (self *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if self.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.Timeout)
+		defer cancel()
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := self.Resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return self.dialIPs(ctx, network, ips, port)
+}
+
+// DialIPs dials port of ips resolved already, the way DialContext dials
+// those of a host.
+func (self *Dialer) DialIPs(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	if self.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.Timeout)
+		defer cancel()
+	}
+	return self.dialIPs(ctx, network, ips, port)
+}
+
+func (self *Dialer) dialIPs(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, errors.New("No address to dial")
+	}
+	ips = interleave(ips)
+	d := &net.Dialer{Control: self.Control}
+	// Happy Eyeballs only makes sense for connection oriented protocols.
+	if !strings.HasPrefix(network, "tcp") {
+		return d.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+	delay := self.FallbackDelay
+	if delay <= 0 {
+		delay = DEFAULT_FALLBACK_DELAY * time.Millisecond
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, len(ips))
+	pending := 0
+	var lastErr error
+	for i := 0; i < len(ips) || pending > 0; {
+		if i < len(ips) {
+			go func(ip net.IP) {
+				c, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+				results <- result{c, err}
+			}(ips[i])
+			i += 1
+			pending += 1
+		}
+		var fallback <-chan time.Time
+		var t *time.Timer
+		if i < len(ips) {
+			t = time.NewTimer(delay)
+			fallback = t.C
+		}
+		for waiting := true; waiting && pending > 0; {
+			select {
+			case r := <-results:
+				pending -= 1
+				if r.err == nil {
+					if t != nil {
+						t.Stop()
+					}
+					// Close connections of attempts racing to finish.
+					go func(n int) {
+						for ; n > 0; n-- {
+							if r := <-results; r.err == nil {
+								r.c.Close()
+							}
+						}
+					}(pending)
+					return r.c, nil
+				}
+				lastErr = r.err
+				// Start next attempt at once.
+				waiting = false
+			case <-fallback:
+				waiting = false
+			}
+		}
+		if t != nil {
+			t.Stop()
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("No address to dial")
+	}
+	return nil, lastErr
+}
+
+// ParseResolver creates a Resolver querying upstream spec as ParseExchange
+// accepts. It returns nil if both spec and prefer are empty.
+func ParseResolver(spec, prefer string) (*Resolver, error) {
+	if spec == "" && prefer == "" {
+		return nil, nil
+	}
+	if spec == "" {
+		spec = "system"
+	}
+	exchange, err := ParseExchange(spec)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePreference(prefer)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{Exchange: exchange, Prefer: p}, nil
+}
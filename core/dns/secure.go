@@ -0,0 +1,135 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const MAX_IDLE_DOT_CONNS = 4
+
+// DoTExchange returns an ExchangeFunc sending queries to server over TLS.
+// Idle connections are reused. As the server may have closed a reused
+// connection, the query is retried once on a new connection if it fails.
+func DoTExchange(server string, config *tls.Config) ExchangeFunc {
+	idle := make(chan net.Conn, MAX_IDLE_DOT_CONNS)
+	dial := func(ctx context.Context) (net.Conn, error) {
+		d := &tls.Dialer{Config: config}
+		return d.DialContext(ctx, "tcp", server)
+	}
+	exchange := func(ctx context.Context, c net.Conn, query []byte) ([]byte, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(DEFAULT_EXCHANGE_TIMEOUT * time.Second)
+		}
+		c.SetDeadline(deadline)
+		if err := WriteTCPMessage(c, query); err != nil {
+			return nil, err
+		}
+		return ReadTCPMessage(c)
+	}
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		var c net.Conn
+		reused := false
+		select {
+		case c = <-idle:
+			reused = true
+		default:
+			var err error
+			if c, err = dial(ctx); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := exchange(ctx, c, query)
+		if err != nil && reused && ctx.Err() == nil {
+			c.Close()
+			if c, err = dial(ctx); err != nil {
+				return nil, err
+			}
+			resp, err = exchange(ctx, c, query)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		select {
+		case idle <- c:
+		default:
+			c.Close()
+		}
+		return resp, nil
+	}
+}
+
+// DoHExchange returns an ExchangeFunc posting queries to url as RFC 8484
+// describes. Queries without deadlines time out after
+// DEFAULT_EXCHANGE_TIMEOUT seconds.
+func DoHExchange(url string, client *http.Client) ExchangeFunc {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, DEFAULT_EXCHANGE_TIMEOUT*time.Second)
+			defer cancel()
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("DoH server responded %s", resp.Status)
+		}
+		return ioutil.ReadAll(io.LimitReader(resp.Body, 0xffff))
+	}
+}
+
+// ParseExchange creates an ExchangeFunc from spec, which is one of
+//
+//	system                  nameservers in resolv.conf
+//	<host:port>             classic DNS
+//	udp://<host:port>       classic DNS
+//	tls://<host:port>       DNS over TLS
+//	https://<host>/<path>   DNS over HTTPS
+//
+// Multiple classic DNS servers can be separated by commas.
+func ParseExchange(spec string) (ExchangeFunc, error) {
+	switch {
+	case spec == "system":
+		return ClassicExchange(SystemServers()), nil
+	case strings.HasPrefix(spec, "https://"):
+		return DoHExchange(spec, nil), nil
+	case strings.HasPrefix(spec, "tls://"):
+		server := strings.TrimPrefix(spec, "tls://")
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, err
+		}
+		return DoTExchange(server, &tls.Config{ServerName: host}), nil
+	default:
+		servers := strings.Split(strings.TrimPrefix(spec, "udp://"), ",")
+		for _, s := range servers {
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				return nil, err
+			}
+		}
+		return ClassicExchange(servers), nil
+	}
+}
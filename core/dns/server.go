@@ -0,0 +1,146 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Server answers queries over UDP and TCP by Exchange.
+type Server struct {
+	Addr     string
+	Exchange ExchangeFunc
+	mu       sync.Mutex
+	closers  []io.Closer
+	closing  bool
+}
+
+// maxUDPSize returns the max response size the client of query accepts over
+// UDP.
+func maxUDPSize(m *Message) int {
+	for _, rr := range m.Additionals {
+		if rr.Type == TYPE_OPT && int(rr.Class) > MAX_UDP_SIZE {
+			return int(rr.Class)
+		}
+	}
+	return MAX_UDP_SIZE
+}
+
+func (self *Server) answer(query []byte) []byte {
+	m, err := Parse(query)
+	if err != nil || m.IsResponse() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_EXCHANGE_TIMEOUT*time.Second)
+	defer cancel()
+	resp, err := self.Exchange(ctx, query)
+	if err != nil {
+		log.Println(err)
+		resp, _ = NewErrorResponse(query, RCODE_SERVER_FAILURE)
+	}
+	return resp
+}
+
+func (self *Server) serveUDP(c net.PacketConn) {
+	buf := make([]byte, 0xffff)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			if !self.isClosing() {
+				log.Println(err)
+			}
+			return
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			resp := self.answer(query)
+			if resp == nil {
+				return
+			}
+			if m, err := Parse(query); err == nil && len(resp) > maxUDPSize(m) {
+				// Let the client retry over TCP.
+				resp, _ = NewErrorResponse(query, RCODE_SUCCESS)
+				binary.BigEndian.PutUint16(resp[2:], binary.BigEndian.Uint16(resp[2:])|FLAG_TC)
+			}
+			if _, err := c.WriteTo(resp, addr); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+}
+
+func (self *Server) serveTCPConn(c net.Conn) {
+	defer c.Close()
+	for {
+		c.SetReadDeadline(time.Now().Add(DEFAULT_EXCHANGE_TIMEOUT * 2 * time.Second))
+		query, err := ReadTCPMessage(c)
+		if err != nil {
+			return
+		}
+		resp := self.answer(query)
+		if resp == nil {
+			return
+		}
+		if err := WriteTCPMessage(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+func (self *Server) serveTCP(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if !self.isClosing() {
+				log.Println(err)
+			}
+			return
+		}
+		go self.serveTCPConn(c)
+	}
+}
+
+func (self *Server) isClosing() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.closing
+}
+
+// Start listens on Addr over both UDP and TCP. If port of Addr is 0, Addr is
+// updated to the address actually listened.
+func (self *Server) Start() error {
+	pc, err := net.ListenPacket("udp", self.Addr)
+	if err != nil {
+		return err
+	}
+	self.Addr = pc.LocalAddr().String()
+	ln, err := net.Listen("tcp", self.Addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	self.mu.Lock()
+	self.closers = append(self.closers, pc, ln)
+	self.mu.Unlock()
+	go self.serveUDP(pc)
+	go self.serveTCP(ln)
+	return nil
+}
+
+func (self *Server) Close() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.closing = true
+	for _, c := range self.closers {
+		c.Close()
+	}
+	self.closers = nil
+	return nil
+}
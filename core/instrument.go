@@ -0,0 +1,64 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package core
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/bzEq/bx/core/metrics"
+)
+
+var (
+	routerRoutes = metrics.Default.Gauge("bx_router_routes",
+		"Number of routes in SimpleRouter")
+	routerDropped = metrics.Default.Counter("bx_router_dropped_total",
+		"Number of frames SimpleRouter dropped due to full queues or unknown routes")
+	passErrors = metrics.Default.CounterVec("bx_pass_errors_total",
+		"Number of errors raised by pass pipelines", "stage")
+	dialFailures = metrics.Default.CounterVec("bx_dial_failures_total",
+		"Number of failed dials by reason", "reason")
+	handshakeLatency = metrics.Default.HistogramVec("bx_handshake_seconds",
+		"Latency of protocol handshakes", metrics.DefaultBuckets, "protocol")
+)
+
+// ErrNotAllowed is wrapped by errors of dials refused by policies of relayers
+// on the way, e.g. ACLs and quotas, rather than failing to reach the
+// destination.
+var ErrNotAllowed = errors.New("Connection is not allowed")
+
+// DialErrorReason classifies err returned by a dial.
+func DialErrorReason(err error) string {
+	if errors.Is(err, ErrNotAllowed) {
+		return "not_allowed"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return "timeout"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "refused"
+	}
+	if errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) {
+		return "unreachable"
+	}
+	return "other"
+}
+
+func RecordDialFailure(err error) {
+	dialFailures.With(DialErrorReason(err)).Inc()
+}
+
+func RecordHandshake(protocol string, start time.Time) {
+	handshakeLatency.With(protocol).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+// Package metrics implements a minimal metrics registry exposed in
+// Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Metric interface {
+	Type() string
+	// Write writes samples of the metric. labels is either empty or a
+	// rendered label set without braces.
+	Write(w io.Writer, name string, labels string) error
+}
+
+type Counter struct {
+	v uint64
+}
+
+func (self *Counter) Type() string { return "counter" }
+
+func (self *Counter) Inc() { atomic.AddUint64(&self.v, 1) }
+
+func (self *Counter) Add(n uint64) { atomic.AddUint64(&self.v, n) }
+
+func (self *Counter) Value() uint64 { return atomic.LoadUint64(&self.v) }
+
+func (self *Counter) Write(w io.Writer, name string, labels string) error {
+	return writeSample(w, name, labels, float64(self.Value()))
+}
+
+type Gauge struct {
+	v int64
+}
+
+func (self *Gauge) Type() string { return "gauge" }
+
+func (self *Gauge) Inc() { atomic.AddInt64(&self.v, 1) }
+
+func (self *Gauge) Dec() { atomic.AddInt64(&self.v, -1) }
+
+func (self *Gauge) Add(n int64) { atomic.AddInt64(&self.v, n) }
+
+func (self *Gauge) Set(n int64) { atomic.StoreInt64(&self.v, n) }
+
+func (self *Gauge) Value() int64 { return atomic.LoadInt64(&self.v) }
+
+func (self *Gauge) Write(w io.Writer, name string, labels string) error {
+	return writeSample(w, name, labels, float64(self.Value()))
+}
+
+// GaugeFunc reports the value returned by the function at collection time.
+type GaugeFunc func() float64
+
+func (self GaugeFunc) Type() string { return "gauge" }
+
+func (self GaugeFunc) Write(w io.Writer, name string, labels string) error {
+	return writeSample(w, name, labels, self())
+}
+
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	b := append([]float64{}, buckets...)
+	sort.Float64s(b)
+	return &Histogram{
+		buckets: b,
+		counts:  make([]uint64, len(b)),
+	}
+}
+
+func (self *Histogram) Type() string { return "histogram" }
+
+func (self *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(self.buckets, v)
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if i < len(self.counts) {
+		self.counts[i] += 1
+	}
+	self.sum += v
+	self.count += 1
+}
+
+func (self *Histogram) Write(w io.Writer, name string, labels string) error {
+	self.mu.Lock()
+	counts := append([]uint64{}, self.counts...)
+	sum, count := self.sum, self.count
+	self.mu.Unlock()
+	var acc uint64
+	for i, b := range self.buckets {
+		acc += counts[i]
+		if err := writeSample(w, name+"_bucket", joinLabels(labels, "le", formatFloat(b)), float64(acc)); err != nil {
+			return err
+		}
+	}
+	if err := writeSample(w, name+"_bucket", joinLabels(labels, "le", "+Inf"), float64(count)); err != nil {
+		return err
+	}
+	if err := writeSample(w, name+"_sum", labels, sum); err != nil {
+		return err
+	}
+	return writeSample(w, name+"_count", labels, float64(count))
+}
+
+// Vec is a family of metrics partitioned by label values.
+type Vec[M Metric] struct {
+	labels   []string
+	create   func() M
+	mu       sync.Mutex
+	children map[string]M
+}
+
+func NewVec[M Metric](create func() M, labels ...string) *Vec[M] {
+	return &Vec[M]{
+		labels:   labels,
+		create:   create,
+		children: make(map[string]M),
+	}
+}
+
+func (self *Vec[M]) Type() string {
+	var m M
+	return m.Type()
+}
+
+func (self *Vec[M]) With(values ...string) M {
+	if len(values) != len(self.labels) {
+		panic(fmt.Errorf("Expect %d label values, got %d", len(self.labels), len(values)))
+	}
+	var buf strings.Builder
+	for i, v := range values {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%s=\"%s\"", self.labels[i], escapeLabelValue(v))
+	}
+	key := buf.String()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	m, in := self.children[key]
+	if !in {
+		m = self.create()
+		self.children[key] = m
+	}
+	return m
+}
+
+func (self *Vec[M]) Write(w io.Writer, name string, labels string) error {
+	self.mu.Lock()
+	keys := make([]string, 0, len(self.children))
+	for k := range self.children {
+		keys = append(keys, k)
+	}
+	children := make([]M, len(keys))
+	sort.Strings(keys)
+	for i, k := range keys {
+		children[i] = self.children[k]
+	}
+	self.mu.Unlock()
+	for i, m := range children {
+		if err := m.Write(w, name, joinRendered(labels, keys[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewCounterVec(labels ...string) *Vec[*Counter] {
+	return NewVec(func() *Counter { return &Counter{} }, labels...)
+}
+
+func NewHistogramVec(buckets []float64, labels ...string) *Vec[*Histogram] {
+	return NewVec(func() *Histogram { return NewHistogram(buckets) }, labels...)
+}
+
+type entry struct {
+	name, help string
+	m          Metric
+}
+
+var Default = &Registry{}
+
+type Registry struct {
+	mu      sync.Mutex
+	entries []entry
+	names   map[string]bool
+}
+
+func (self *Registry) Register(name, help string, m Metric) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.names == nil {
+		self.names = make(map[string]bool)
+	}
+	if self.names[name] {
+		panic(fmt.Errorf("Metric %s already exists!", name))
+	}
+	self.names[name] = true
+	self.entries = append(self.entries, entry{name, help, m})
+}
+
+func (self *Registry) WriteTo(w io.Writer) (int64, error) {
+	self.mu.Lock()
+	entries := append([]entry{}, self.entries...)
+	self.mu.Unlock()
+	var buf bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", e.name, e.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", e.name, e.m.Type())
+		if err := e.m.Write(&buf, e.name, ""); err != nil {
+			return 0, err
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+func (self *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	self.WriteTo(w)
+}
+
+func (self *Registry) Counter(name, help string) *Counter {
+	m := &Counter{}
+	self.Register(name, help, m)
+	return m
+}
+
+func (self *Registry) Gauge(name, help string) *Gauge {
+	m := &Gauge{}
+	self.Register(name, help, m)
+	return m
+}
+
+func (self *Registry) GaugeFunc(name, help string, f func() float64) {
+	self.Register(name, help, GaugeFunc(f))
+}
+
+func (self *Registry) CounterVec(name, help string, labels ...string) *Vec[*Counter] {
+	m := NewCounterVec(labels...)
+	self.Register(name, help, m)
+	return m
+}
+
+func (self *Registry) HistogramVec(name, help string, buckets []float64, labels ...string) *Vec[*Histogram] {
+	m := NewHistogramVec(buckets, labels...)
+	self.Register(name, help, m)
+	return m
+}
+
+func writeSample(w io.Writer, name string, labels string, v float64) error {
+	var err error
+	if labels == "" {
+		_, err = fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+	} else {
+		_, err = fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(v))
+	}
+	return err
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	if math.IsInf(v, -1) {
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func joinLabels(labels, name, value string) string {
+	return joinRendered(labels, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(value)))
+}
+
+func joinRendered(a, b string) string {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	return a + "," + b
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := &Registry{}
+	c := &Counter{}
+	r.Register("bx_test_total", "Test counter", c)
+	c.Add(3)
+	g := &Gauge{}
+	r.Register("bx_test_active", "Test gauge", g)
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	v := NewCounterVec("reason")
+	r.Register("bx_test_failures_total", "Test vec", v)
+	v.With("timeout").Inc()
+	v.With("refused").Add(2)
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP bx_test_total Test counter
+# TYPE bx_test_total counter
+bx_test_total 3
+# HELP bx_test_active Test gauge
+# TYPE bx_test_active gauge
+bx_test_active 1
+# HELP bx_test_failures_total Test vec
+# TYPE bx_test_failures_total counter
+bx_test_failures_total{reason="refused"} 2
+bx_test_failures_total{reason="timeout"} 1
+`
+	if buf.String() != expected {
+		t.Log(buf.String())
+		t.Fail()
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := &Registry{}
+	h := NewHistogramVec([]float64{0.1, 1}, "protocol")
+	r.Register("bx_test_seconds", "Test histogram", h)
+	h.With("socks5").Observe(0.05)
+	h.With("socks5").Observe(0.5)
+	h.With("socks5").Observe(5)
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{
+		`bx_test_seconds_bucket{protocol="socks5",le="0.1"} 1`,
+		`bx_test_seconds_bucket{protocol="socks5",le="1"} 2`,
+		`bx_test_seconds_bucket{protocol="socks5",le="+Inf"} 3`,
+		`bx_test_seconds_sum{protocol="socks5"} 5.55`,
+		`bx_test_seconds_count{protocol="socks5"} 3`,
+	} {
+		if !strings.Contains(buf.String(), l+"\n") {
+			t.Log(buf.String())
+			t.Fatal(l)
+		}
+	}
+}
+
+func TestDuplicateMetric(t *testing.T) {
+	r := &Registry{}
+	r.Register("bx_test", "", &Counter{})
+	defer func() {
+		if recover() == nil {
+			t.Fail()
+		}
+	}()
+	r.Register("bx_test", "", &Counter{})
+}
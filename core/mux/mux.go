@@ -0,0 +1,257 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+// Package mux multiplexes streams over a core.Port. Every frame packed into
+// the port is a byte of frame type and 4 bytes of stream id, followed by
+// payload. Streams are flow controlled by windows, so that a slow stream
+// doesn't block others sharing the port.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+)
+
+// Frame types. The receiving goroutine of a session never sends frames
+// synchronously, so that sessions don't deadlock when both sides are sending.
+const (
+	// Payload is the address of the stream's origin.
+	FRAME_OPEN = iota + 1
+	FRAME_DATA
+	// Sender won't write to the stream anymore.
+	FRAME_FIN
+	// Sender has closed the stream.
+	FRAME_RESET
+	// Payload is a 4-byte increment of the stream's send window.
+	FRAME_WINDOW
+	FRAME_PING
+)
+
+const FRAME_HEADER_SIZE = 5
+
+// Bytes a stream can send before its peer reads them.
+const STREAM_WINDOW = 256 << 10
+
+const MAX_FRAME_PAYLOAD = 16 << 10
+
+// Seconds between pings keeping sessions from idle timeout.
+const PING_INTERVAL = 60
+
+// Number of opened streams waiting to be accepted. Streams beyond are reset.
+const ACCEPT_BACKLOG = 64
+
+var ErrSessionClosed = errors.New("Session is closed")
+var ErrStreamReset = errors.New("Stream is reset by peer")
+var ErrMalformedFrame = errors.New("Malformed frame")
+
+type Session struct {
+	p         core.Port
+	mu        sync.Mutex
+	streams   map[uint32]*Stream
+	nextId    uint32
+	accepts   chan *Stream
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+// NewSession starts multiplexing over p. Sides of a session must differ in
+// client, which decides ids of streams they open.
+func NewSession(p core.Port, client bool) *Session {
+	self := &Session{
+		p:       core.AsSyncPort(p),
+		streams: make(map[uint32]*Stream),
+		nextId:  2,
+		accepts: make(chan *Stream, ACCEPT_BACKLOG),
+		done:    make(chan struct{}),
+	}
+	if client {
+		self.nextId = 1
+	}
+	go self.recvLoop()
+	go self.ping()
+	return self
+}
+
+func (self *Session) send(t byte, id uint32, payload []byte) error {
+	frame := make([]byte, FRAME_HEADER_SIZE+len(payload))
+	frame[0] = t
+	binary.BigEndian.PutUint32(frame[1:], id)
+	copy(frame[FRAME_HEADER_SIZE:], payload)
+	if err := self.p.Pack(iovec.FromSlice(frame)); err != nil {
+		self.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (self *Session) ping() {
+	t := time.NewTicker(PING_INTERVAL * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := self.send(FRAME_PING, 0, nil); err != nil {
+				return
+			}
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// Open opens a stream originated from addr.
+func (self *Session) Open(addr string) (*Stream, error) {
+	self.mu.Lock()
+	if self.isClosed() {
+		self.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := self.nextId
+	self.nextId += 2
+	s := newStream(self, id, addr)
+	self.streams[id] = s
+	self.mu.Unlock()
+	if err := self.send(FRAME_OPEN, id, []byte(addr)); err != nil {
+		self.remove(id)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept waits for a stream opened by the peer.
+func (self *Session) Accept() (*Stream, error) {
+	select {
+	case s := <-self.accepts:
+		return s, nil
+	case <-self.done:
+		return nil, ErrSessionClosed
+	}
+}
+
+func (self *Session) lookup(id uint32) *Stream {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.streams[id]
+}
+
+func (self *Session) remove(id uint32) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.streams, id)
+}
+
+func (self *Session) recvLoop() {
+	for {
+		var b iovec.IoVec
+		if err := self.p.Unpack(&b); err != nil {
+			self.closeWithError(err)
+			return
+		}
+		frame := b.Consume()
+		if len(frame) < FRAME_HEADER_SIZE {
+			self.closeWithError(ErrMalformedFrame)
+			return
+		}
+		id := binary.BigEndian.Uint32(frame[1:])
+		payload := frame[FRAME_HEADER_SIZE:]
+		if err := self.handle(frame[0], id, payload); err != nil {
+			self.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (self *Session) handle(t byte, id uint32, payload []byte) error {
+	if t == FRAME_PING {
+		return nil
+	}
+	if t == FRAME_OPEN {
+		self.mu.Lock()
+		if id%2 == self.nextId%2 || self.streams[id] != nil {
+			self.mu.Unlock()
+			return fmt.Errorf("Invalid stream #%d to open", id)
+		}
+		s := newStream(self, id, string(payload))
+		self.streams[id] = s
+		self.mu.Unlock()
+		select {
+		case self.accepts <- s:
+		default:
+			self.remove(id)
+			go self.send(FRAME_RESET, id, nil)
+		}
+		return nil
+	}
+	s := self.lookup(id)
+	if s == nil {
+		// Frames may arrive after the stream is closed locally.
+		return nil
+	}
+	switch t {
+	case FRAME_DATA:
+		if err := s.receive(payload); err != nil {
+			go s.Close()
+		}
+	case FRAME_FIN:
+		s.receiveFIN()
+	case FRAME_RESET:
+		self.remove(id)
+		s.receiveReset(ErrStreamReset)
+	case FRAME_WINDOW:
+		if len(payload) != 4 {
+			return ErrMalformedFrame
+		}
+		s.addCredit(binary.BigEndian.Uint32(payload))
+	default:
+		return fmt.Errorf("Unknown frame type: %d", t)
+	}
+	return nil
+}
+
+func (self *Session) isClosed() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done is closed once the session is closed.
+func (self *Session) Done() <-chan struct{} {
+	return self.done
+}
+
+// Err returns why the session is closed.
+func (self *Session) Err() error {
+	<-self.done
+	return self.err
+}
+
+func (self *Session) closeWithError(err error) {
+	self.closeOnce.Do(func() {
+		self.mu.Lock()
+		self.err = err
+		close(self.done)
+		streams := self.streams
+		self.streams = make(map[uint32]*Stream)
+		self.mu.Unlock()
+		core.CancelPort(self.p)
+		for _, s := range streams {
+			s.receiveReset(ErrSessionClosed)
+		}
+	})
+}
+
+// Close closes the session and its streams. The underlying port is
+// cancelled but not closed.
+func (self *Session) Close() error {
+	self.closeWithError(ErrSessionClosed)
+	return nil
+}
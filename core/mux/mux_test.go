@@ -0,0 +1,196 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bx/core"
+)
+
+func newSessionPair() (*Session, *Session) {
+	c := core.MakePipe()
+	client := NewSession(core.NewPort(c[0], &core.HTTPProtocol{}), true)
+	server := NewSession(core.NewPort(c[1], &core.HTTPProtocol{}), false)
+	return client, server
+}
+
+func TestStream(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+	s, err := client.Open("10.0.0.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.RemoteAddr().String() != "10.0.0.1:1234" {
+		t.Fatalf("Unexpected origin: %v", peer.RemoteAddr())
+	}
+	// Data exceeding the window is delivered once the peer reads.
+	data := make([]byte, 3*STREAM_WINDOW+17)
+	rand.Read(data)
+	go func() {
+		s.Write(data)
+		s.CloseWrite()
+	}()
+	got, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Received %d bytes, expected %d bytes", len(got), len(data))
+	}
+	// The other direction is still open.
+	if _, err := peer.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := s.Read(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("Unexpected read: %q %v", buf[:n], err)
+	}
+	peer.Close()
+	if _, err := s.Read(buf); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		for {
+			s, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func(s net.Conn) {
+				defer s.Close()
+				io.Copy(s, s)
+			}(s)
+		}
+	}()
+	// A stream nobody reads doesn't block others.
+	stalled, err := client.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stalled.Write(make([]byte, 4*STREAM_WINDOW))
+	done := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			s, err := client.Open("")
+			if err != nil {
+				done <- err
+				return
+			}
+			defer s.Close()
+			data := make([]byte, 64<<10)
+			rand.Read(data)
+			go s.Write(data)
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(s, got); err != nil {
+				done <- err
+				return
+			}
+			if !bytes.Equal(got, data) {
+				done <- io.ErrUnexpectedEOF
+				return
+			}
+			done <- nil
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out")
+		}
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	c := core.MakePipe()
+	client := NewSession(core.NewPort(c[0], &core.HTTPProtocol{}), true)
+	server := NewSession(core.NewPort(c[1], &core.HTTPProtocol{}), false)
+	s, err := client.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	c[1].Close()
+	if _, err := s.Read(make([]byte, 1)); err != ErrSessionClosed {
+		t.Fatalf("Expected ErrSessionClosed, got %v", err)
+	}
+	if _, err := client.Open(""); err != ErrSessionClosed {
+		t.Fatalf("Expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+	s, err := client.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := s.Read(make([]byte, 1)); err != os.ErrDeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestDeadlineWakesBlockedRead(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+	s, err := client.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetReadDeadline(time.Now().Add(time.Hour))
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// A deadline in the past interrupts the pending read, the way
+	// core.CancelPort does.
+	s.SetReadDeadline(time.Unix(1, 0))
+	select {
+	case err := <-done:
+		if err != os.ErrDeadlineExceeded {
+			t.Fatalf("Expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pending read isn't woken by the deadline")
+	}
+	// The stream is readable again once the deadline is cleared.
+	s.SetReadDeadline(time.Time{})
+	go func() {
+		_, err := s.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected read to block, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadline is a channel closed when the deadline set is exceeded.
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	c     chan struct{}
+}
+
+// set sets the deadline to t. The channel is kept unless it's closed
+// already, so that reads and writes blocked on it are woken by a deadline
+// set later, the way net.Pipe does.
+func (self *deadline) set(t time.Time) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.c == nil {
+		self.c = make(chan struct{})
+	}
+	if self.timer != nil && !self.timer.Stop() {
+		// Wait for the timer to close the channel.
+		<-self.c
+	}
+	self.timer = nil
+	closed := isClosed(self.c)
+	if t.IsZero() {
+		if closed {
+			self.c = make(chan struct{})
+		}
+		return
+	}
+	if d := time.Until(t); d > 0 {
+		if closed {
+			self.c = make(chan struct{})
+		}
+		c := self.c
+		self.timer = time.AfterFunc(d, func() { close(c) })
+		return
+	}
+	if !closed {
+		close(self.c)
+	}
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *deadline) wait() <-chan struct{} {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.c == nil {
+		self.c = make(chan struct{})
+	}
+	return self.c
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+type streamAddr string
+
+func (self streamAddr) Network() string {
+	return "mux"
+}
+
+func (self streamAddr) String() string {
+	return string(self)
+}
+
+// Stream is a net.Conn multiplexed in a session.
+type Stream struct {
+	session  *Session
+	id       uint32
+	addr     string
+	mu       sync.Mutex
+	buf      []byte
+	consumed uint32
+	credit   uint32
+	// Peer won't write anymore.
+	eof         bool
+	readClosed  bool
+	writeClosed bool
+	closed      bool
+	// Why the stream can't be written, once it's closed by peer.
+	err           error
+	readable      chan struct{}
+	writable      chan struct{}
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newStream(session *Session, id uint32, addr string) *Stream {
+	return &Stream{
+		session:  session,
+		id:       id,
+		addr:     addr,
+		credit:   STREAM_WINDOW,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func (self *Stream) receive(b []byte) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.readClosed {
+		// Data is discarded as it's read. Receiving goroutine of the
+		// session mustn't block on sending.
+		self.consumed += uint32(len(b))
+		if inc := self.windowIncrement(); inc != 0 {
+			go self.sendWindow(inc)
+		}
+		return nil
+	}
+	if len(self.buf)+len(b) > STREAM_WINDOW {
+		return fmt.Errorf("Stream #%d exceeds its window", self.id)
+	}
+	self.buf = append(self.buf, b...)
+	notify(self.readable)
+	return nil
+}
+
+// windowIncrement returns bytes consumed to announce to the peer, if they
+// are many enough. It's called with self.mu held.
+func (self *Stream) windowIncrement() uint32 {
+	if self.consumed < STREAM_WINDOW/2 || self.closed {
+		return 0
+	}
+	inc := self.consumed
+	self.consumed = 0
+	return inc
+}
+
+func (self *Stream) sendWindow(inc uint32) error {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], inc)
+	return self.session.send(FRAME_WINDOW, self.id, b[:])
+}
+
+func (self *Stream) receiveFIN() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.eof = true
+	notify(self.readable)
+}
+
+func (self *Stream) receiveReset(err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	// Data received before the peer closed the stream is still readable.
+	if err == ErrStreamReset {
+		self.eof = true
+	}
+	if self.err == nil {
+		self.err = err
+	}
+	notify(self.readable)
+	notify(self.writable)
+}
+
+func (self *Stream) addCredit(n uint32) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.credit += n
+	notify(self.writable)
+}
+
+func (self *Stream) Read(b []byte) (int, error) {
+	for {
+		self.mu.Lock()
+		if self.closed || self.readClosed {
+			self.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(self.buf) != 0 {
+			n := copy(b, self.buf)
+			self.buf = self.buf[n:]
+			self.consumed += uint32(n)
+			inc := self.windowIncrement()
+			self.mu.Unlock()
+			if inc != 0 {
+				if err := self.sendWindow(inc); err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		}
+		if self.eof {
+			self.mu.Unlock()
+			return 0, io.EOF
+		}
+		if self.err != nil {
+			err := self.err
+			self.mu.Unlock()
+			return 0, err
+		}
+		self.mu.Unlock()
+		select {
+		case <-self.readable:
+		case <-self.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (self *Stream) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) != 0 {
+		self.mu.Lock()
+		if self.closed || self.writeClosed {
+			self.mu.Unlock()
+			return n, net.ErrClosed
+		}
+		if self.err != nil {
+			err := self.err
+			self.mu.Unlock()
+			return n, err
+		}
+		if self.credit == 0 {
+			self.mu.Unlock()
+			select {
+			case <-self.writable:
+			case <-self.writeDeadline.wait():
+				return n, os.ErrDeadlineExceeded
+			}
+			continue
+		}
+		size := len(b)
+		if size > MAX_FRAME_PAYLOAD {
+			size = MAX_FRAME_PAYLOAD
+		}
+		if uint32(size) > self.credit {
+			size = int(self.credit)
+		}
+		self.credit -= uint32(size)
+		self.mu.Unlock()
+		if err := self.session.send(FRAME_DATA, self.id, b[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// CloseRead discards data received afterwards.
+func (self *Stream) CloseRead() error {
+	self.mu.Lock()
+	if self.readClosed || self.closed {
+		self.mu.Unlock()
+		return nil
+	}
+	self.readClosed = true
+	self.consumed += uint32(len(self.buf))
+	self.buf = nil
+	inc := self.windowIncrement()
+	self.mu.Unlock()
+	notify(self.readable)
+	if inc != 0 {
+		return self.sendWindow(inc)
+	}
+	return nil
+}
+
+func (self *Stream) CloseWrite() error {
+	self.mu.Lock()
+	if self.writeClosed || self.closed {
+		self.mu.Unlock()
+		return nil
+	}
+	self.writeClosed = true
+	err := self.err
+	self.mu.Unlock()
+	notify(self.writable)
+	if err != nil {
+		return nil
+	}
+	return self.session.send(FRAME_FIN, self.id, nil)
+}
+
+func (self *Stream) Close() error {
+	self.mu.Lock()
+	if self.closed {
+		self.mu.Unlock()
+		return nil
+	}
+	self.closed = true
+	self.buf = nil
+	err := self.err
+	self.mu.Unlock()
+	notify(self.readable)
+	notify(self.writable)
+	if err != nil {
+		// The peer has closed it or the session is gone.
+		return nil
+	}
+	self.session.remove(self.id)
+	return self.session.send(FRAME_RESET, self.id, nil)
+}
+
+func (self *Stream) LocalAddr() net.Addr {
+	return streamAddr(fmt.Sprintf("mux#%d", self.id))
+}
+
+// RemoteAddr returns the origin of the stream passed to Open.
+func (self *Stream) RemoteAddr() net.Addr {
+	return streamAddr(self.addr)
+}
+
+func (self *Stream) SetDeadline(t time.Time) error {
+	self.readDeadline.set(t)
+	self.writeDeadline.set(t)
+	return nil
+}
+
+func (self *Stream) SetReadDeadline(t time.Time) error {
+	self.readDeadline.set(t)
+	return nil
+}
+
+func (self *Stream) SetWriteDeadline(t time.Time) error {
+	self.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,217 @@
+package netstack
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeDev is an in-memory device. Packets sent to in are read by the stack
+// and packets written by the stack arrive at out.
+type pipeDev struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newPipeDev() *pipeDev {
+	return &pipeDev{in: make(chan []byte, 64), out: make(chan []byte, 64)}
+}
+
+func (self *pipeDev) Read(b []byte) (int, error) {
+	p, ok := <-self.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, p), nil
+}
+
+func (self *pipeDev) Write(b []byte) (int, error) {
+	p := make([]byte, len(b))
+	copy(p, b)
+	self.out <- p
+	return len(b), nil
+}
+
+var (
+	peer   = [4]byte{10, 0, 0, 1}
+	remote = [4]byte{1, 2, 3, 4}
+)
+
+func validChecksum(t *testing.T, b []byte) *ipv4Packet {
+	if finishChecksum(checksum(0, b[:IPV4_HEADER_SIZE])) != 0 {
+		t.Fatal("Invalid IP checksum")
+	}
+	p, err := parseIPv4(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := checksum(0, p.src[:])
+	sum = checksum(sum, p.dst[:])
+	sum += uint32(p.proto) + uint32(len(p.payload))
+	if finishChecksum(checksum(sum, p.payload)) != 0 {
+		t.Fatal("Invalid L4 checksum")
+	}
+	return p
+}
+
+func receiveTCP(t *testing.T, dev *pipeDev) *tcpSegment {
+	select {
+	case b := <-dev.out:
+		p := validChecksum(t, b)
+		if p.src != remote || p.dst != peer {
+			t.Fatalf("Unexpected addresses: %v -> %v", p.src, p.dst)
+		}
+		s, err := parseTCP(p.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out receiving segment")
+	}
+	return nil
+}
+
+func sendTCP(dev *pipeDev, seq, ack uint32, flags byte, payload string) {
+	dev.in <- buildTCP(peer, remote, &tcpSegment{
+		srcPort: 40000,
+		dstPort: 80,
+		seq:     seq,
+		ack:     ack,
+		flags:   flags,
+		window:  TCP_WINDOW,
+		payload: []byte(payload),
+	})
+}
+
+func TestTCP(t *testing.T) {
+	dev := newPipeDev()
+	conns := make(chan net.Conn, 1)
+	s := &Stack{Dev: dev, HandleTCP: func(c net.Conn) { conns <- c }}
+	go s.Run()
+	defer close(dev.in)
+	sendTCP(dev, 1000, 0, TCP_SYN, "")
+	synack := receiveTCP(t, dev)
+	if synack.flags != TCP_SYN|TCP_ACK || synack.ack != 1001 || synack.mss == 0 {
+		t.Fatalf("Unexpected SYN-ACK: %+v", synack)
+	}
+	iss := synack.seq
+	sendTCP(dev, 1001, iss+1, TCP_ACK, "hello")
+	c := <-conns
+	if c.LocalAddr().String() != "1.2.3.4:80" || c.RemoteAddr().String() != "10.0.0.1:40000" {
+		t.Fatalf("Unexpected addresses: %v %v", c.LocalAddr(), c.RemoteAddr())
+	}
+	if s := receiveTCP(t, dev); s.ack != 1006 {
+		t.Fatalf("Expected ACK of data, got %+v", s)
+	}
+	buf := make([]byte, 16)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Unexpected read: %q %v", buf[:n], err)
+	}
+	c.Write([]byte("world"))
+	data := receiveTCP(t, dev)
+	if string(data.payload) != "world" || data.seq != iss+1 {
+		t.Fatalf("Unexpected data: %+v", data)
+	}
+	// Unacknowledged data is retransmitted.
+	if s := receiveTCP(t, dev); string(s.payload) != "world" || s.seq != iss+1 {
+		t.Fatalf("Expected retransmission, got %+v", s)
+	}
+	sendTCP(dev, 1006, iss+6, TCP_ACK, "")
+	c.(interface{ CloseWrite() error }).CloseWrite()
+	fin := receiveTCP(t, dev)
+	if fin.flags&TCP_FIN == 0 || fin.seq != iss+6 {
+		t.Fatalf("Expected FIN, got %+v", fin)
+	}
+	sendTCP(dev, 1006, iss+7, TCP_ACK|TCP_FIN, "")
+	if s := receiveTCP(t, dev); s.ack != 1007 {
+		t.Fatalf("Expected ACK of FIN, got %+v", s)
+	}
+	if _, err := c.Read(buf); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+	// The connection is gone.
+	sendTCP(dev, 1007, iss+7, TCP_ACK, "x")
+	if s := receiveTCP(t, dev); s.flags&TCP_RST == 0 {
+		t.Fatalf("Expected RST, got %+v", s)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	dev := newPipeDev()
+	s := &Stack{Dev: dev, HandleUDP: func(c net.Conn) {
+		defer c.Close()
+		buf := make([]byte, 16)
+		n, _ := c.Read(buf)
+		c.Write(append([]byte("re: "), buf[:n]...))
+	}}
+	go s.Run()
+	defer close(dev.in)
+	dev.in <- buildUDP(peer, remote, &udpDatagram{srcPort: 40000, dstPort: 53, payload: []byte("ping")})
+	select {
+	case b := <-dev.out:
+		p := validChecksum(t, b)
+		d, err := parseUDP(p.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.src != remote || p.dst != peer || d.srcPort != 53 || d.dstPort != 40000 || string(d.payload) != "re: ping" {
+			t.Fatalf("Unexpected reply: %+v %+v", p, d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out receiving datagram")
+	}
+}
+
+func TestUDPFlowCap(t *testing.T) {
+	dev := newPipeDev()
+	release := make(chan struct{})
+	handled := make(chan net.Conn, MAX_UDP_FLOWS+1)
+	s := &Stack{Dev: dev, HandleUDP: func(c net.Conn) {
+		handled <- c
+		<-release
+		c.Close()
+	}}
+	go s.Run()
+	defer close(dev.in)
+	send := func(port uint16) {
+		dev.in <- buildUDP(peer, remote, &udpDatagram{srcPort: port, dstPort: 53, payload: []byte("ping")})
+	}
+	for i := 0; i <= MAX_UDP_FLOWS; i++ {
+		send(uint16(10000 + i))
+	}
+	for i := 0; i < MAX_UDP_FLOWS; i++ {
+		<-handled
+	}
+	// Flows are closed once released, admitting new ones.
+	close(release)
+	for {
+		s.mu.Lock()
+		n := len(s.udpConns)
+		s.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	send(20000)
+	select {
+	case c := <-handled:
+		if c.RemoteAddr().(*net.UDPAddr).Port != 20000 {
+			t.Fatalf("Expected flow beyond the cap dropped, got %v", c.RemoteAddr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out handling flow")
+	}
+}
+
+func TestFragment(t *testing.T) {
+	b := buildUDP(peer, remote, &udpDatagram{srcPort: 1, dstPort: 2})
+	// Set MF flag.
+	b[6] |= 0x20
+	if _, err := parseIPv4(b); err != ErrFragmented {
+		t.Fatalf("Expected ErrFragmented, got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package netstack
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	PROTO_TCP = 6
+	PROTO_UDP = 17
+)
+
+const (
+	IPV4_HEADER_SIZE = 20
+	TCP_HEADER_SIZE  = 20
+	UDP_HEADER_SIZE  = 8
+)
+
+const (
+	TCP_FIN = 1 << iota
+	TCP_SYN
+	TCP_RST
+	TCP_PSH
+	TCP_ACK
+)
+
+const TCP_OPTION_MSS = 2
+
+var (
+	ErrMalformed  = errors.New("Malformed packet")
+	ErrFragmented = errors.New("Fragmented packet")
+	ErrNotIPv4    = errors.New("Not an IPv4 packet")
+)
+
+type ipv4Packet struct {
+	src     [4]byte
+	dst     [4]byte
+	proto   byte
+	payload []byte
+}
+
+func parseIPv4(b []byte) (*ipv4Packet, error) {
+	if len(b) < IPV4_HEADER_SIZE {
+		return nil, ErrMalformed
+	}
+	if b[0]>>4 != 4 {
+		return nil, ErrNotIPv4
+	}
+	ihl := int(b[0]&0xf) * 4
+	total := int(binary.BigEndian.Uint16(b[2:]))
+	if ihl < IPV4_HEADER_SIZE || total < ihl || total > len(b) {
+		return nil, ErrMalformed
+	}
+	// MF flag or fragment offset.
+	if binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+		return nil, ErrFragmented
+	}
+	p := &ipv4Packet{proto: b[9], payload: b[ihl:total]}
+	copy(p.src[:], b[12:16])
+	copy(p.dst[:], b[16:20])
+	return p, nil
+}
+
+func checksum(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func finishChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// buildIPv4 builds an IPv4 packet carrying l4, whose checksum at csumOffset
+// is filled as well.
+func buildIPv4(src, dst [4]byte, proto byte, l4 []byte, csumOffset int) []byte {
+	b := make([]byte, IPV4_HEADER_SIZE+len(l4))
+	b[0] = 4<<4 | IPV4_HEADER_SIZE/4
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	// Don't fragment.
+	binary.BigEndian.PutUint16(b[6:], 0x4000)
+	b[8] = 64
+	b[9] = proto
+	copy(b[12:], src[:])
+	copy(b[16:], dst[:])
+	binary.BigEndian.PutUint16(b[10:], finishChecksum(checksum(0, b[:IPV4_HEADER_SIZE])))
+	copy(b[IPV4_HEADER_SIZE:], l4)
+	l4 = b[IPV4_HEADER_SIZE:]
+	// Pseudo header.
+	sum := checksum(0, src[:])
+	sum = checksum(sum, dst[:])
+	sum += uint32(proto) + uint32(len(l4))
+	csum := finishChecksum(checksum(sum, l4))
+	if csum == 0 && proto == PROTO_UDP {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(l4[csumOffset:], csum)
+	return b
+}
+
+type tcpSegment struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	ack     uint32
+	flags   byte
+	window  uint16
+	// MSS option, 0 if absent.
+	mss     uint16
+	payload []byte
+}
+
+func parseTCP(b []byte) (*tcpSegment, error) {
+	if len(b) < TCP_HEADER_SIZE {
+		return nil, ErrMalformed
+	}
+	off := int(b[12]>>4) * 4
+	if off < TCP_HEADER_SIZE || off > len(b) {
+		return nil, ErrMalformed
+	}
+	s := &tcpSegment{
+		srcPort: binary.BigEndian.Uint16(b),
+		dstPort: binary.BigEndian.Uint16(b[2:]),
+		seq:     binary.BigEndian.Uint32(b[4:]),
+		ack:     binary.BigEndian.Uint32(b[8:]),
+		flags:   b[13],
+		window:  binary.BigEndian.Uint16(b[14:]),
+		payload: b[off:],
+	}
+	for opts := b[TCP_HEADER_SIZE:off]; len(opts) > 0; {
+		switch opts[0] {
+		case 0:
+			opts = nil
+			continue
+		case 1:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return nil, ErrMalformed
+		}
+		if opts[0] == TCP_OPTION_MSS && opts[1] == 4 {
+			s.mss = binary.BigEndian.Uint16(opts[2:])
+		}
+		opts = opts[opts[1]:]
+	}
+	return s, nil
+}
+
+func buildTCP(src, dst [4]byte, s *tcpSegment) []byte {
+	hlen := TCP_HEADER_SIZE
+	if s.mss != 0 {
+		hlen += 4
+	}
+	b := make([]byte, hlen+len(s.payload))
+	binary.BigEndian.PutUint16(b, s.srcPort)
+	binary.BigEndian.PutUint16(b[2:], s.dstPort)
+	binary.BigEndian.PutUint32(b[4:], s.seq)
+	binary.BigEndian.PutUint32(b[8:], s.ack)
+	b[12] = byte(hlen/4) << 4
+	b[13] = s.flags
+	binary.BigEndian.PutUint16(b[14:], s.window)
+	if s.mss != 0 {
+		b[20] = TCP_OPTION_MSS
+		b[21] = 4
+		binary.BigEndian.PutUint16(b[22:], s.mss)
+	}
+	copy(b[hlen:], s.payload)
+	return buildIPv4(src, dst, PROTO_TCP, b, 16)
+}
+
+type udpDatagram struct {
+	srcPort uint16
+	dstPort uint16
+	payload []byte
+}
+
+func parseUDP(b []byte) (*udpDatagram, error) {
+	if len(b) < UDP_HEADER_SIZE {
+		return nil, ErrMalformed
+	}
+	l := int(binary.BigEndian.Uint16(b[4:]))
+	if l < UDP_HEADER_SIZE || l > len(b) {
+		return nil, ErrMalformed
+	}
+	return &udpDatagram{
+		srcPort: binary.BigEndian.Uint16(b),
+		dstPort: binary.BigEndian.Uint16(b[2:]),
+		payload: b[UDP_HEADER_SIZE:l],
+	}, nil
+}
+
+func buildUDP(src, dst [4]byte, d *udpDatagram) []byte {
+	b := make([]byte, UDP_HEADER_SIZE+len(d.payload))
+	binary.BigEndian.PutUint16(b, d.srcPort)
+	binary.BigEndian.PutUint16(b[2:], d.dstPort)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+	copy(b[UDP_HEADER_SIZE:], d.payload)
+	return buildIPv4(src, dst, PROTO_UDP, b, 6)
+}
+
+func ipOf(a [4]byte) net.IP {
+	return net.IPv4(a[0], a[1], a[2], a[3]).To4()
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+// Package netstack is a minimal userspace TCP/IP stack terminating TCP and UDP
+// flows carried by IPv4 packets, as a TUN device delivers them, so that they
+// can be relayed like connections accepted by a proxy.
+//
+// It's not a general purpose stack. It only accepts flows initiated by the
+// peer, doesn't reassemble IP fragments and drops IPv6 packets. TCP uses
+// go-back-N retransmission without window scaling, SACK or congestion
+// control, which suffices for the lossless link between the kernel and a
+// TUN device.
+package netstack
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+const DEFAULT_MTU = 1500
+
+// Maximum number of UDP flows handled at a time. Datagrams of new flows are
+// dropped beyond it.
+const MAX_UDP_FLOWS = 1024
+
+type flowID struct {
+	// The peer.
+	src     [4]byte
+	srcPort uint16
+	// The original destination.
+	dst     [4]byte
+	dstPort uint16
+}
+
+// Stack reads IP packets from Dev and hands TCP and UDP flows in them to
+// HandleTCP and HandleUDP as net.Conn. LocalAddr of a flow is its original
+// destination and RemoteAddr is the peer. UDP flows are packet oriented, each
+// Read returns a datagram and each Write sends one.
+type Stack struct {
+	Dev       io.ReadWriter
+	MTU       int
+	HandleTCP func(net.Conn)
+	HandleUDP func(net.Conn)
+	wmu       sync.Mutex
+	mu        sync.Mutex
+	tcpConns  map[flowID]*tcpConn
+	udpConns  map[flowID]*udpConn
+}
+
+func (self *Stack) mtu() int {
+	if self.MTU <= 0 {
+		return DEFAULT_MTU
+	}
+	return self.MTU
+}
+
+// Run processes packets from Dev until reading Dev fails.
+func (self *Stack) Run() error {
+	self.mu.Lock()
+	if self.tcpConns == nil {
+		self.tcpConns = make(map[flowID]*tcpConn)
+		self.udpConns = make(map[flowID]*udpConn)
+	}
+	self.mu.Unlock()
+	buf := make([]byte, 0xffff)
+	for {
+		n, err := self.Dev.Read(buf)
+		if err != nil {
+			return err
+		}
+		self.input(buf[:n])
+	}
+}
+
+func (self *Stack) writePacket(b []byte) {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+	if _, err := self.Dev.Write(b); err != nil {
+		log.Println(err)
+	}
+}
+
+func (self *Stack) input(b []byte) {
+	p, err := parseIPv4(b)
+	if err != nil {
+		return
+	}
+	switch p.proto {
+	case PROTO_TCP:
+		s, err := parseTCP(p.payload)
+		if err != nil {
+			return
+		}
+		self.inputTCP(flowID{p.src, s.srcPort, p.dst, s.dstPort}, s)
+	case PROTO_UDP:
+		d, err := parseUDP(p.payload)
+		if err != nil {
+			return
+		}
+		self.inputUDP(flowID{p.src, d.srcPort, p.dst, d.dstPort}, d)
+	}
+}
+
+func (self *Stack) inputTCP(id flowID, s *tcpSegment) {
+	self.mu.Lock()
+	c := self.tcpConns[id]
+	if c == nil && s.flags&(TCP_SYN|TCP_ACK|TCP_RST) == TCP_SYN && self.HandleTCP != nil {
+		c = newTCPConn(self, id, s, rand.Uint32())
+		self.tcpConns[id] = c
+		self.mu.Unlock()
+		c.start()
+		return
+	}
+	self.mu.Unlock()
+	if c == nil {
+		self.resetTCP(id, s)
+		return
+	}
+	c.input(s)
+}
+
+// resetTCP answers s, which belongs to no connection, with RST.
+func (self *Stack) resetTCP(id flowID, s *tcpSegment) {
+	if s.flags&TCP_RST != 0 {
+		return
+	}
+	r := &tcpSegment{srcPort: id.dstPort, dstPort: id.srcPort, flags: TCP_RST}
+	if s.flags&TCP_ACK != 0 {
+		r.seq = s.ack
+	} else {
+		r.flags |= TCP_ACK
+		r.ack = s.seq + uint32(len(s.payload))
+		if s.flags&TCP_SYN != 0 {
+			r.ack += 1
+		}
+		if s.flags&TCP_FIN != 0 {
+			r.ack += 1
+		}
+	}
+	self.writePacket(buildTCP(id.dst, id.src, r))
+}
+
+func (self *Stack) removeTCP(id flowID) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.tcpConns, id)
+}
+
+func (self *Stack) inputUDP(id flowID, d *udpDatagram) {
+	if self.HandleUDP == nil {
+		return
+	}
+	self.mu.Lock()
+	c := self.udpConns[id]
+	if c == nil {
+		if len(self.udpConns) >= MAX_UDP_FLOWS {
+			self.mu.Unlock()
+			return
+		}
+		c = newUDPConn(self, id)
+		self.udpConns[id] = c
+		go self.HandleUDP(c)
+	}
+	self.mu.Unlock()
+	c.deliver(d.payload)
+}
+
+func (self *Stack) removeUDP(id flowID) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.udpConns, id)
+}
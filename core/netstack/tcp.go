@@ -0,0 +1,507 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package netstack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Window scaling isn't negotiated.
+	TCP_WINDOW           = 0xffff
+	TCP_SEND_BUFFER_SIZE = 1 << 18
+	TCP_DEFAULT_MSS      = 536
+	TCP_INITIAL_RTO      = 200 * time.Millisecond
+	TCP_MAX_RTO          = 10 * time.Second
+	TCP_MAX_RETRIES      = 10
+	// How long a closed connection waits for the peer to close.
+	TCP_LINGER = 30 * time.Second
+)
+
+var ErrTimedOut = errors.New("TCP retransmission timed out")
+
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// tcpConn is the passive side of a TCP connection initiated by the peer.
+type tcpConn struct {
+	stack *Stack
+	id    flowID
+	mss   int
+	mu    sync.Mutex
+	cond  *sync.Cond
+	// Handshake is completed.
+	established bool
+	rcvNxt      uint32
+	sndUna      uint32
+	sndNxt      uint32
+	// Highest sequence number ever sent, sndNxt goes back on retransmission.
+	sndMax uint32
+	sndWnd uint32
+	// An ACK arrived since last timeout.
+	acked   bool
+	recvBuf []byte
+	// Unacknowledged and unsent data, starting at sndUna.
+	sendBuf     []byte
+	finRcvd     bool
+	readClosed  bool
+	writeClosed bool
+	finSent     bool
+	finAcked    bool
+	// Removed from the stack.
+	done          bool
+	err           error
+	rto           time.Duration
+	retries       int
+	timer         *time.Timer
+	timerGen      uint64
+	linger        *time.Timer
+	readDeadline  time.Time
+	writeDeadline time.Time
+	rdTimer       *time.Timer
+	wdTimer       *time.Timer
+}
+
+func newTCPConn(stack *Stack, id flowID, syn *tcpSegment, iss uint32) *tcpConn {
+	mss := TCP_DEFAULT_MSS
+	if syn.mss != 0 {
+		mss = int(syn.mss)
+	}
+	c := &tcpConn{
+		stack:  stack,
+		id:     id,
+		mss:    minInt(mss, stack.mtu()-IPV4_HEADER_SIZE-TCP_HEADER_SIZE),
+		rcvNxt: syn.seq + 1,
+		sndUna: iss,
+		sndNxt: iss + 1,
+		sndMax: iss + 1,
+		sndWnd: uint32(syn.window),
+		rto:    TCP_INITIAL_RTO,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (self *tcpConn) start() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.sendSYNACK()
+	self.armTimer()
+}
+
+func (self *tcpConn) window() uint16 {
+	if len(self.recvBuf) >= TCP_WINDOW {
+		return 0
+	}
+	return uint16(TCP_WINDOW - len(self.recvBuf))
+}
+
+func (self *tcpConn) send(seq uint32, flags byte, payload []byte) {
+	self.stack.writePacket(buildTCP(self.id.dst, self.id.src, &tcpSegment{
+		srcPort: self.id.dstPort,
+		dstPort: self.id.srcPort,
+		seq:     seq,
+		ack:     self.rcvNxt,
+		flags:   flags,
+		window:  self.window(),
+		payload: payload,
+	}))
+}
+
+func (self *tcpConn) sendSYNACK() {
+	self.stack.writePacket(buildTCP(self.id.dst, self.id.src, &tcpSegment{
+		srcPort: self.id.dstPort,
+		dstPort: self.id.srcPort,
+		seq:     self.sndUna,
+		ack:     self.rcvNxt,
+		flags:   TCP_SYN | TCP_ACK,
+		window:  self.window(),
+		mss:     uint16(self.stack.mtu() - IPV4_HEADER_SIZE - TCP_HEADER_SIZE),
+	}))
+}
+
+func (self *tcpConn) sendACK() {
+	self.send(self.sndNxt, TCP_ACK, nil)
+}
+
+func (self *tcpConn) advance(n int) {
+	self.sndNxt += uint32(n)
+	if seqLT(self.sndMax, self.sndNxt) {
+		self.sndMax = self.sndNxt
+	}
+}
+
+func (self *tcpConn) input(s *tcpSegment) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.done {
+		return
+	}
+	if s.flags&TCP_RST != 0 {
+		if d := s.seq - self.rcvNxt; d <= TCP_WINDOW {
+			self.abort(syscall.ECONNRESET, false)
+		}
+		return
+	}
+	if !self.established {
+		if s.flags&TCP_SYN != 0 {
+			self.sendSYNACK()
+			return
+		}
+		if s.flags&TCP_ACK == 0 || s.ack != self.sndNxt {
+			return
+		}
+		self.established = true
+		self.sndUna = s.ack
+		self.sndWnd = uint32(s.window)
+		self.retries = 0
+		self.rto = TCP_INITIAL_RTO
+		self.stopTimer()
+		go self.stack.HandleTCP(self)
+	} else if s.flags&TCP_SYN != 0 {
+		self.sendACK()
+		return
+	}
+	if s.flags&TCP_ACK != 0 {
+		self.inputACK(s)
+	}
+	self.inputData(s)
+	self.output()
+	if self.finRcvd && self.finAcked {
+		self.finish(nil)
+	}
+}
+
+func (self *tcpConn) inputACK(s *tcpSegment) {
+	if seqLT(self.sndUna, s.ack) && !seqLT(self.sndMax, s.ack) {
+		n := int(s.ack - self.sndUna)
+		if n > len(self.sendBuf) {
+			// Only FIN follows data.
+			self.finSent = true
+			self.finAcked = true
+			n = len(self.sendBuf)
+		}
+		self.sendBuf = self.sendBuf[n:]
+		self.sndUna = s.ack
+		if seqLT(self.sndNxt, s.ack) {
+			self.sndNxt = s.ack
+		}
+		self.retries = 0
+		self.rto = TCP_INITIAL_RTO
+		self.stopTimer()
+		self.cond.Broadcast()
+	}
+	if !seqLT(s.ack, self.sndUna) {
+		self.sndWnd = uint32(s.window)
+		self.acked = true
+	}
+}
+
+func (self *tcpConn) inputData(s *tcpSegment) {
+	payload := s.payload
+	fin := s.flags&TCP_FIN != 0
+	if len(payload) == 0 && !fin {
+		return
+	}
+	seq := s.seq
+	if d := int32(self.rcvNxt - seq); d > 0 {
+		if int(d) > len(payload) {
+			// Retransmitted.
+			self.sendACK()
+			return
+		}
+		payload = payload[d:]
+		seq = self.rcvNxt
+	}
+	// Out of order segments are dropped, the peer will retransmit them.
+	if seq != self.rcvNxt || self.finRcvd {
+		self.sendACK()
+		return
+	}
+	n := len(payload)
+	if !self.readClosed {
+		n = minInt(n, int(self.window()))
+		self.recvBuf = append(self.recvBuf, payload[:n]...)
+	}
+	self.rcvNxt += uint32(n)
+	if n == len(payload) && fin {
+		self.finRcvd = true
+		self.rcvNxt += 1
+	}
+	self.cond.Broadcast()
+	self.sendACK()
+}
+
+// output sends data and FIN as far as the peer's window allows.
+func (self *tcpConn) output() {
+	if !self.established || self.done {
+		return
+	}
+	for !self.finSent {
+		off := int(self.sndNxt - self.sndUna)
+		pending := len(self.sendBuf) - off
+		if pending == 0 {
+			if self.writeClosed {
+				self.send(self.sndNxt, TCP_ACK|TCP_FIN, nil)
+				self.finSent = true
+				self.advance(1)
+			}
+			break
+		}
+		wnd := int(self.sndWnd) - off
+		if wnd <= 0 {
+			break
+		}
+		n := minInt(minInt(pending, self.mss), wnd)
+		self.send(self.sndNxt, TCP_ACK|TCP_PSH, self.sendBuf[off:off+n])
+		self.advance(n)
+	}
+	self.armTimer()
+}
+
+func (self *tcpConn) outstanding() bool {
+	return !self.established || self.sndNxt != self.sndUna ||
+		len(self.sendBuf) > int(self.sndNxt-self.sndUna) || (self.writeClosed && !self.finSent)
+}
+
+func (self *tcpConn) armTimer() {
+	if self.done || !self.outstanding() {
+		self.stopTimer()
+		return
+	}
+	if self.timer == nil {
+		self.timerGen += 1
+		gen := self.timerGen
+		self.timer = time.AfterFunc(self.rto, func() { self.onTimeout(gen) })
+	}
+}
+
+func (self *tcpConn) stopTimer() {
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+}
+
+// onTimeout retransmits from sndUna. With zero window, the first segment
+// probes the window.
+func (self *tcpConn) onTimeout(gen uint64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.timer == nil || gen != self.timerGen || self.done {
+		return
+	}
+	self.timer = nil
+	// Probing zero window of a live peer doesn't count as retry.
+	if self.sndWnd != 0 || !self.acked {
+		self.retries += 1
+	}
+	self.acked = false
+	if self.retries > TCP_MAX_RETRIES {
+		self.abort(ErrTimedOut, true)
+		return
+	}
+	self.rto *= 2
+	if self.rto > TCP_MAX_RTO {
+		self.rto = TCP_MAX_RTO
+	}
+	if !self.established {
+		self.sendSYNACK()
+		self.armTimer()
+		return
+	}
+	self.sndNxt = self.sndUna
+	self.finSent = false
+	if len(self.sendBuf) > 0 {
+		n := minInt(len(self.sendBuf), self.mss)
+		self.send(self.sndNxt, TCP_ACK|TCP_PSH, self.sendBuf[:n])
+		self.advance(n)
+	} else if self.writeClosed {
+		self.send(self.sndNxt, TCP_ACK|TCP_FIN, nil)
+		self.finSent = true
+		self.advance(1)
+	}
+	self.output()
+}
+
+// finish removes the connection from the stack. Received data is still
+// readable.
+func (self *tcpConn) finish(err error) {
+	if self.done {
+		return
+	}
+	self.done = true
+	self.err = err
+	self.stopTimer()
+	if self.linger != nil {
+		self.linger.Stop()
+	}
+	self.stack.removeTCP(self.id)
+	self.cond.Broadcast()
+}
+
+func (self *tcpConn) abort(err error, sendRST bool) {
+	if sendRST {
+		self.send(self.sndNxt, TCP_RST|TCP_ACK, nil)
+	}
+	self.finish(err)
+}
+
+func expired(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+func (self *tcpConn) Read(b []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for len(self.recvBuf) == 0 && !self.finRcvd && !self.readClosed && !self.done && !expired(self.readDeadline) {
+		self.cond.Wait()
+	}
+	if len(self.recvBuf) > 0 {
+		old := self.window()
+		n := copy(b, self.recvBuf)
+		self.recvBuf = self.recvBuf[n:]
+		if len(self.recvBuf) == 0 {
+			self.recvBuf = nil
+		}
+		// Tell the peer the window opens.
+		if old < TCP_WINDOW/2 && self.window() >= TCP_WINDOW/2 && !self.done {
+			self.sendACK()
+		}
+		return n, nil
+	}
+	if self.err != nil {
+		return 0, self.err
+	}
+	if self.readClosed {
+		return 0, net.ErrClosed
+	}
+	if expired(self.readDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return 0, io.EOF
+}
+
+func (self *tcpConn) Write(b []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	total := 0
+	for len(b) > 0 {
+		for len(self.sendBuf) >= TCP_SEND_BUFFER_SIZE && !self.writeClosed && !self.done && !expired(self.writeDeadline) {
+			self.cond.Wait()
+		}
+		if self.err != nil {
+			return total, self.err
+		}
+		if self.writeClosed || self.done {
+			return total, net.ErrClosed
+		}
+		if expired(self.writeDeadline) {
+			return total, os.ErrDeadlineExceeded
+		}
+		n := minInt(len(b), TCP_SEND_BUFFER_SIZE-len(self.sendBuf))
+		self.sendBuf = append(self.sendBuf, b[:n]...)
+		b = b[n:]
+		total += n
+		self.output()
+	}
+	return total, nil
+}
+
+func (self *tcpConn) CloseRead() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.readClosed = true
+	self.recvBuf = nil
+	self.cond.Broadcast()
+	return nil
+}
+
+// CloseWrite sends FIN after buffered data.
+func (self *tcpConn) CloseWrite() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if !self.writeClosed {
+		self.writeClosed = true
+		self.output()
+		self.cond.Broadcast()
+	}
+	return nil
+}
+
+// Close closes both directions. The connection is reset if the peer doesn't
+// close within TCP_LINGER.
+func (self *tcpConn) Close() error {
+	self.CloseRead()
+	self.CloseWrite()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if !self.done && self.linger == nil {
+		self.linger = time.AfterFunc(TCP_LINGER, func() {
+			self.mu.Lock()
+			defer self.mu.Unlock()
+			self.abort(nil, true)
+		})
+	}
+	return nil
+}
+
+func (self *tcpConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: ipOf(self.id.dst), Port: int(self.id.dstPort)}
+}
+
+func (self *tcpConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: ipOf(self.id.src), Port: int(self.id.srcPort)}
+}
+
+func (self *tcpConn) setDeadline(p *time.Time, timer **time.Timer, t time.Time) {
+	*p = t
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			self.mu.Lock()
+			defer self.mu.Unlock()
+			self.cond.Broadcast()
+		})
+	}
+	self.cond.Broadcast()
+}
+
+func (self *tcpConn) SetDeadline(t time.Time) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.setDeadline(&self.readDeadline, &self.rdTimer, t)
+	self.setDeadline(&self.writeDeadline, &self.wdTimer, t)
+	return nil
+}
+
+func (self *tcpConn) SetReadDeadline(t time.Time) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.setDeadline(&self.readDeadline, &self.rdTimer, t)
+	return nil
+}
+
+func (self *tcpConn) SetWriteDeadline(t time.Time) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.setDeadline(&self.writeDeadline, &self.wdTimer, t)
+	return nil
+}
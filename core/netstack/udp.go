@@ -0,0 +1,138 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package netstack
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Number of datagrams queued for a UDP flow before it's read.
+const UDP_QUEUE_SIZE = 64
+
+// deadline is a channel closed when the deadline set is exceeded.
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	c     chan struct{}
+}
+
+func (self *deadline) set(t time.Time) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+	c := make(chan struct{})
+	self.c = c
+	if t.IsZero() {
+		return
+	}
+	d := time.Until(t)
+	if d <= 0 {
+		close(c)
+		return
+	}
+	self.timer = time.AfterFunc(d, func() { close(c) })
+}
+
+func (self *deadline) wait() <-chan struct{} {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.c == nil {
+		self.c = make(chan struct{})
+	}
+	return self.c
+}
+
+type udpConn struct {
+	stack        *Stack
+	id           flowID
+	packets      chan []byte
+	closed       chan struct{}
+	closeOnce    sync.Once
+	readDeadline deadline
+}
+
+func newUDPConn(stack *Stack, id flowID) *udpConn {
+	return &udpConn{
+		stack:   stack,
+		id:      id,
+		packets: make(chan []byte, UDP_QUEUE_SIZE),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (self *udpConn) deliver(b []byte) {
+	p := make([]byte, len(b))
+	copy(p, b)
+	select {
+	case self.packets <- p:
+	default:
+		// Drop the datagram as a congested router does.
+	}
+}
+
+func (self *udpConn) Read(b []byte) (int, error) {
+	select {
+	case p := <-self.packets:
+		return copy(b, p), nil
+	case <-self.closed:
+		return 0, io.EOF
+	case <-self.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (self *udpConn) Write(b []byte) (int, error) {
+	select {
+	case <-self.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if len(b) > self.stack.mtu()-IPV4_HEADER_SIZE-UDP_HEADER_SIZE {
+		return 0, fmt.Errorf("Datagram of %d bytes exceeds MTU", len(b))
+	}
+	self.stack.writePacket(buildUDP(self.id.dst, self.id.src, &udpDatagram{
+		srcPort: self.id.dstPort,
+		dstPort: self.id.srcPort,
+		payload: b,
+	}))
+	return len(b), nil
+}
+
+func (self *udpConn) Close() error {
+	self.closeOnce.Do(func() {
+		self.stack.removeUDP(self.id)
+		close(self.closed)
+	})
+	return nil
+}
+
+func (self *udpConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: ipOf(self.id.dst), Port: int(self.id.dstPort)}
+}
+
+func (self *udpConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: ipOf(self.id.src), Port: int(self.id.srcPort)}
+}
+
+func (self *udpConn) SetDeadline(t time.Time) error {
+	self.readDeadline.set(t)
+	return nil
+}
+
+func (self *udpConn) SetReadDeadline(t time.Time) error {
+	self.readDeadline.set(t)
+	return nil
+}
+
+// Writes never block, so write deadline is ignored.
+func (self *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/bzEq/bx/core/iovec"
+)
+
+// Maximum size of a datagram.
+const MAX_DATAGRAM_SIZE = 64 << 10
+
+// EncodePacket encodes b into a datagram with p. b is left as is if p is nil.
+func EncodePacket(p Protocol, b *iovec.IoVec) ([]byte, error) {
+	if p == nil {
+		return b.Consume(), nil
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := p.Pack(b, w); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodePacket decodes datagram data encoded by EncodePacket into b.
+func DecodePacket(p Protocol, data []byte, b *iovec.IoVec) error {
+	if p == nil {
+		b.Take(data)
+		return nil
+	}
+	return p.Unpack(bufio.NewReaderSize(bytes.NewReader(data), len(data)), b)
+}
+
+// PacketPort carries a frame per datagram of C, so that a lost datagram
+// doesn't corrupt others. C is a connected packet conn, like the one
+// net.Dial("udp") returns.
+type PacketPort struct {
+	C       net.Conn
+	P       Protocol
+	timeout time.Duration
+	buf     []byte
+	cc      connCanceller
+}
+
+func NewPacketPort(c net.Conn, p Protocol, timeout int) *PacketPort {
+	return &PacketPort{
+		C:       c,
+		P:       p,
+		timeout: time.Duration(timeout) * time.Second,
+	}
+}
+
+func (self *PacketPort) Pack(b *iovec.IoVec) error {
+	data, err := EncodePacket(self.P, b)
+	if err != nil {
+		return err
+	}
+	if err := self.cc.setWriteDeadline(self.C, time.Now().Add(self.timeout)); err != nil {
+		return err
+	}
+	_, err = self.C.Write(data)
+	return self.cc.check(err)
+}
+
+func (self *PacketPort) Unpack(b *iovec.IoVec) error {
+	if self.buf == nil {
+		self.buf = make([]byte, MAX_DATAGRAM_SIZE)
+	}
+	if err := self.cc.setReadDeadline(self.C, time.Now().Add(self.timeout)); err != nil {
+		return err
+	}
+	for {
+		n, err := self.C.Read(self.buf)
+		if err != nil {
+			return self.cc.check(err)
+		}
+		data := make([]byte, n)
+		copy(data, self.buf[:n])
+		// Datagrams failing to decode are dropped, like lost ones.
+		if err := DecodePacket(self.P, data, b); err == nil {
+			return nil
+		}
+	}
+}
+
+func (self *PacketPort) Cancel() error {
+	return self.cc.cancel(self.C)
+}
+
+func (self *PacketPort) CloseRead() error {
+	return nil
+}
+
+func (self *PacketPort) CloseWrite() error {
+	return nil
+}
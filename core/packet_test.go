@@ -0,0 +1,54 @@
+package core
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bzEq/bx/core/iovec"
+)
+
+func TestPacketPort(t *testing.T) {
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("udp", ln.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	p := NewPacketPort(c, &HTTPProtocol{}, 5)
+	for _, s := range []string{"wtf", "wtfwtf"} {
+		if err := p.Pack(iovec.FromSlice([]byte(s))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+	var received [][]byte
+	for i := 0; i < 2; i++ {
+		n, _, err := ln.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, append([]byte{}, buf[:n]...))
+	}
+	// A malformed datagram is dropped without affecting following ones.
+	if _, err := ln.WriteTo([]byte("garbage"), c.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range received {
+		if _, err := ln.WriteTo(b, c.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range []string{"wtf", "wtfwtf"} {
+		var b iovec.IoVec
+		if err := p.Unpack(&b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b.Consume()) != expected {
+			t.Fatalf("Expected %q", expected)
+		}
+	}
+}
@@ -4,8 +4,12 @@ package core
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bzEq/bx/core/iovec"
@@ -17,21 +21,22 @@ const DEFAULT_BUFFER_LIMIT = 64 << 20
 const DEFAULT_UDP_TIMEOUT = 60
 const DEFAULT_UDP_BUFFER_SIZE = 2 << 10
 
+// HalfCloser is implemented by conns supporting half-close, like TCP and unix
+// conns and wrappers of them.
+type HalfCloser interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
 func CloseRead(c net.Conn) error {
-	if c, ok := c.(*net.TCPConn); ok {
-		return c.CloseRead()
-	}
-	if c, ok := c.(*net.UnixConn); ok {
+	if c, ok := c.(HalfCloser); ok {
 		return c.CloseRead()
 	}
 	return nil
 }
 
 func CloseWrite(c net.Conn) error {
-	if c, ok := c.(*net.TCPConn); ok {
-		return c.CloseWrite()
-	}
-	if c, ok := c.(*net.UnixConn); ok {
+	if c, ok := c.(HalfCloser); ok {
 		return c.CloseWrite()
 	}
 	return nil
@@ -44,29 +49,109 @@ type Port interface {
 	CloseWrite() error
 }
 
+var ErrPortCancelled = errors.New("Port is cancelled")
+
+// Canceller is implemented by ports whose pending and future Pack and Unpack
+// can be interrupted without closing the underlying connection.
+type Canceller interface {
+	Cancel() error
+}
+
+func CancelPort(p Port) error {
+	if c, ok := p.(Canceller); ok {
+		return c.Cancel()
+	}
+	return fmt.Errorf("Port %T is not cancellable", p)
+}
+
+// CancelPortWhenDone cancels p once ctx is done. Calling the returned function
+// releases the watch on ctx.
+func CancelPortWhenDone(ctx context.Context, p Port) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			CancelPort(p)
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connCanceller cancels IO on a net.Conn by moving its deadline to the past.
+// Deadlines set afterwards are checked against the cancelled flag, so that a
+// cancellation can't be overwritten by a later deadline.
+type connCanceller struct {
+	cancelled uint32
+}
+
+func (self *connCanceller) cancel(c net.Conn) error {
+	atomic.StoreUint32(&self.cancelled, 1)
+	return c.SetDeadline(aLongTimeAgo)
+}
+
+func (self *connCanceller) isCancelled() bool {
+	return atomic.LoadUint32(&self.cancelled) != 0
+}
+
+func (self *connCanceller) setReadDeadline(c net.Conn, t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	if self.isCancelled() {
+		return ErrPortCancelled
+	}
+	return nil
+}
+
+func (self *connCanceller) setWriteDeadline(c net.Conn, t time.Time) error {
+	if err := c.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	if self.isCancelled() {
+		return ErrPortCancelled
+	}
+	return nil
+}
+
+func (self *connCanceller) check(err error) error {
+	if err != nil && self.isCancelled() {
+		return ErrPortCancelled
+	}
+	return err
+}
+
 type NetPort struct {
 	C       net.Conn
 	P       Protocol
 	rbuf    *bufio.Reader
 	wbuf    *bufio.Writer
 	timeout time.Duration
+	cc      connCanceller
 }
 
 func (self *NetPort) Unpack(b *iovec.IoVec) error {
-	if err := self.C.SetReadDeadline(time.Now().Add(self.timeout)); err != nil {
+	if err := self.cc.setReadDeadline(self.C, time.Now().Add(self.timeout)); err != nil {
 		return err
 	}
-	return self.P.Unpack(self.rbuf, b)
+	return self.cc.check(self.P.Unpack(self.rbuf, b))
 }
 
 func (self *NetPort) Pack(b *iovec.IoVec) error {
-	if err := self.C.SetWriteDeadline(time.Now().Add(self.timeout)); err != nil {
+	if err := self.cc.setWriteDeadline(self.C, time.Now().Add(self.timeout)); err != nil {
 		return err
 	}
 	if err := self.P.Pack(b, self.wbuf); err != nil {
-		return err
+		return self.cc.check(err)
 	}
-	return self.wbuf.Flush()
+	return self.cc.check(self.wbuf.Flush())
+}
+
+func (self *NetPort) Cancel() error {
+	return self.cc.cancel(self.C)
 }
 
 func (self *NetPort) CloseRead() error {
@@ -82,14 +167,19 @@ type RawNetPort struct {
 	timeout time.Duration
 	buf     []byte
 	nr      int
+	cc      connCanceller
 }
 
 func (self *RawNetPort) Pack(b *iovec.IoVec) error {
-	if err := self.C.SetWriteDeadline(time.Now().Add(self.timeout)); err != nil {
+	if err := self.cc.setWriteDeadline(self.C, time.Now().Add(self.timeout)); err != nil {
 		return err
 	}
 	_, err := b.WriteTo(self.C)
-	return err
+	return self.cc.check(err)
+}
+
+func (self *RawNetPort) Cancel() error {
+	return self.cc.cancel(self.C)
 }
 
 func (self *RawNetPort) growBuffer() {
@@ -119,14 +209,14 @@ func (self *RawNetPort) growBuffer() {
 
 func (self *RawNetPort) Unpack(b *iovec.IoVec) error {
 	self.growBuffer()
-	err := self.C.SetReadDeadline(time.Now().Add(self.timeout))
+	err := self.cc.setReadDeadline(self.C, time.Now().Add(self.timeout))
 	if err != nil {
 		return err
 	}
 	self.nr, err = self.C.Read(self.buf)
 	if err != nil {
 		self.nr = 0
-		return err
+		return self.cc.check(err)
 	}
 	b.Take(self.buf[:self.nr])
 	self.buf = self.buf[self.nr:]
@@ -158,6 +248,10 @@ func (self *SyncPort) Pack(b *iovec.IoVec) error {
 	return self.Port.Pack(b)
 }
 
+func (self *SyncPort) Cancel() error {
+	return CancelPort(self.Port)
+}
+
 func NewPort(c net.Conn, p Protocol) Port {
 	return NewPortWithTimeout(c, p, DEFAULT_TIMEOUT)
 }
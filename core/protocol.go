@@ -4,6 +4,7 @@ package core
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
 	"io"
 	"net/http"
@@ -27,6 +28,7 @@ type ProtocolWithPass struct {
 func (self *ProtocolWithPass) Pack(b *iovec.IoVec, out *bufio.Writer) error {
 	err := self.PP.Run(b)
 	if err != nil {
+		passErrors.With("pack").Inc()
 		return err
 	}
 	return self.P.Pack(b, out)
@@ -37,7 +39,11 @@ func (self *ProtocolWithPass) Unpack(in *bufio.Reader, b *iovec.IoVec) error {
 	if err != nil {
 		return err
 	}
-	return self.UP.Run(b)
+	if err := self.UP.Run(b); err != nil {
+		passErrors.With("unpack").Inc()
+		return err
+	}
+	return nil
 }
 
 type HTTPProtocol struct{}
@@ -73,3 +79,34 @@ func (self *HTTPProtocol) Unpack(in *bufio.Reader, b *iovec.IoVec) error {
 	b.Take(body)
 	return nil
 }
+
+// LengthPrefixedProtocol frames data with its length in 4 bytes of big
+// endian. It's meant for carriers already secured, like streams of a tunnel.
+type LengthPrefixedProtocol struct{}
+
+func (self *LengthPrefixedProtocol) Pack(b *iovec.IoVec, out *bufio.Writer) error {
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], uint32(b.Len()))
+	if _, err := out.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := b.WriteTo(out)
+	return err
+}
+
+func (self *LengthPrefixedProtocol) Unpack(in *bufio.Reader, b *iovec.IoVec) error {
+	var h [4]byte
+	if _, err := io.ReadFull(in, h[:]); err != nil {
+		return err
+	}
+	l := binary.BigEndian.Uint32(h[:])
+	if l > DEFAULT_BUFFER_LIMIT {
+		return errors.New("Invalid length")
+	}
+	body := make([]byte, l)
+	if _, err := io.ReadFull(in, body); err != nil {
+		return err
+	}
+	b.Take(body)
+	return nil
+}
@@ -14,6 +14,26 @@ func MakeBufferedPipe() (*bufio.Reader, *bufio.Writer) {
 	return bufio.NewReader(c[0]), bufio.NewWriter(c[1])
 }
 
+func TestLengthPrefixedProtocol(t *testing.T) {
+	r, w := MakeBufferedPipe()
+	p := &LengthPrefixedProtocol{}
+	go func() {
+		p.Pack(iovec.FromSlice([]byte("wtf")), w)
+		p.Pack(&iovec.IoVec{}, w)
+		p.Pack(iovec.FromSlice([]byte("wtfwtf")), w)
+		w.Flush()
+	}()
+	for _, expected := range []string{"wtf", "", "wtfwtf"} {
+		var b iovec.IoVec
+		if err := p.Unpack(r, &b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b.Consume()) != expected {
+			t.Fatalf("Expected %q", expected)
+		}
+	}
+}
+
 func TestHTTPProtocol(t *testing.T) {
 	r, w := MakeBufferedPipe()
 	p := &HTTPProtocol{}
@@ -0,0 +1,126 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bzEq/bx/core/iovec"
+)
+
+// TokenBucket limits throughput to rate bytes per second, allowing bursts up
+// to burst bytes. burst defaults to rate if it's not positive.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate, burst int) *TokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (self *TokenBucket) refill() {
+	now := time.Now()
+	self.tokens += now.Sub(self.last).Seconds() * self.rate
+	if self.tokens > self.burst {
+		self.tokens = self.burst
+	}
+	self.last = now
+}
+
+// Reserve takes n tokens from the bucket and returns how long the caller
+// should wait before consuming them. Frames larger than the bucket are
+// allowed by running into debt.
+func (self *TokenBucket) Reserve(n int) time.Duration {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.refill()
+	self.tokens -= float64(n)
+	if self.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-self.tokens / self.rate * float64(time.Second))
+}
+
+// Allow takes n tokens if the bucket has them. Unlike Reserve, it never runs
+// into debt, so that callers dropping what's refused aren't throttled further.
+func (self *TokenBucket) Allow(n int) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.refill()
+	if self.tokens < float64(n) {
+		return false
+	}
+	self.tokens -= float64(n)
+	return true
+}
+
+// RateLimitedPort throttles Pack by PackLimits and Unpack by UnpackLimits.
+// Buckets can be shared by multiple ports to limit their total throughput.
+type RateLimitedPort struct {
+	Port
+	PackLimits   []*TokenBucket
+	UnpackLimits []*TokenBucket
+	once         sync.Once
+	cancelled    chan struct{}
+}
+
+func NewRateLimitedPort(p Port, pack, unpack []*TokenBucket) *RateLimitedPort {
+	return &RateLimitedPort{
+		Port:         p,
+		PackLimits:   pack,
+		UnpackLimits: unpack,
+		cancelled:    make(chan struct{}),
+	}
+}
+
+func (self *RateLimitedPort) wait(limits []*TokenBucket, n int) error {
+	var d time.Duration
+	for _, l := range limits {
+		if w := l.Reserve(n); w > d {
+			d = w
+		}
+	}
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-self.cancelled:
+		return ErrPortCancelled
+	}
+}
+
+func (self *RateLimitedPort) Pack(b *iovec.IoVec) error {
+	if err := self.wait(self.PackLimits, b.Len()); err != nil {
+		return err
+	}
+	return self.Port.Pack(b)
+}
+
+func (self *RateLimitedPort) Unpack(b *iovec.IoVec) error {
+	if err := self.Port.Unpack(b); err != nil {
+		return err
+	}
+	return self.wait(self.UnpackLimits, b.Len())
+}
+
+func (self *RateLimitedPort) Cancel() error {
+	self.once.Do(func() { close(self.cancelled) })
+	return CancelPort(self.Port)
+}
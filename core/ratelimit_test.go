@@ -0,0 +1,68 @@
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bx/core/iovec"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(1000, 1000)
+	if d := b.Reserve(1000); d != 0 {
+		t.Fatal(d)
+	}
+	d := b.Reserve(500)
+	if d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatal(d)
+	}
+}
+
+func TestTokenBucketAllow(t *testing.T) {
+	b := NewTokenBucket(1, 2)
+	if !b.Allow(1) || !b.Allow(1) {
+		t.Fatal("Expected burst to be allowed")
+	}
+	if b.Allow(1) {
+		t.Fatal("Expected empty bucket to refuse")
+	}
+	// Refusals don't run into debt.
+	if d := b.Reserve(0); d != 0 {
+		t.Fatal(d)
+	}
+}
+
+func TestRateLimitedPort(t *testing.T) {
+	p0, p1 := net.Pipe()
+	defer p0.Close()
+	defer p1.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := p1.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	b := NewTokenBucket(10000, 1000)
+	p := NewRateLimitedPort(NewPort(p0, nil), []*TokenBucket{b}, nil)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := p.Pack(iovec.FromSlice(make([]byte, 1000))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatal(d)
+	}
+	b = NewTokenBucket(1, 1)
+	p = NewRateLimitedPort(NewPort(p0, nil), []*TokenBucket{b}, nil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.Cancel()
+	}()
+	if err := p.Pack(iovec.FromSlice(make([]byte, 1000))); err != ErrPortCancelled {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+// Package route decides how a local relayer reaches a destination. Rules are
+// written one per line as
+//
+//	<direct|tunnel|reject|upstream:<addrs>> <matcher> [port:<ranges>]
+//
+// where addrs are comma separated addresses of relayers, matcher and ranges are the same as package acl's. geoip matchers
+// require a database, which is declared by
+//
+//	geoip_db <file>
+//
+// before rules using it. Relative paths are resolved against the directory
+// of the rules file. Lines starting with '#' are comments. The first matching
+// rule wins and destinations matching no rule go through the tunnel.
+package route
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bzEq/bx/core/acl"
+)
+
+var ErrRejected = errors.New("Destination is rejected by route rules")
+
+type Action int
+
+const (
+	TUNNEL Action = iota
+	DIRECT
+	UPSTREAM
+	REJECT
+)
+
+func (self Action) String() string {
+	switch self {
+	case TUNNEL:
+		return "tunnel"
+	case DIRECT:
+		return "direct"
+	case UPSTREAM:
+		return "upstream"
+	case REJECT:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+type Rule struct {
+	Action Action
+	// Addresses of relayers to go through if Action is UPSTREAM.
+	Upstream string
+	M        acl.Matcher
+	// Empty means any port.
+	Ports []acl.PortRange
+}
+
+func (self *Rule) Match(host string, ips []net.IP, port uint16) bool {
+	return acl.PortsContain(self.Ports, port) && self.M.Match(host, ips)
+}
+
+type Decision struct {
+	Action   Action
+	Upstream string
+}
+
+// Table holds rules loaded from a file. Rules can be reloaded while the
+// table is in use.
+type Table struct {
+	Resolver acl.IPResolver
+	file     string
+	mu       sync.RWMutex
+	rules    []Rule
+}
+
+func NewTable(rules []Rule) *Table {
+	return &Table{rules: rules}
+}
+
+func Load(file string) (*Table, error) {
+	self := &Table{file: file}
+	if err := self.Reload(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// Reload replaces rules with the content of the file the table was loaded
+// from. Rules are kept unchanged if the file is invalid.
+func (self *Table) Reload() error {
+	if self.file == "" {
+		return fmt.Errorf("Route table isn't loaded from a file")
+	}
+	f, err := os.Open(self.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules, err := Parse(f, filepath.Dir(self.file))
+	if err != nil {
+		return fmt.Errorf("%s: %w", self.file, err)
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.rules = rules
+	return nil
+}
+
+func (self *Table) Rules() []Rule {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.rules
+}
+
+// Decide returns the action of the first rule matching addr. A domain is
+// resolved once a rule inspecting IPs is reached. Domains failing to resolve
+// locally have no IPs, since they might still be resolved by the remote.
+func (self *Table) Decide(ctx context.Context, network, addr string) (Decision, error) {
+	host, port, err := acl.SplitHostPort(addr)
+	if err != nil {
+		return Decision{}, err
+	}
+	ips, _ := acl.LookupIPs(ctx, self.Resolver, host, false)
+	resolved := ips != nil
+	d := Decision{Action: TUNNEL}
+	for _, r := range self.Rules() {
+		if !resolved && r.M.NeedIPs() {
+			ips, _ = acl.LookupIPs(ctx, self.Resolver, host, true)
+			resolved = true
+		}
+		if r.Match(host, ips, port) {
+			d = Decision{Action: r.Action, Upstream: r.Upstream}
+			break
+		}
+	}
+	return d, nil
+}
+
+func parseAction(s string) (Action, string, error) {
+	switch s {
+	case "direct":
+		return DIRECT, "", nil
+	case "tunnel":
+		return TUNNEL, "", nil
+	case "reject":
+		return REJECT, "", nil
+	}
+	if strings.HasPrefix(s, "upstream:") {
+		upstream := strings.TrimPrefix(s, "upstream:")
+		if upstream == "" {
+			return UPSTREAM, "", fmt.Errorf("Empty upstream")
+		}
+		return UPSTREAM, upstream, nil
+	}
+	return TUNNEL, "", fmt.Errorf("Unknown action: %s", s)
+}
+
+// Parse parses rules listed in the package doc. Relative paths of GeoIP
+// databases are resolved against dir.
+func Parse(in io.Reader, dir string) ([]Rule, error) {
+	var rules []Rule
+	var db *acl.GeoIP
+	s := bufio.NewScanner(in)
+	n := 0
+	for s.Scan() {
+		n += 1
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] == "geoip_db" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("Line %d: Invalid GeoIP database: %s", n, line)
+			}
+			file := fields[1]
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			var err error
+			if db, err = acl.LoadGeoIP(file); err != nil {
+				return nil, fmt.Errorf("Line %d: %w", n, err)
+			}
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("Line %d: Invalid rule: %s", n, line)
+		}
+		var r Rule
+		var err error
+		if r.Action, r.Upstream, err = parseAction(fields[0]); err != nil {
+			return nil, fmt.Errorf("Line %d: %w", n, err)
+		}
+		if r.M, err = acl.ParseMatcherWithGeoIP(fields[1], db); err != nil {
+			return nil, fmt.Errorf("Line %d: %w", n, err)
+		}
+		if len(fields) == 3 {
+			if !strings.HasPrefix(fields[2], "port:") {
+				return nil, fmt.Errorf("Line %d: Invalid port ranges: %s", n, fields[2])
+			}
+			if r.Ports, err = acl.ParsePortRanges(strings.TrimPrefix(fields[2], "port:")); err != nil {
+				return nil, fmt.Errorf("Line %d: %w", n, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, s.Err()
+}
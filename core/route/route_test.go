@@ -0,0 +1,87 @@
+package route
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const rules = `
+geoip_db geoip.txt
+reject domain:ads.example.com
+direct domain:lan
+direct cidr:192.168.0.0/16
+direct geoip:cn port:80,443
+upstream:10.0.0.1:1080 glob:*.example.hk
+`
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestDecide(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "geoip.txt", "36.0.0.0/8 CN\n")
+	table, err := Load(writeFile(t, dir, "routes.txt", rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		addr string
+		d    Decision
+	}{
+		{"x.ads.example.com:443", Decision{Action: REJECT}},
+		{"nas.lan:22", Decision{Action: DIRECT}},
+		{"192.168.1.1:80", Decision{Action: DIRECT}},
+		{"36.1.1.1:443", Decision{Action: DIRECT}},
+		{"36.1.1.1:22", Decision{Action: TUNNEL}},
+		{"www.example.hk:443", Decision{Action: UPSTREAM, Upstream: "10.0.0.1:1080"}},
+		{"1.1.1.1:53", Decision{Action: TUNNEL}},
+	}
+	for _, c := range cases {
+		d, err := table.Decide(context.Background(), "tcp", c.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != c.d {
+			t.Errorf("%s: expected %v, got %v", c.addr, c.d, d)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFile(t, dir, "routes.txt", "direct all\n")
+	table, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "routes.txt", "reject all\n")
+	if err := table.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := table.Decide(context.Background(), "tcp", "1.1.1.1:80"); d.Action != REJECT {
+		t.Fatalf("expected reject, got %v", d.Action)
+	}
+	writeFile(t, dir, "routes.txt", "bogus all\n")
+	if err := table.Reload(); err == nil {
+		t.Fatal("expected error")
+	}
+	if d, _ := table.Decide(context.Background(), "tcp", "1.1.1.1:80"); d.Action != REJECT {
+		t.Fatalf("rules should be kept on invalid reload, got %v", d.Action)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, r := range []string{"direct geoip:cn", "upstream: all", "geoip_db", "tunnel all port:x"} {
+		if _, err := Parse(strings.NewReader(r), ""); err == nil {
+			t.Error(r)
+		}
+	}
+}
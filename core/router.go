@@ -5,6 +5,8 @@ package core
 import (
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 
 	"github.com/bzEq/bx/core/iovec"
 )
@@ -16,15 +18,86 @@ type Codec interface {
 	Decode(*iovec.IoVec) (RouteId, error)
 }
 
+// Number of frames queued for a route by default.
+const DEFAULT_ROUTE_QUEUE_SIZE = 64
+
+// DropPolicy decides which frame is dropped once a route's queue is full.
+type DropPolicy int
+
+const (
+	// Drop the oldest queued frame, preferring fresh data like games and
+	// VoIP do.
+	DROP_OLDEST DropPolicy = iota
+	// Drop the incoming frame.
+	DROP_NEWEST
+)
+
 type RouteInfo struct {
-	P   *SyncPort
-	Err chan error
+	P *SyncPort
+	// Receives the first error of the route. It's buffered, so the route
+	// never blocks on it.
+	Err     chan error
+	q       chan *iovec.IoVec
+	done    chan struct{}
+	once    sync.Once
+	dropped uint64
+}
+
+// Dropped returns the number of frames dropped due to the full queue.
+func (self *RouteInfo) Dropped() uint64 {
+	return atomic.LoadUint64(&self.dropped)
+}
+
+// Queued returns the number of frames waiting to be packed to P.
+func (self *RouteInfo) Queued() int {
+	return len(self.q)
+}
+
+func (self *RouteInfo) fail(err error) {
+	select {
+	case self.Err <- err:
+	default:
+	}
+	self.once.Do(func() { close(self.done) })
 }
 
+func (self *RouteInfo) drop() {
+	atomic.AddUint64(&self.dropped, 1)
+	routerDropped.Inc()
+}
+
+// enqueue queues b without blocking, dropping a frame per policy if the
+// queue is full.
+func (self *RouteInfo) enqueue(b *iovec.IoVec, policy DropPolicy) {
+	for {
+		select {
+		case self.q <- b:
+			return
+		default:
+		}
+		if policy == DROP_NEWEST {
+			self.drop()
+			return
+		}
+		select {
+		case <-self.q:
+			self.drop()
+		default:
+		}
+	}
+}
+
+// SimpleRouter multiplexes routes over P. Frames from P are queued for their
+// routes without blocking, so a slow route neither stalls others nor piles
+// up memory.
 type SimpleRouter struct {
-	P      *SyncPort
-	C      Codec
-	routes Map[RouteId, *RouteInfo]
+	P *SyncPort
+	C Codec
+	// Number of frames queued for each route, DEFAULT_ROUTE_QUEUE_SIZE if
+	// it's 0.
+	QueueSize int
+	Drop      DropPolicy
+	routes    Map[RouteId, *RouteInfo]
 }
 
 func (self *SimpleRouter) route(id RouteId, ri *RouteInfo) {
@@ -32,56 +105,79 @@ func (self *SimpleRouter) route(id RouteId, ri *RouteInfo) {
 		var b iovec.IoVec
 		err := ri.P.Unpack(&b)
 		if err != nil {
-			ri.Err <- err
+			ri.fail(err)
 			return
 		}
 		err = self.C.Encode(id, &b)
 		if err != nil {
-			ri.Err <- err
+			ri.fail(err)
 			return
 		}
 		if err = self.P.Pack(&b); err != nil {
-			ri.Err <- err
+			ri.fail(err)
+			return
+		}
+	}
+}
+
+// deliver packs frames queued for the route to its port.
+func (self *SimpleRouter) deliver(ri *RouteInfo) {
+	for {
+		select {
+		case b := <-ri.q:
+			if err := ri.P.Pack(b); err != nil {
+				ri.fail(err)
+				return
+			}
+		case <-ri.done:
 			return
 		}
 	}
 }
 
 func (self *SimpleRouter) NewRoute(id RouteId, P *SyncPort) (*RouteInfo, error) {
-	ri := &RouteInfo{P: P, Err: make(chan error)}
+	size := self.QueueSize
+	if size <= 0 {
+		size = DEFAULT_ROUTE_QUEUE_SIZE
+	}
+	ri := &RouteInfo{
+		P:    P,
+		Err:  make(chan error, 1),
+		q:    make(chan *iovec.IoVec, size),
+		done: make(chan struct{}),
+	}
 	if v, in := self.routes.LoadOrStore(id, ri); in {
 		return v, fmt.Errorf("Route #%d already exists", id)
 	}
+	routerRoutes.Inc()
 	go func() {
+		defer routerRoutes.Dec()
 		defer self.routes.Delete(id)
 		self.route(id, ri)
 	}()
+	go self.deliver(ri)
 	return ri, nil
 }
 
 func (self *SimpleRouter) Run() {
 	for {
-		var b iovec.IoVec
-		err := self.P.Unpack(&b)
+		b := &iovec.IoVec{}
+		err := self.P.Unpack(b)
 		if err != nil {
 			log.Println(err)
 			return
 		}
-		id, err := self.C.Decode(&b)
+		id, err := self.C.Decode(b)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 		ri, in := self.routes.Load(id)
 		if !in {
-			log.Println(fmt.Errorf("Route #%d doesn't exist\n", id))
+			routerDropped.Inc()
+			log.Println(fmt.Errorf("Route #%d doesn't exist", id))
 			continue
 		}
-		go func(ri *RouteInfo) {
-			if err := ri.P.Pack(&b); err != nil {
-				ri.Err <- err
-				return
-			}
-		}(ri)
+		ri.enqueue(b, self.Drop)
 	}
 }
@@ -0,0 +1,210 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bx/core/iovec"
+)
+
+// chanPort unpacks frames from in and packs frames to out.
+type chanPort struct {
+	in  chan []byte
+	out chan []byte
+	err error
+}
+
+func newChanPort(outSize int) *chanPort {
+	return &chanPort{
+		in:  make(chan []byte),
+		out: make(chan []byte, outSize),
+	}
+}
+
+func (self *chanPort) Unpack(b *iovec.IoVec) error {
+	s, ok := <-self.in
+	if !ok {
+		return io.EOF
+	}
+	b.Take(s)
+	return nil
+}
+
+func (self *chanPort) Pack(b *iovec.IoVec) error {
+	if self.err != nil {
+		return self.err
+	}
+	self.out <- b.Consume()
+	return nil
+}
+
+func (self *chanPort) CloseRead() error {
+	return nil
+}
+
+func (self *chanPort) CloseWrite() error {
+	return nil
+}
+
+// idCodec prefixes frames with their RouteId in a byte.
+type idCodec struct{}
+
+func (self idCodec) Encode(id RouteId, b *iovec.IoVec) error {
+	b.Take(append([]byte{byte(id)}, b.Consume()...))
+	return nil
+}
+
+func (self idCodec) Decode(b *iovec.IoVec) (RouteId, error) {
+	s := b.Consume()
+	if len(s) == 0 {
+		return 0, errors.New("Empty frame")
+	}
+	b.Take(s[1:])
+	return RouteId(s[0]), nil
+}
+
+func payload(i uint32) []byte {
+	s := make([]byte, 4)
+	binary.BigEndian.PutUint32(s, i)
+	return s
+}
+
+func frame(id RouteId, i uint32) []byte {
+	return append([]byte{byte(id)}, payload(i)...)
+}
+
+func newTestRouter(queueSize int, drop DropPolicy) (*SimpleRouter, *chanPort) {
+	p := newChanPort(64)
+	r := &SimpleRouter{
+		P:         &SyncPort{Port: p},
+		C:         idCodec{},
+		QueueSize: queueSize,
+		Drop:      drop,
+	}
+	go r.Run()
+	return r, p
+}
+
+func expectFrame(t *testing.T, p *chanPort, expected []byte) {
+	select {
+	case s := <-p.out:
+		if string(s) != string(expected) {
+			t.Fatalf("Expected %v, got %v", expected, s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %v", expected)
+	}
+}
+
+func TestSimpleRouter(t *testing.T) {
+	r, p := newTestRouter(0, DROP_OLDEST)
+	defer close(p.in)
+	rp := newChanPort(1)
+	if _, err := r.NewRoute(1, &SyncPort{Port: rp}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.NewRoute(1, &SyncPort{Port: rp}); err == nil {
+		t.Fatal("Expected error of duplicate route")
+	}
+	p.in <- []byte{1, 'a'}
+	expectFrame(t, rp, []byte("a"))
+	rp.in <- []byte("b")
+	expectFrame(t, p, []byte{1, 'b'})
+}
+
+// stall returns a route whose port is blocked packing frame 0.
+func stall(t *testing.T, r *SimpleRouter, p *chanPort) (*RouteInfo, *chanPort) {
+	rp := newChanPort(0)
+	ri, err := r.NewRoute(1, &SyncPort{Port: rp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.in <- frame(1, 0)
+	for ri.Queued() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return ri, rp
+}
+
+// flush waits until Run has processed frames sent before.
+func flush(t *testing.T, r *SimpleRouter, p *chanPort) {
+	rp := newChanPort(1)
+	if _, err := r.NewRoute(2, &SyncPort{Port: rp}); err != nil {
+		t.Fatal(err)
+	}
+	p.in <- []byte{2, 'x'}
+	expectFrame(t, rp, []byte("x"))
+}
+
+func TestSimpleRouterFlood(t *testing.T) {
+	const N = 10000
+	const QUEUE_SIZE = 8
+	r, p := newTestRouter(QUEUE_SIZE, DROP_OLDEST)
+	defer close(p.in)
+	ri, rp := stall(t, r, p)
+	goroutines := runtime.NumGoroutine()
+	for i := uint32(1); i < N; i++ {
+		p.in <- frame(1, i)
+	}
+	// The stalled route doesn't block others.
+	flush(t, r, p)
+	if n := runtime.NumGoroutine(); n > goroutines+8 {
+		t.Fatalf("%d goroutines are spawned by flood", n-goroutines)
+	}
+	if ri.Queued() != QUEUE_SIZE {
+		t.Fatalf("Expected %d queued frames, got %d", QUEUE_SIZE, ri.Queued())
+	}
+	if ri.Dropped() != N-1-QUEUE_SIZE {
+		t.Fatalf("Expected %d dropped frames, got %d", N-1-QUEUE_SIZE, ri.Dropped())
+	}
+	// The newest frames are kept.
+	expectFrame(t, rp, payload(0))
+	for i := uint32(N - QUEUE_SIZE); i < N; i++ {
+		expectFrame(t, rp, payload(i))
+	}
+}
+
+func TestSimpleRouterDropNewest(t *testing.T) {
+	const QUEUE_SIZE = 4
+	r, p := newTestRouter(QUEUE_SIZE, DROP_NEWEST)
+	defer close(p.in)
+	ri, rp := stall(t, r, p)
+	for i := uint32(1); i < 100; i++ {
+		p.in <- frame(1, i)
+	}
+	flush(t, r, p)
+	if ri.Dropped() != 100-1-QUEUE_SIZE {
+		t.Fatalf("Expected %d dropped frames, got %d", 100-1-QUEUE_SIZE, ri.Dropped())
+	}
+	for i := uint32(0); i <= QUEUE_SIZE; i++ {
+		expectFrame(t, rp, payload(i))
+	}
+}
+
+func TestSimpleRouterErr(t *testing.T) {
+	r, p := newTestRouter(0, DROP_OLDEST)
+	defer close(p.in)
+	rp := newChanPort(0)
+	rp.err = errors.New("Broken route")
+	ri, err := r.NewRoute(1, &SyncPort{Port: rp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nobody waits for errors, which doesn't block the router.
+	for i := uint32(0); i < 16; i++ {
+		p.in <- frame(1, i)
+	}
+	flush(t, r, p)
+	select {
+	case err := <-ri.Err:
+		if err != rp.err {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for error")
+	}
+}
@@ -3,57 +3,195 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bzEq/bx/core/iovec"
 )
 
+// Directions of a SimpleSwitch.
+const (
+	// From port[0] to port[1].
+	SWITCH_FORWARD = iota
+	// From port[1] to port[0].
+	SWITCH_BACKWARD
+)
+
+var ErrSwitchStopped = errors.New("Switch is stopped")
+
+type SwitchStats struct {
+	Bytes  [2]uint64
+	Frames [2]uint64
+	Start  time.Time
+	// Zero until the switch is done.
+	End    time.Time
+	Reason [2]error
+}
+
+func (self *SwitchStats) Duration() time.Duration {
+	if self.End.IsZero() {
+		return time.Since(self.Start)
+	}
+	return self.End.Sub(self.Start)
+}
+
+type SwitchObserver interface {
+	// OnTraffic is called after a frame of n bytes is switched in direction dir.
+	OnTraffic(dir int, n int)
+	// OnDone is called once both directions ended.
+	OnDone(*SwitchStats)
+}
+
+// SwitchFunc switches traffic between the port facing a client and the port
+// facing target. Servers accept a SwitchFunc so that callers can observe and
+// control relays.
+type SwitchFunc func(ctx context.Context, client, remote Port, target string)
+
+func DefaultSwitchFunc(ctx context.Context, client, remote Port, target string) {
+	RunSimpleSwitch(ctx, client, remote)
+}
+
 // SimpleSwitch is not responsible to close ports.
 type SimpleSwitch struct {
-	done [2]chan struct{}
-	port [2]Port
+	bytes     [2]uint64
+	frames    [2]uint64
+	done      [2]chan struct{}
+	port      [2]Port
+	reason    [2]error
+	stop      chan struct{}
+	once      sync.Once
+	cause     error
+	start     time.Time
+	observers []SwitchObserver
+}
+
+func (self *SimpleSwitch) AddObserver(o SwitchObserver) *SimpleSwitch {
+	self.observers = append(self.observers, o)
+	return self
 }
 
-func (self *SimpleSwitch) Run() {
+// Stats returns a snapshot of the switch's counters. Reasons are filled
+// once Run returns.
+func (self *SimpleSwitch) Stats() SwitchStats {
+	s := SwitchStats{Start: self.start}
+	for i := range s.Bytes {
+		s.Bytes[i] = atomic.LoadUint64(&self.bytes[i])
+		s.Frames[i] = atomic.LoadUint64(&self.frames[i])
+	}
+	return s
+}
+
+func (self *SimpleSwitch) Run(ctx context.Context) {
+	go func() {
+		defer close(self.done[SWITCH_FORWARD])
+		self.reason[SWITCH_FORWARD] = self.switchTraffic(SWITCH_FORWARD, self.port[0], self.port[1])
+	}()
 	go func() {
-		defer close(self.done[0])
-		self.switchTraffic(self.port[0], self.port[1])
+		defer close(self.done[SWITCH_BACKWARD])
+		self.reason[SWITCH_BACKWARD] = self.switchTraffic(SWITCH_BACKWARD, self.port[1], self.port[0])
 	}()
+	finished := make(chan struct{})
 	go func() {
-		defer close(self.done[1])
-		self.switchTraffic(self.port[1], self.port[0])
+		defer close(finished)
+		<-self.done[SWITCH_FORWARD]
+		<-self.done[SWITCH_BACKWARD]
 	}()
-	<-self.done[0]
-	<-self.done[1]
+	select {
+	case <-finished:
+	case <-self.stop:
+	case <-ctx.Done():
+		self.Stop(ctx.Err())
+	}
+	<-finished
+	if len(self.observers) != 0 {
+		s := self.Stats()
+		s.End = time.Now()
+		s.Reason = self.reason
+		for _, o := range self.observers {
+			o.OnDone(&s)
+		}
+	}
+}
+
+// Stop tears down both directions of the switch. reason is reported by
+// Reasons for directions that haven't ended yet. If reason is nil,
+// ErrSwitchStopped is reported.
+func (self *SimpleSwitch) Stop(reason error) {
+	self.once.Do(func() {
+		if reason == nil {
+			reason = ErrSwitchStopped
+		}
+		self.cause = reason
+		close(self.stop)
+		for _, p := range self.port {
+			if err := CancelPort(p); err != nil {
+				log.Println(err)
+			}
+		}
+	})
 }
 
-func (self *SimpleSwitch) switchTraffic(in, out Port) {
+func (self *SimpleSwitch) stopped() bool {
+	select {
+	case <-self.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reasons tells why each direction ended, indexed by SWITCH_FORWARD and
+// SWITCH_BACKWARD. A nil reason means the direction ended with EOF. It's
+// only valid after Run returns.
+func (self *SimpleSwitch) Reasons() [2]error {
+	return self.reason
+}
+
+func (self *SimpleSwitch) switchTraffic(dir int, in, out Port) error {
 	for {
 		var b iovec.IoVec
 		if err := in.Unpack(&b); err != nil {
 			if err == io.EOF {
 				out.CloseWrite()
-			} else {
-				log.Println(err)
+				return nil
+			}
+			if self.stopped() {
+				return self.cause
 			}
-			return
+			log.Println(err)
+			return err
 		}
+		n := b.Len()
 		if err := out.Pack(&b); err != nil {
+			if self.stopped() {
+				return self.cause
+			}
 			log.Println(err)
-			return
+			return err
+		}
+		atomic.AddUint64(&self.bytes[dir], uint64(n))
+		atomic.AddUint64(&self.frames[dir], 1)
+		for _, o := range self.observers {
+			o.OnTraffic(dir, n)
 		}
 	}
 }
 
-func RunSimpleSwitch(p0, p1 Port) {
-	NewSimpleSwitch(p0, p1).Run()
+func RunSimpleSwitch(ctx context.Context, p0, p1 Port) {
+	NewSimpleSwitch(p0, p1).Run(ctx)
 }
 
 func NewSimpleSwitch(p0, p1 Port) *SimpleSwitch {
 	s := &SimpleSwitch{
-		port: [2]Port{p0, p1},
-		done: [2]chan struct{}{make(chan struct{}), make(chan struct{})},
+		port:  [2]Port{p0, p1},
+		done:  [2]chan struct{}{make(chan struct{}), make(chan struct{})},
+		stop:  make(chan struct{}),
+		start: time.Now(),
 	}
 	return s
 }
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSimpleSwitchStop(t *testing.T) {
+	a0, a1 := net.Pipe()
+	b0, b1 := net.Pipe()
+	defer a1.Close()
+	defer b1.Close()
+	sw := NewSimpleSwitch(NewPort(a0, nil), NewPort(b0, nil))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sw.Run(context.Background())
+	}()
+	go func() {
+		a1.Write([]byte("wtf"))
+	}()
+	buf := make([]byte, 8)
+	n, err := b1.Read(buf)
+	if err != nil || string(buf[:n]) != "wtf" {
+		t.Fatal(err)
+	}
+	quota := errors.New("Quota exceeded")
+	sw.Stop(quota)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Switch is not stopped")
+	}
+	for _, r := range sw.Reasons() {
+		if r != quota {
+			t.Fatal(r)
+		}
+	}
+}
+
+func TestSimpleSwitchCancel(t *testing.T) {
+	a0, a1 := net.Pipe()
+	b0, b1 := net.Pipe()
+	defer a1.Close()
+	defer b1.Close()
+	sw := NewSimpleSwitch(NewPort(a0, nil), NewPort(b0, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sw.Run(ctx)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Switch is not cancelled")
+	}
+	for _, r := range sw.Reasons() {
+		if r != context.Canceled {
+			t.Fatal(r)
+		}
+	}
+}
+
+type testObserver struct {
+	bytes int
+	done  *SwitchStats
+}
+
+func (self *testObserver) OnTraffic(dir int, n int) {
+	if dir == SWITCH_FORWARD {
+		self.bytes += n
+	}
+}
+
+func (self *testObserver) OnDone(s *SwitchStats) {
+	self.done = s
+}
+
+func TestSimpleSwitchStats(t *testing.T) {
+	a0, a1 := net.Pipe()
+	b0, b1 := net.Pipe()
+	defer a1.Close()
+	defer b1.Close()
+	o := &testObserver{}
+	sw := NewSimpleSwitch(NewPort(a0, nil), NewPort(b0, nil)).AddObserver(o)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sw.Run(context.Background())
+	}()
+	buf := make([]byte, 8)
+	for i := 0; i < 3; i++ {
+		go a1.Write([]byte("wtf"))
+		if _, err := b1.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sw.Stop(nil)
+	<-done
+	if o.done == nil || o.bytes != 9 {
+		t.Fatal(o)
+	}
+	if o.done.Bytes[SWITCH_FORWARD] != 9 || o.done.Frames[SWITCH_FORWARD] != 3 || o.done.Bytes[SWITCH_BACKWARD] != 0 {
+		t.Fatal(o.done)
+	}
+	if o.done.Reason[SWITCH_BACKWARD] != ErrSwitchStopped || o.done.End.IsZero() {
+		t.Fatal(o.done)
+	}
+}
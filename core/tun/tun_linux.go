@@ -0,0 +1,46 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+// Package tun opens TUN devices, which deliver raw IP packets.
+package tun
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const TUN_DEVICE = "/dev/net/tun"
+
+// struct ifreq
+type ifreq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// Open attaches to TUN device name, creating it if it doesn't exist. Each
+// Read returns a packet and each Write sends one. Addresses and routes of the
+// device are left to be configured, e.g., by ip(8).
+func Open(name string) (*os.File, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("Invalid TUN device name: %s", name)
+	}
+	fd, err := syscall.Open(TUN_DEVICE, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	var req ifreq
+	copy(req.name[:], name)
+	req.flags = syscall.IFF_TUN | syscall.IFF_NO_PI
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Failed to set up TUN device %s: %w", name, errno)
+	}
+	// Make it pollable, so that Close interrupts blocking Read.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), TUN_DEVICE), nil
+}
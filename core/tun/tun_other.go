@@ -0,0 +1,15 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+//go:build !linux
+
+// Package tun opens TUN devices, which deliver raw IP packets.
+package tun
+
+import (
+	"errors"
+	"os"
+)
+
+func Open(name string) (*os.File, error) {
+	return nil, errors.New("TUN device is only supported on Linux")
+}
@@ -5,22 +5,68 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"encoding/binary"
 	"flag"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/bzEq/bx/core/acl"
+	"github.com/bzEq/bx/core/dns"
+	"github.com/bzEq/bx/core/netstack"
+	"github.com/bzEq/bx/core/route"
 	"github.com/bzEq/bx/relayer"
 )
 
 var options struct {
-	Local          string
-	LocalUDP       string
-	LocalHTTPProxy string
-	Next           string
+	Local            string
+	LocalUDP         string
+	LocalHTTPProxy   string
+	LocalDNS         string
+	Transparent      string
+	TUN              string
+	LocalForward     string
+	RemoteForward    string
+	AllowRemoteFwd   bool
+	AcceptGob        bool
+	Compress         bool
+	Mux              bool
+	RendezvousListen string
+	Rendezvous       string
+	RendezvousToken  string
+	DatagramListen   string
+	Datagram         string
+	QUIC             bool
+	TUNMTU           int
+	TProxy           bool
+	FakeIP           bool
+	FakeIPRange      string
+	Next             string
+	ShutdownTimeout  int
+	Metrics          string
+	Admin            string
+	AdminToken       string
+	RateLimit        string
+	Quota            string
+	QuotaPeriod      string
+	QuotaFile        string
+	ACL              string
+	ACLGeoIP         string
+	UpstreamPolicy   string
+	Resolver         string
+	ResolverPrefer   string
+	Routes           string
+	Protocol         string
+	NextProtocol     string
+	Intermediate     bool
+	Path             string
 }
 
 func startRelayer() {
@@ -28,14 +74,135 @@ func startRelayer() {
 	r.Local = options.Local
 	r.LocalUDP = options.LocalUDP
 	r.LocalHTTPProxy = options.LocalHTTPProxy
+	r.LocalDNS = options.LocalDNS
+	r.LocalTransparent = options.Transparent
+	r.LocalTUN = options.TUN
+	r.AllowRemoteForward = options.AllowRemoteFwd
+	r.AcceptGob = options.AcceptGob
+	r.Compress = options.Compress
+	r.Mux = options.Mux
+	r.LocalRendezvous = options.RendezvousListen
+	r.Rendezvous = options.Rendezvous
+	r.RendezvousToken = options.RendezvousToken
+	r.LocalDatagram = options.DatagramListen
+	r.Datagram = options.Datagram
+	r.QUIC = options.QUIC
+	r.TUNMTU = options.TUNMTU
+	r.TProxy = options.TProxy
+	if options.FakeIP {
+		r.FakeIP = options.FakeIPRange
+	}
 	r.Next = options.Next
+	r.RelayProtocol = options.Protocol
+	r.NextRelayProtocol = options.NextProtocol
+	r.Intermediate = options.Intermediate
+	if options.Path != "" {
+		r.Path = strings.Split(options.Path, ",")
+	}
+	policy, err := relayer.ParseUpstreamPolicy(options.UpstreamPolicy)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	r.UpstreamPolicy = policy
+	if r.LocalForwards, err = relayer.ParseForwards(options.LocalForward); err != nil {
+		log.Println(err)
+		return
+	}
+	if r.RemoteForwards, err = relayer.ParseForwards(options.RemoteForward); err != nil {
+		log.Println(err)
+		return
+	}
+	rl, err := relayer.ParseRateLimit(options.RateLimit)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	r.RateLimit = rl
+	q, err := relayer.ParseQuota(options.Quota, options.QuotaPeriod, options.QuotaFile)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	r.Quota = q
+	if r.Resolver, err = dns.ParseResolver(options.Resolver, options.ResolverPrefer); err != nil {
+		log.Println(err)
+		return
+	}
+	if options.ACL != "" {
+		var db *acl.GeoIP
+		if options.ACLGeoIP != "" {
+			if db, err = acl.LoadGeoIP(options.ACLGeoIP); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		if r.ACL, err = acl.Load(options.ACL, db); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if options.Routes != "" {
+		if r.Routes, err = route.Load(options.Routes); err != nil {
+			log.Println(err)
+			return
+		}
+	}
 	r.Dial = func(network, address string) (net.Conn, error) {
 		return net.Dial(network, address)
 	}
 	r.Listen = func(network, address string) (net.Listener, error) {
 		return net.Listen(network, address)
 	}
-	r.Run()
+	if options.Metrics != "" {
+		server, err := relayer.StartMetricsServer(options.Metrics)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer server.Close()
+	}
+	if options.Admin != "" {
+		server, err := relayer.StartAdminServer(options.Admin, options.AdminToken, map[string]relayer.Inspectable{r.Local: r})
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer server.Close()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		r.Run()
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for running := true; running; {
+		select {
+		case <-stopped:
+			running = false
+		case <-hup:
+			if r.Routes == nil {
+				continue
+			}
+			if err := r.Routes.Reload(); err != nil {
+				log.Println(err)
+			} else {
+				log.Println("Reloaded routes from", options.Routes)
+			}
+		case s := <-sig:
+			log.Printf("Received %v, shutting down\n", s)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(options.ShutdownTimeout)*time.Second)
+			defer cancel()
+			if err := r.Shutdown(ctx); err != nil {
+				log.Println(err)
+			}
+			running = false
+		}
+	}
+	log.Println(r.Stats())
 }
 
 func main() {
@@ -47,11 +214,46 @@ func main() {
 	flag.StringVar(&options.Local, "l", "localhost:1080", "Listen address of this relayer")
 	flag.StringVar(&options.LocalUDP, "u", "", "UDP listen address of this relayer")
 	flag.StringVar(&options.LocalHTTPProxy, "http_proxy", "", "Enable this relayer serving as http proxy")
-	flag.StringVar(&options.Next, "n", "", "Address of next-hop relayer")
+	flag.StringVar(&options.LocalDNS, "dns", "", "Listen address of DNS server resolving names via the remote side")
+	flag.StringVar(&options.Transparent, "transparent", "", "Listen address of transparent proxy for iptables REDIRECT")
+	flag.BoolVar(&options.TProxy, "tproxy", false, "Accept iptables TPROXY instead of REDIRECT on transparent proxy, relaying UDP as well")
+	flag.StringVar(&options.TUN, "tun", "", "Name of TUN device whose IPv4 TCP and UDP flows are relayed, routes to next-hop relayers must bypass it")
+	flag.IntVar(&options.TUNMTU, "tun_mtu", netstack.DEFAULT_MTU, "MTU of TUN device")
+	flag.StringVar(&options.LocalForward, "L", "", "Comma separated [tcp/|udp/]<listen>=<target>, forwarding local ports to targets through the tunnel")
+	flag.StringVar(&options.RemoteForward, "R", "", "Comma separated <listen>=<target>, forwarding ports the end relayer listens on to local targets")
+	flag.BoolVar(&options.AllowRemoteFwd, "allow_remote_forward", false, "Let end relayer listen on ports for remote forwarding requests")
+	flag.BoolVar(&options.AcceptGob, "accept_gob", false, "Serve gob encoded requests of relayers older than the versioned wire format")
+	flag.BoolVar(&options.Compress, "compress", false, "Compress TCP traffic through the tunnel if the end relayer supports it")
+	flag.BoolVar(&options.Mux, "mux", false, "Relay TCP through the tunnel over a multiplexed connection if the end relayer supports it")
+	flag.StringVar(&options.RendezvousListen, "rendezvous_listen", "", "Listen address accepting registrations of end relayers behind NAT, relaying connections of -l to the latest registered one")
+	flag.StringVar(&options.Rendezvous, "rendezvous", "", "Address of rendezvous relayer this end relayer behind NAT registers to, -l can be empty then")
+	flag.StringVar(&options.RendezvousToken, "rendezvous_token", "", "Secret the rendezvous relayer authenticates registrations of end relayers with, required by -rendezvous_listen")
+	flag.StringVar(&options.DatagramListen, "datagram_listen", "", "UDP listen address of end relayer's datagram transport, relaying UDP without head-of-line blocking")
+	flag.StringVar(&options.Datagram, "datagram", "", "Address of end relayer's datagram transport to relay UDP over, falling back to TCP if it doesn't answer")
+	flag.BoolVar(&options.QUIC, "quic", false, "Talk with next-hop relayers over QUIC without verifying their certificates, and accept QUIC on -l's UDP port if serving previous hops")
+	flag.BoolVar(&options.FakeIP, "fake_ip", false, "Answer DNS queries with fake IPs and relay connections to them by domain")
+	flag.StringVar(&options.FakeIPRange, "fake_ip_range", dns.DEFAULT_FAKE_IP_RANGE, "Range of fake IPs")
+	flag.StringVar(&options.Next, "n", "", "Comma separated addresses of next-hop relayers")
+	flag.StringVar(&options.UpstreamPolicy, "upstream_policy", "failover", "How to choose next-hop relayer: failover, round_robin, least_conn, latency or random")
+	flag.StringVar(&options.Protocol, "proto", "", "Name of relay protocol")
+	flag.StringVar(&options.NextProtocol, "next_proto", "", "Name of relay protocol to talk with next-hop relayers, same as -proto if empty")
+	flag.BoolVar(&options.Intermediate, "intermediate", false, "Forward requests of previous hops to next-hop relayer")
+	flag.StringVar(&options.Path, "path", "", "Comma separated relayers to go through after next-hop relayer")
+	flag.StringVar(&options.Metrics, "metrics", "", "Listen address of metrics endpoint")
+	flag.StringVar(&options.RateLimit, "rate_limit", "", "Bandwidth limits in bytes per second, e.g. global=10M/100M,client=1M/10M,dest=512K/5M")
+	flag.StringVar(&options.Quota, "quota", "", "Bytes each client can relay per quota period, e.g. 100G")
+	flag.StringVar(&options.QuotaPeriod, "quota_period", "monthly", "Quota period: daily, weekly or monthly")
+	flag.StringVar(&options.QuotaFile, "quota_file", "", "File to persist quota usage")
+	flag.StringVar(&options.ACL, "acl", "", "File of destination ACL rules for end relayer, also checked against hops of requested paths")
+	flag.StringVar(&options.ACLGeoIP, "acl_geoip", "", "GeoIP database of geoip matchers in ACL rules")
+	flag.StringVar(&options.Resolver, "resolver", "", "DNS upstream of end relayer: system, <host:port>, tls://<host:port> or https://<host>/<path>")
+	flag.StringVar(&options.ResolverPrefer, "resolver_prefer", "", "IP preference of end relayer: ipv4, ipv6, ipv4_only or ipv6_only")
+	flag.StringVar(&options.Routes, "routes", "", "File of routing rules for local relayer, reloaded on SIGHUP")
+	flag.StringVar(&options.Admin, "admin", "", "Loopback listen address or unix socket path of admin endpoint")
+	flag.StringVar(&options.AdminToken, "admin_token", "", "Token admin requests must carry in header "+relayer.ADMIN_TOKEN_HEADER)
+	flag.IntVar(&options.ShutdownTimeout, "shutdown_timeout", relayer.DEFAULT_SHUTDOWN_TIMEOUT, "Seconds to wait for in-flight relays on shutdown")
 	flag.Parse()
-	if !debug {
-		log.SetOutput(ioutil.Discard)
-	}
+	relayer.SetDebugLogging(debug)
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	startRelayer()
 }
@@ -5,48 +5,159 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"crypto/tls"
 	"encoding/binary"
 	"flag"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/acl"
+	"github.com/bzEq/bx/core/dns"
 	"github.com/bzEq/bx/relayer"
 )
 
 var options struct {
-	Local    string
-	Next     string
-	Protocol string
-	UseTLS   bool
+	Local           string
+	Next            string
+	Protocol        string
+	UseTLS          bool
+	ShutdownTimeout int
+	Metrics         string
+	Admin           string
+	AdminToken      string
+	RateLimit       string
+	Quota           string
+	QuotaPeriod     string
+	QuotaFile       string
+	ACL             string
+	ACLGeoIP        string
+	UpstreamPolicy  string
+	Resolver        string
+	ResolverPrefer  string
 }
 
 func startRelayers() {
 	addrs := strings.Split(options.Local, ",")
-	var wg sync.WaitGroup
+	q, err := relayer.ParseQuota(options.Quota, options.QuotaPeriod, options.QuotaFile)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// Relayers share usage of clients.
+	var quota *relayer.QuotaStore
+	if q != (relayer.Quota{}) {
+		if quota, err = relayer.NewQuotaStore(q); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	var relayers []*relayer.SocksRelayer
 	for _, addr := range addrs {
+		r, err := createRelayer(addr, quota)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		relayers = append(relayers, r)
+	}
+	if options.Metrics != "" {
+		server, err := relayer.StartMetricsServer(options.Metrics)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer server.Close()
+	}
+	if options.Admin != "" {
+		m := make(map[string]relayer.Inspectable)
+		for _, r := range relayers {
+			m[r.Local] = r
+		}
+		server, err := relayer.StartAdminServer(options.Admin, options.AdminToken, m)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer server.Close()
+	}
+	var wg sync.WaitGroup
+	for _, r := range relayers {
 		wg.Add(1)
-		go func(addr string) {
+		go func(r *relayer.SocksRelayer) {
 			defer wg.Done()
-			startRelayer(addr)
-		}(addr)
+			r.Run()
+		}(r)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		wg.Wait()
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-stopped:
+	case s := <-sig:
+		log.Printf("Received %v, shutting down\n", s)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(options.ShutdownTimeout)*time.Second)
+		defer cancel()
+		var swg sync.WaitGroup
+		for _, r := range relayers {
+			swg.Add(1)
+			go func(r *relayer.SocksRelayer) {
+				defer swg.Done()
+				if err := r.Shutdown(ctx); err != nil {
+					log.Println(err)
+				}
+			}(r)
+		}
+		swg.Wait()
+	}
+	for _, r := range relayers {
+		log.Printf("%s: %v\n", r.Local, r.Stats())
 	}
-	wg.Wait()
 }
 
-func startRelayer(localAddr string) {
+func createRelayer(localAddr string, quota *relayer.QuotaStore) (*relayer.SocksRelayer, error) {
 	r := &relayer.SocksRelayer{}
 	r.Local = localAddr
 	r.RelayProtocol = options.Protocol
+	rl, err := relayer.ParseRateLimit(options.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	r.RateLimit = rl
+	r.QuotaStore = quota
+	if r.Resolver, err = dns.ParseResolver(options.Resolver, options.ResolverPrefer); err != nil {
+		return nil, err
+	}
+	if options.ACL != "" {
+		var db *acl.GeoIP
+		if options.ACLGeoIP != "" {
+			if db, err = acl.LoadGeoIP(options.ACLGeoIP); err != nil {
+				return nil, err
+			}
+		}
+		if r.ACL, err = acl.Load(options.ACL, db); err != nil {
+			return nil, err
+		}
+	}
 	if options.Next != "" {
 		r.Next = strings.Split(options.Next, ",")
 	}
+	if r.UpstreamPolicy, err = relayer.ParseUpstreamPolicy(options.UpstreamPolicy); err != nil {
+		return nil, err
+	}
 	if options.UseTLS && len(r.Next) != 0 {
 		config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{options.Protocol}}
 		r.Dial = func(network, address string) (net.Conn, error) {
@@ -60,8 +171,7 @@ func startRelayer(localAddr string) {
 	if options.UseTLS && len(r.Next) == 0 {
 		config, err := core.CreateBarebonesTLSConfig(options.Protocol)
 		if err != nil {
-			log.Println(err)
-			return
+			return nil, err
 		}
 		r.Listen = func(network, address string) (net.Listener, error) {
 			return tls.Listen(network, address, config)
@@ -71,7 +181,7 @@ func startRelayer(localAddr string) {
 			return net.Listen(network, address)
 		}
 	}
-	r.Run()
+	return r, nil
 }
 
 func main() {
@@ -80,14 +190,25 @@ func main() {
 	rand.Seed(seed)
 	var debug bool
 	flag.StringVar(&options.Local, "l", "localhost:1080", "Addresses of local relayers")
-	flag.StringVar(&options.Next, "n", "", "Address of next-hop relayer")
+	flag.StringVar(&options.Next, "n", "", "Comma separated addresses of next-hop relayers")
+	flag.StringVar(&options.UpstreamPolicy, "upstream_policy", "random", "How to choose next-hop relayer: random, failover, round_robin, least_conn or latency")
 	flag.StringVar(&options.Protocol, "proto", "", "Name of relay protocol")
 	flag.BoolVar(&options.UseTLS, "tls", false, "Use TLS")
+	flag.StringVar(&options.Metrics, "metrics", "", "Listen address of metrics endpoint")
+	flag.StringVar(&options.RateLimit, "rate_limit", "", "Bandwidth limits in bytes per second, e.g. global=10M/100M,client=1M/10M,dest=512K/5M")
+	flag.StringVar(&options.Quota, "quota", "", "Bytes each client can relay per quota period, e.g. 100G")
+	flag.StringVar(&options.QuotaPeriod, "quota_period", "monthly", "Quota period: daily, weekly or monthly")
+	flag.StringVar(&options.QuotaFile, "quota_file", "", "File to persist quota usage")
+	flag.StringVar(&options.ACL, "acl", "", "File of destination ACL rules for end relayer")
+	flag.StringVar(&options.ACLGeoIP, "acl_geoip", "", "GeoIP database of geoip matchers in ACL rules")
+	flag.StringVar(&options.Resolver, "resolver", "", "DNS upstream of end relayer: system, <host:port>, tls://<host:port> or https://<host>/<path>")
+	flag.StringVar(&options.ResolverPrefer, "resolver_prefer", "", "IP preference of end relayer: ipv4, ipv6, ipv4_only or ipv6_only")
+	flag.StringVar(&options.Admin, "admin", "", "Loopback listen address or unix socket path of admin endpoint")
+	flag.StringVar(&options.AdminToken, "admin_token", "", "Token admin requests must carry in header "+relayer.ADMIN_TOKEN_HEADER)
+	flag.IntVar(&options.ShutdownTimeout, "shutdown_timeout", relayer.DEFAULT_SHUTDOWN_TIMEOUT, "Seconds to wait for in-flight relays on shutdown")
 	flag.BoolVar(&debug, "debug", false, "Enable debug logging")
 	flag.Parse()
-	if !debug {
-		log.SetOutput(ioutil.Discard)
-	}
+	relayer.SetDebugLogging(debug)
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	startRelayers()
 }
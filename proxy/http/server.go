@@ -1,6 +1,8 @@
 package http
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -8,6 +10,7 @@ import (
 	"net/http"
 
 	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/acl"
 )
 
 // See https://www.rfc-editor.org/rfc/rfc9110.html#field.connection
@@ -29,20 +32,26 @@ func RemoveHopByHopFields(header http.Header) {
 type HTTPProxy struct {
 	Transport http.RoundTripper
 	Dial      func(string, string) (net.Conn, error)
+	Switch    core.SwitchFunc
+	// If not nil, Permit is consulted before dialing and the request is
+	// refused if it returns an error.
+	Permit func(ctx context.Context, network, addr string) error
 }
 
-func (self *HTTPProxy) handleConnect(w http.ResponseWriter, req *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	h, ok := w.(http.Hijacker)
-	if !ok {
-		log.Println(fmt.Errorf("Hijacking not supported"))
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-		return
+func (self *HTTPProxy) permit(w http.ResponseWriter, req *http.Request, addr string) bool {
+	if self.Permit == nil {
+		return true
 	}
-	c, _, err := h.Hijack()
-	if err != nil {
+	if err := self.Permit(req.Context(), "tcp", addr); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (self *HTTPProxy) handleConnect(w http.ResponseWriter, req *http.Request) {
+	if !self.permit(w, req, req.Host) {
 		return
 	}
 	if self.Dial == nil {
@@ -50,11 +59,34 @@ func (self *HTTPProxy) handleConnect(w http.ResponseWriter, req *http.Request) {
 	}
 	remoteConn, err := self.Dial("tcp", req.Host)
 	if err != nil {
+		core.RecordDialFailure(err)
 		log.Println(err)
+		if errors.Is(err, core.ErrNotAllowed) || errors.Is(err, acl.ErrDenied) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
 		return
 	}
 	defer remoteConn.Close()
-	core.RunSimpleSwitch(core.NewPort(c, nil), core.NewPort(remoteConn, nil))
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		log.Println(fmt.Errorf("Hijacking not supported"))
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	c, _, err := h.Hijack()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer c.Close()
+	defer remoteConn.Close()
+	if self.Switch == nil {
+		self.Switch = core.DefaultSwitchFunc
+	}
+	self.Switch(req.Context(), core.NewPort(c, nil), core.NewPort(remoteConn, nil), req.Host)
 }
 
 func copyHeader(dst, src http.Header) {
@@ -66,10 +98,21 @@ func copyHeader(dst, src http.Header) {
 }
 
 func (self *HTTPProxy) handleNormal(w http.ResponseWriter, req *http.Request) {
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	if !self.permit(w, req, addr) {
+		return
+	}
 	req.RequestURI = ""
 	RemoveHopByHopFields(req.Header)
 	client := &http.Client{Transport: self.Transport}
 	resp, err := client.Do(req)
+	if errors.Is(err, core.ErrNotAllowed) || errors.Is(err, acl.ErrDenied) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3,28 +3,57 @@
 package intrinsic
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/bzEq/bx/core"
 	"github.com/bzEq/bx/core/iovec"
+	"github.com/bzEq/bx/core/mux"
 )
 
 type ClientContext struct {
-	GetProtocol  func() core.Protocol
-	RelayUDP     bool
-	Next         string
+	GetProtocol func() core.Protocol
+	RelayUDP    bool
+	Next        string
+	// Relayers to go through after Next. UDP isn't relayed along Path.
+	Path         []string
 	InternalDial func(network string, addr string) (net.Conn, error)
+	// Compress relayed TCP traffic if the remote side supports it. It needs a
+	// protocol keeping frames and is ignored along Path.
+	Compress bool
+	// Relay TCP over a multiplexed connection to Next if the remote side
+	// supports it, saving a handshake per connection. It needs a protocol
+	// keeping frames.
+	Mux bool
+	// Address of the datagram transport of the end relayer. UDP is relayed
+	// over it if it answers, otherwise over a TCP connection to Next.
+	Datagram string
+	// Dials QUIC datagrams of Next. UDP is relayed over them if it succeeds,
+	// before trying Datagram and TCP.
+	DialQUICDatagrams func() (*core.SyncPort, io.Closer, error)
 
-	router *core.SimpleRouter
+	framed     bool
+	helloMu    sync.Mutex
+	hello      *Hello
+	helloTime  time.Time
+	refreshing bool
+	muxMu      sync.Mutex
+	session    *mux.Session
+	router     *core.SimpleRouter
+	routerPort *udpRouterPort
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
 func (self *ClientContext) Init() error {
+	self.ctx, self.cancel = context.WithCancel(context.Background())
 	if self.GetProtocol == nil {
 		self.GetProtocol = func() core.Protocol {
 			return nil
@@ -33,38 +62,112 @@ func (self *ClientContext) Init() error {
 	if self.InternalDial == nil {
 		self.InternalDial = net.Dial
 	}
+	self.framed = self.GetProtocol() != nil
 	if !self.RelayUDP {
 		return nil
 	}
-	// Launch router for UDP relay.
-	routerReady := make(chan error)
-	go func() {
-		c, err := self.InternalDial("tcp", self.Next)
+	// Launch router for UDP relay. It reconnects with RELAY_UDP requested
+	// again once the connection is lost.
+	rp, err := newUDPRouterPort(func() (*udpRouterConn, error) {
+		hello, err := self.negotiate()
 		if err != nil {
-			routerReady <- err
-			return
+			return nil, err
 		}
-		defer c.Close()
-		self.router = &core.SimpleRouter{
-			// Set timeout a big value in order to serve UDP requests.
-			P: core.NewSyncPortWithTimeout(c, self.GetProtocol(), 60*60*24*30),
-			C: &UDPDispatcher{},
+		if hello.Features&FEATURE_UDP == 0 {
+			return nil, fmt.Errorf("UDP relay is not supported by %s", self.Next)
 		}
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		i := Intrinsic{Func: RELAY_UDP}
-		if err := enc.Encode(&i); err != nil {
-			routerReady <- err
-			return
+		rc, err := self.dialUDPRouter()
+		if err != nil {
+			return nil, err
 		}
-		if err := self.router.P.Pack(iovec.FromSlice(buf.Bytes())); err != nil {
-			routerReady <- err
-			return
+		rc.probed = rc.transport == "datagram" || hello.Features&FEATURE_UDP_PROBE != 0
+		return rc, nil
+	}, UDP_ROUTER_HEARTBEAT_INTERVAL*time.Second)
+	if err != nil {
+		return err
+	}
+	self.routerPort = rp
+	self.router = &core.SimpleRouter{
+		P: &core.SyncPort{Port: rp},
+		C: &UDPDispatcher{},
+	}
+	go self.router.Run()
+	return nil
+}
+
+// Seconds the UDP router waits for datagrams. It's a big value in order to
+// serve UDP requests.
+const UDP_ROUTER_TIMEOUT = 60 * 60 * 24 * 30
+
+// Seconds to wait for the TCPStatus of a relay. It outlasts dials of end
+// relayers.
+const TCP_STATUS_TIMEOUT = 60
+
+// dialUDPRouter returns the connection UDP routes are carried over,
+// preferring QUIC datagrams and then the datagram transport.
+func (self *ClientContext) dialUDPRouter() (*udpRouterConn, error) {
+	if self.DialQUICDatagrams != nil {
+		p, c, err := self.DialQUICDatagrams()
+		if err == nil {
+			log.Println("Relaying UDP over QUIC datagrams")
+			return &udpRouterConn{p: p, c: c, transport: "quic"}, nil
 		}
-		routerReady <- nil
-		self.router.Run()
-	}()
-	return <-routerReady
+		log.Println(fmt.Errorf("Falling back from QUIC datagrams: %w", err))
+	}
+	if self.Datagram != "" {
+		p, c, err := self.dialDatagram()
+		if err == nil {
+			log.Printf("Relaying UDP over datagram transport %s\n", self.Datagram)
+			return &udpRouterConn{p: p, c: c, transport: "datagram"}, nil
+		}
+		log.Println(fmt.Errorf("Falling back to relaying UDP over TCP: %w", err))
+	}
+	c, err := self.InternalDial("tcp", self.Next)
+	if err != nil {
+		core.RecordDialFailure(err)
+		return nil, err
+	}
+	p := core.NewSyncPortWithTimeout(c, self.GetProtocol(), UDP_ROUTER_TIMEOUT)
+	pack, err := EncodeIntrinsic(RELAY_UDP, nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := p.Pack(iovec.FromSlice(pack)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &udpRouterConn{p: p, c: c, transport: "tcp"}, nil
+}
+
+// UDPRoutes returns remote addresses of active UDP routes.
+func (self *ClientContext) UDPRoutes() map[core.RouteId]string {
+	if self.router == nil {
+		return nil
+	}
+	return self.router.C.(*UDPDispatcher).Entries()
+}
+
+// Close stops relays dialed via this context and tears down the connection
+// used for UDP relay.
+func (self *ClientContext) Close() error {
+	if self.cancel != nil {
+		self.cancel()
+	}
+	if self.routerPort == nil {
+		return nil
+	}
+	return self.routerPort.Close()
+}
+
+// UDPRouterHealth reports the connection of UDP relay, nil if UDP relay isn't
+// enabled.
+func (self *ClientContext) UDPRouterHealth() *UDPRouterHealth {
+	if self.routerPort == nil {
+		return nil
+	}
+	h := self.routerPort.Health()
+	return &h
 }
 
 func (self *ClientContext) Dial(network string, addr string) (net.Conn, error) {
@@ -78,6 +181,9 @@ func (self *ClientContext) Dial(network string, addr string) (net.Conn, error) {
 }
 
 func (self *ClientContext) dialUDP(network, addr string) (net.Conn, error) {
+	if self.router == nil {
+		return nil, fmt.Errorf("UDP relay is not enabled")
+	}
 	local := core.MakePipe()
 	c := local[1]
 	go func() {
@@ -96,41 +202,124 @@ func (self *ClientContext) dialUDP(network, addr string) (net.Conn, error) {
 	return local[0], nil
 }
 
+// dialTCP returns a conn relayed to addr by the remote side. If the remote
+// side answers TCPStatus, it returns once addr is reached, so that refusals
+// are reported as errors wrapping core.ErrNotAllowed.
 func (self *ClientContext) dialTCP(network, addr string) (net.Conn, error) {
-	local := core.MakePipe()
-	go func() {
-		defer local[1].Close()
-		c, err := self.InternalDial(network, self.Next)
+	start := time.Now()
+	hello, err := self.negotiate()
+	if err != nil {
+		return nil, err
+	}
+	common := hello.Features & self.features()
+	var cp core.Port
+	var c io.Closer
+	if common&FEATURE_MUX != 0 {
+		session, err := self.muxSession()
 		if err != nil {
-			log.Println(err)
-			return
+			return nil, err
 		}
-		defer c.Close()
-		i := Intrinsic{Func: RELAY_TCP}
-		{
-			data := &bytes.Buffer{}
-			req := TCPRequest{Addr: addr}
-			enc := gob.NewEncoder(data)
-			if err := enc.Encode(&req); err != nil {
-				log.Println(err)
-				return
-			}
-			i.Data = data.Bytes()
+		s, err := session.Open("")
+		if err != nil {
+			return nil, err
 		}
-		pack := &bytes.Buffer{}
-		enc := gob.NewEncoder(pack)
-		if err := enc.Encode(&i); err != nil {
-			log.Println(err)
-			return
+		cp, c = core.NewPort(s, &core.LengthPrefixedProtocol{}), s
+	} else {
+		conn, err := self.InternalDial(network, self.Next)
+		if err != nil {
+			core.RecordDialFailure(err)
+			return nil, err
 		}
-		cp := core.NewPort(c, self.GetProtocol())
-		// Connect remote server without further check to be fast.
-		cp.Pack(iovec.FromSlice(pack.Bytes()))
-		core.NewSimpleSwitch(cp, core.NewPort(local[1], nil)).Run()
+		cp, c = core.NewPort(conn, self.GetProtocol()), conn
+	}
+	req := &TCPRequest{
+		Addr:     addr,
+		Path:     self.Path,
+		Compress: common&FEATURE_COMPRESSION != 0,
+		Status:   common&FEATURE_TCP_STATUS != 0,
+	}
+	pack, err := EncodeIntrinsic(RELAY_TCP, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := cp.Pack(iovec.FromSlice(pack)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if req.Status {
+		if err := self.waitTCPStatus(cp, addr); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if req.Compress {
+		cp = newCompressedPort(cp)
+	}
+	core.RecordHandshake("intrinsic_client", start)
+	local := core.MakePipe()
+	go func() {
+		defer local[1].Close()
+		defer c.Close()
+		core.NewSimpleSwitch(core.NewPort(local[1], nil), cp).Run(self.ctx)
 	}()
 	return local[0], nil
 }
 
+// waitTCPStatus waits up to TCP_STATUS_TIMEOUT seconds for the TCPStatus of
+// the request relaying to addr.
+func (self *ClientContext) waitTCPStatus(cp core.Port, addr string) error {
+	ctx, cancel := context.WithTimeout(self.ctx, TCP_STATUS_TIMEOUT*time.Second)
+	defer cancel()
+	stop := core.CancelPortWhenDone(ctx, cp)
+	defer stop()
+	var b iovec.IoVec
+	if err := cp.Unpack(&b); err != nil {
+		return err
+	}
+	var status TCPStatus
+	if err := (codec{}).decode(b.Consume(), &status); err != nil {
+		return err
+	}
+	switch status.Code {
+	case TCP_STATUS_OK:
+		return nil
+	case TCP_STATUS_NOT_ALLOWED:
+		return fmt.Errorf("%w: %s: %s", core.ErrNotAllowed, addr, status.Err)
+	default:
+		return fmt.Errorf("Remote side failed to reach %s: %s", addr, status.Err)
+	}
+}
+
+// ExchangeDNS sends query to the remote side over a new connection to Next
+// and returns the response.
+func (self *ClientContext) ExchangeDNS(ctx context.Context, query []byte) ([]byte, error) {
+	if err := self.require(FEATURE_DNS, "DNS"); err != nil {
+		return nil, err
+	}
+	c, err := self.InternalDial("tcp", self.Next)
+	if err != nil {
+		core.RecordDialFailure(err)
+		return nil, err
+	}
+	defer c.Close()
+	pack, err := EncodeIntrinsic(RESOLVE_DNS, &DNSRequest{Msg: query})
+	if err != nil {
+		return nil, err
+	}
+	cp := core.NewPort(c, self.GetProtocol())
+	stop := core.CancelPortWhenDone(ctx, cp)
+	defer stop()
+	if err := cp.Pack(iovec.FromSlice(pack)); err != nil {
+		return nil, err
+	}
+	var b iovec.IoVec
+	if err := cp.Unpack(&b); err != nil {
+		return nil, err
+	}
+	return b.Consume(), nil
+}
+
 type UDPDispatcher struct {
 	t core.Map[core.RouteId, string]
 	c uint64
@@ -146,25 +335,32 @@ func (self *UDPDispatcher) DeleteEntry(id core.RouteId) {
 	self.t.Delete(id)
 }
 
+func (self *UDPDispatcher) Entries() map[core.RouteId]string {
+	m := make(map[core.RouteId]string)
+	self.t.Range(func(id core.RouteId, addr string) bool {
+		m[id] = addr
+		return true
+	})
+	return m
+}
+
 func (self *UDPDispatcher) Encode(id core.RouteId, data *iovec.IoVec) error {
 	raddr, in := self.t.Load(id)
 	if !in {
 		return fmt.Errorf("Remote address of RouteId #%d doesn't exist", id)
 	}
 	msg := UDPMessage{Id: id, Addr: raddr, Data: data.Consume()}
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(&msg); err != nil {
+	pack, err := codec{}.encode(&msg)
+	if err != nil {
 		return err
 	}
-	data.Take(buf.Bytes())
+	data.Take(pack)
 	return nil
 }
 
 func (self *UDPDispatcher) Decode(data *iovec.IoVec) (core.RouteId, error) {
-	dec := gob.NewDecoder(bytes.NewBuffer(data.Consume()))
 	var msg UDPMessage
-	if err := dec.Decode(&msg); err != nil {
+	if err := (codec{}).decode(data.Consume(), &msg); err != nil {
 		return core.RouteId(^uint64(0)), err
 	}
 	data.Take(msg.Data)
@@ -0,0 +1,71 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package intrinsic
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+)
+
+var ErrFrameTooLarge = errors.New("Decompressed frame is too large")
+
+// compressedPort compresses every frame on its own with DEFLATE, so that
+// frames can be decompressed without their predecessors. Frames decompressed
+// beyond limit bytes fail Unpack.
+type compressedPort struct {
+	core.Port
+	zw    *flate.Writer
+	zr    io.ReadCloser
+	limit int
+}
+
+func newCompressedPort(p core.Port) core.Port {
+	zw, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &compressedPort{
+		Port:  p,
+		zw:    zw,
+		zr:    flate.NewReader(nil),
+		limit: core.DEFAULT_BUFFER_LIMIT,
+	}
+}
+
+func (self *compressedPort) Pack(b *iovec.IoVec) error {
+	var buf bytes.Buffer
+	self.zw.Reset(&buf)
+	if _, err := b.WriteTo(self.zw); err != nil {
+		return err
+	}
+	if err := self.zw.Close(); err != nil {
+		return err
+	}
+	return self.Port.Pack(iovec.FromSlice(buf.Bytes()))
+}
+
+func (self *compressedPort) Unpack(b *iovec.IoVec) error {
+	var c iovec.IoVec
+	if err := self.Port.Unpack(&c); err != nil {
+		return err
+	}
+	if err := self.zr.(flate.Resetter).Reset(&c, nil); err != nil {
+		return err
+	}
+	// One byte beyond the limit tells oversized frames from ones of the limit.
+	data, err := io.ReadAll(io.LimitReader(self.zr, int64(self.limit)+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > self.limit {
+		return ErrFrameTooLarge
+	}
+	b.Take(data)
+	return nil
+}
+
+func (self *compressedPort) Cancel() error {
+	return core.CancelPort(self.Port)
+}
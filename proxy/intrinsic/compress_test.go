@@ -0,0 +1,52 @@
+package intrinsic
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+)
+
+func compressedPipe() (core.Port, *compressedPort) {
+	pipe := core.MakePipe()
+	w := newCompressedPort(core.NewPort(pipe[0], &core.LengthPrefixedProtocol{}))
+	r := newCompressedPort(core.NewPort(pipe[1], &core.LengthPrefixedProtocol{}))
+	return w, r.(*compressedPort)
+}
+
+func TestCompressedPort(t *testing.T) {
+	w, r := compressedPipe()
+	msgs := [][]byte{[]byte("wtf"), bytes.Repeat([]byte("wtf"), 4096), {}}
+	go func() {
+		for _, msg := range msgs {
+			w.Pack(iovec.FromSlice(append([]byte(nil), msg...)))
+		}
+	}()
+	for _, msg := range msgs {
+		var b iovec.IoVec
+		if err := r.Unpack(&b); err != nil {
+			t.Fatal(err)
+		}
+		if got := b.Consume(); !bytes.Equal(got, msg) {
+			t.Fatalf("Expected %d bytes, got %d", len(msg), len(got))
+		}
+	}
+}
+
+func TestCompressedPortRefusesOversizedFrames(t *testing.T) {
+	w, r := compressedPipe()
+	r.limit = 16
+	go func() {
+		w.Pack(iovec.FromSlice(bytes.Repeat([]byte{'w'}, r.limit)))
+		w.Pack(iovec.FromSlice(bytes.Repeat([]byte{'w'}, r.limit+1)))
+	}()
+	var b iovec.IoVec
+	if err := r.Unpack(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Unpack(&b); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("Expected ErrFrameTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package intrinsic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+)
+
+// UDPMessages of route 0 are probes, which are echoed back. Datagram
+// transports have always answered them, while other transports answer them
+// if FEATURE_UDP_PROBE is supported.
+const PROBE_ROUTE_ID = core.RouteId(0)
+
+// Seconds to wait for an answer of a probe.
+const DATAGRAM_PROBE_TIMEOUT = 1
+const DATAGRAM_PROBE_ATTEMPTS = 3
+
+// Maximum number of peers of a datagram transport.
+const MAX_DATAGRAM_PEERS = 1024
+
+// Datagrams per second a peer of a datagram transport can send, beyond which
+// its datagrams are dropped.
+const DATAGRAM_PEER_RATE = 4096
+
+// DatagramServer relays UDPMessages carried in datagrams of Conn the way
+// RELAY_UDP does, so that datagrams of a route don't wait for lost ones of
+// others as they do over a TCP connection. Each datagram carries a message
+// in wire format, encoded with the relay protocol.
+type DatagramServer struct {
+	Conn        net.PacketConn
+	GetProtocol func() core.Protocol
+	Dial        func(string, string) (net.Conn, error)
+	Permit      func(ctx context.Context, network, addr string) error
+	// Context of requests from addr. ctx of Serve is used if it's nil.
+	PeerContext func(ctx context.Context, addr net.Addr) context.Context
+	// Datagrams per second of each peer. DATAGRAM_PEER_RATE if it's zero.
+	PeerRate int
+	mu       sync.Mutex
+	peers    map[string]*datagramPeer
+}
+
+// datagramPeer is a client of the datagram transport, whose replies are
+// packed to its address.
+type datagramPeer struct {
+	conn     net.PacketConn
+	addr     net.Addr
+	ctx      context.Context
+	mu       sync.Mutex
+	p        core.Protocol
+	sessions udpSessionTable
+	limit    *core.TokenBucket
+	// Unix nanoseconds of last datagram received.
+	active int64
+}
+
+func (self *datagramPeer) touch() {
+	atomic.StoreInt64(&self.active, time.Now().UnixNano())
+}
+
+// idle returns true if the peer has sent nothing for a while and its
+// sessions have expired.
+func (self *datagramPeer) idle() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&self.active))) >= core.DEFAULT_UDP_TIMEOUT*time.Second &&
+		self.sessions.size() == 0
+}
+
+func (self *datagramPeer) Pack(b *iovec.IoVec) error {
+	self.mu.Lock()
+	data, err := core.EncodePacket(self.p, b)
+	self.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = self.conn.WriteTo(data, self.addr)
+	return err
+}
+
+func (self *datagramPeer) Unpack(b *iovec.IoVec) error {
+	return fmt.Errorf("Datagram peer can't be unpacked")
+}
+
+func (self *datagramPeer) CloseRead() error {
+	return nil
+}
+
+func (self *datagramPeer) CloseWrite() error {
+	return nil
+}
+
+// Serve relays datagrams until Conn is closed.
+func (self *DatagramServer) Serve(ctx context.Context) error {
+	if self.GetProtocol == nil {
+		self.GetProtocol = func() core.Protocol { return nil }
+	}
+	if self.Dial == nil {
+		self.Dial = net.Dial
+	}
+	if self.PeerRate == 0 {
+		self.PeerRate = DATAGRAM_PEER_RATE
+	}
+	self.peers = make(map[string]*datagramPeer)
+	defer self.closePeers(func(*datagramPeer) bool { return true })
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(core.DEFAULT_UDP_TIMEOUT * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				self.closePeers((*datagramPeer).idle)
+			case <-done:
+				return
+			}
+		}
+	}()
+	p := self.GetProtocol()
+	buf := make([]byte, core.MAX_DATAGRAM_SIZE)
+	for {
+		n, addr, err := self.Conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		var b iovec.IoVec
+		if err := core.DecodePacket(p, data, &b); err != nil {
+			// Datagrams not of the protocol are ignored silently.
+			continue
+		}
+		var msg UDPMessage
+		if err := (codec{}).decode(b.Consume(), &msg); err != nil {
+			log.Println(err)
+			continue
+		}
+		peer := self.peer(ctx, addr)
+		if peer == nil {
+			log.Println(fmt.Errorf("Too many datagram peers, datagram from %s is dropped", addr))
+			continue
+		}
+		peer.touch()
+		if !peer.limit.Allow(1) {
+			continue
+		}
+		s := &Server{
+			P:      peer,
+			Dial:   self.Dial,
+			Permit: self.Permit,
+		}
+		s.dispatchUDP(peer.ctx, &peer.sessions, &msg)
+	}
+}
+
+func (self *DatagramServer) peer(ctx context.Context, addr net.Addr) *datagramPeer {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if peer, in := self.peers[addr.String()]; in {
+		return peer
+	}
+	if len(self.peers) >= MAX_DATAGRAM_PEERS {
+		return nil
+	}
+	if self.PeerContext != nil {
+		ctx = self.PeerContext(ctx, addr)
+	}
+	peer := &datagramPeer{
+		conn:  self.Conn,
+		addr:  addr,
+		ctx:   ctx,
+		p:     self.GetProtocol(),
+		limit: core.NewTokenBucket(self.PeerRate, self.PeerRate),
+	}
+	self.peers[addr.String()] = peer
+	return peer
+}
+
+// closePeers closes sessions of peers f returns true for.
+func (self *DatagramServer) closePeers(f func(*datagramPeer) bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for k, peer := range self.peers {
+		if f(peer) {
+			peer.sessions.closeAll()
+			delete(self.peers, k)
+		}
+	}
+}
+
+// dialDatagram returns a port to the datagram transport at Datagram if it
+// answers probes.
+func (self *ClientContext) dialDatagram() (*core.SyncPort, io.Closer, error) {
+	c, err := net.Dial("udp", self.Datagram)
+	if err != nil {
+		return nil, nil, err
+	}
+	probe := core.NewPacketPort(c, self.GetProtocol(), DATAGRAM_PROBE_TIMEOUT)
+	pack, err := codec{}.encode(&UDPMessage{Id: PROBE_ROUTE_ID})
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	for i := 0; i < DATAGRAM_PROBE_ATTEMPTS; i++ {
+		if err = probe.Pack(iovec.FromSlice(pack)); err != nil {
+			continue
+		}
+		var b iovec.IoVec
+		if err = probe.Unpack(&b); err != nil {
+			continue
+		}
+		var msg UDPMessage
+		if err = (codec{}).decode(b.Consume(), &msg); err != nil {
+			continue
+		}
+		if msg.Id == PROBE_ROUTE_ID {
+			return &core.SyncPort{Port: core.NewPacketPort(c, self.GetProtocol(), UDP_ROUTER_TIMEOUT)}, c, nil
+		}
+	}
+	c.Close()
+	return nil, nil, fmt.Errorf("Datagram transport %s doesn't answer: %w", self.Datagram, err)
+}
@@ -0,0 +1,120 @@
+package intrinsic
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+)
+
+func serveUDPEcho(t *testing.T) string {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	return echo.LocalAddr().String()
+}
+
+func startDatagramServer(t *testing.T, rate int) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	s := &DatagramServer{Conn: pc, PeerRate: rate}
+	go s.Serve(context.Background())
+	return pc.LocalAddr().String()
+}
+
+func datagramClient(t *testing.T, addr string) *ClientContext {
+	client := &ClientContext{Datagram: addr}
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestDatagramServerRelaysUDP(t *testing.T) {
+	echo := serveUDPEcho(t)
+	p, c, err := datagramClient(t, startDatagramServer(t, 0)).dialDatagram()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i, msg := range []string{"wtf", "wtfwtf"} {
+		pack, err := codec{}.encode(&UDPMessage{Id: core.RouteId(i + 1), Addr: echo, Data: []byte(msg)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Pack(iovec.FromSlice(pack)); err != nil {
+			t.Fatal(err)
+		}
+		var b iovec.IoVec
+		if err := p.Unpack(&b); err != nil {
+			t.Fatal(err)
+		}
+		var reply UDPMessage
+		if err := (codec{}).decode(b.Consume(), &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Id != core.RouteId(i+1) || string(reply.Data) != msg {
+			t.Fatalf("Unexpected reply: %v", reply)
+		}
+	}
+}
+
+func TestDatagramTransportUnanswered(t *testing.T) {
+	// A socket taking datagrams without answering them.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, _, err := datagramClient(t, pc.LocalAddr().String()).dialDatagram(); err == nil {
+		t.Fatal("Expected silent datagram transport to be refused")
+	}
+}
+
+func TestDatagramServerPeerRate(t *testing.T) {
+	addr := startDatagramServer(t, 1)
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	probe, err := codec{}.encode(&UDPMessage{Id: PROBE_ROUTE_ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.Write(probe); err != nil {
+			t.Fatal(err)
+		}
+	}
+	answers := 0
+	buf := make([]byte, 2048)
+	for {
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := c.Read(buf); err != nil {
+			break
+		}
+		answers += 1
+	}
+	if answers != 1 {
+		t.Fatalf("Expected 1 answer within the rate, got %d", answers)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package intrinsic
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+)
+
+// Seconds between heartbeats on control connections of remote forwarding,
+// keeping them from idle timeout.
+const HEARTBEAT_INTERVAL = 60
+
+// Seconds an inbound connection waits to be claimed by its client.
+const PENDING_CONN_TIMEOUT = 30
+
+// ListenRequest asks the end relayer to listen on Addr. The end relayer
+// responds with a ListenResponse, then a RemoteConn for every inbound
+// connection, which the client claims over a new connection by AcceptRequest.
+type ListenRequest struct {
+	Addr string
+}
+
+type ListenResponse struct {
+	// Address actually listened.
+	Addr string
+	Err  string
+}
+
+// RemoteConn with zero Id is a heartbeat.
+type RemoteConn struct {
+	Id   uint64
+	From string
+}
+
+type AcceptRequest struct {
+	Id uint64
+}
+
+// ListenerTable keeps inbound connections of remote forwarding until their
+// clients claim them. It's shared by servers of a relayer.
+type ListenerTable struct {
+	Listen  func(string, string) (net.Listener, error)
+	mu      sync.Mutex
+	pending map[uint64]net.Conn
+}
+
+func (self *ListenerTable) add(c net.Conn) (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	// Ids are unguessable, so that connections can't be claimed by others.
+	id := binary.BigEndian.Uint64(b[:]) | 1
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.pending == nil {
+		self.pending = make(map[uint64]net.Conn)
+	}
+	self.pending[id] = c
+	time.AfterFunc(PENDING_CONN_TIMEOUT*time.Second, func() {
+		if c := self.take(id); c != nil {
+			c.Close()
+		}
+	})
+	return id, nil
+}
+
+func (self *ListenerTable) take(id uint64) net.Conn {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	c := self.pending[id]
+	delete(self.pending, id)
+	return c
+}
+
+func (self codec) pack(p core.Port, v Message) error {
+	b, err := self.encode(v)
+	if err != nil {
+		return err
+	}
+	return p.Pack(iovec.FromSlice(b))
+}
+
+// heartbeat sends heartbeats over p until done is closed.
+func heartbeat(p core.Port, c codec, done <-chan struct{}) {
+	t := time.NewTicker(HEARTBEAT_INTERVAL * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := c.pack(p, &RemoteConn{}); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// listenTCP listens on behalf of the client until the client closes the
+// control connection.
+func (self *Server) listenTCP(ctx context.Context, data []byte) error {
+	if self.Listeners == nil || self.Listeners.Listen == nil {
+		return fmt.Errorf("Remote forwarding is not supported")
+	}
+	var req ListenRequest
+	if err := self.codec.decode(data, &req); err != nil {
+		return err
+	}
+	p := core.AsSyncPort(self.P)
+	ln, err := self.Listeners.Listen("tcp", req.Addr)
+	if err != nil {
+		self.codec.pack(p, &ListenResponse{Err: err.Error()})
+		return err
+	}
+	defer ln.Close()
+	if err := self.codec.pack(p, &ListenResponse{Addr: ln.Addr().String()}); err != nil {
+		return err
+	}
+	stop := core.CancelPortWhenDone(ctx, p)
+	defer stop()
+	done := make(chan struct{})
+	defer close(done)
+	go heartbeat(p, self.codec, done)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			id, err := self.Listeners.add(c)
+			if err != nil {
+				log.Println(err)
+				c.Close()
+				continue
+			}
+			if err := self.codec.pack(p, &RemoteConn{Id: id, From: c.RemoteAddr().String()}); err != nil {
+				return
+			}
+		}
+	}()
+	// The client only sends heartbeats.
+	for {
+		var b iovec.IoVec
+		if err := p.Unpack(&b); err != nil {
+			return nil
+		}
+	}
+}
+
+func (self *Server) acceptTCP(ctx context.Context, data []byte) error {
+	if self.Listeners == nil {
+		return fmt.Errorf("Remote forwarding is not supported")
+	}
+	var req AcceptRequest
+	if err := self.codec.decode(data, &req); err != nil {
+		return err
+	}
+	c := self.Listeners.take(req.Id)
+	if c == nil {
+		return fmt.Errorf("Inbound connection #%x doesn't exist", req.Id)
+	}
+	defer c.Close()
+	if self.Switch == nil {
+		self.Switch = core.DefaultSwitchFunc
+	}
+	self.Switch(ctx, self.P, core.NewPort(c, nil), c.RemoteAddr().String())
+	return nil
+}
+
+type remoteAddr string
+
+func (self remoteAddr) Network() string {
+	return "tcp"
+}
+
+func (self remoteAddr) String() string {
+	return string(self)
+}
+
+type remoteListener struct {
+	cc        *ClientContext
+	c         net.Conn
+	p         core.Port
+	addr      remoteAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen asks the end relayer to listen on addr for TCP connections, which
+// are relayed back and returned by Accept of the listener. Inbound
+// connections are claimed over new connections to Next, so Next should reach
+// the same end relayer.
+func (self *ClientContext) Listen(network, addr string) (net.Listener, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("Unsupported network of remote forwarding: %s", network)
+	}
+	if err := self.require(FEATURE_REMOTE_FORWARD, "Remote forwarding"); err != nil {
+		return nil, err
+	}
+	c, err := self.InternalDial("tcp", self.Next)
+	if err != nil {
+		core.RecordDialFailure(err)
+		return nil, err
+	}
+	p := core.AsSyncPort(core.NewPort(c, self.GetProtocol()))
+	if err := func() error {
+		pack, err := EncodeIntrinsic(LISTEN_TCP, &ListenRequest{Addr: addr})
+		if err != nil {
+			return err
+		}
+		if err := p.Pack(iovec.FromSlice(pack)); err != nil {
+			return err
+		}
+		var b iovec.IoVec
+		if err := p.Unpack(&b); err != nil {
+			return err
+		}
+		var resp ListenResponse
+		if err := (codec{}).decode(b.Consume(), &resp); err != nil {
+			return err
+		}
+		if resp.Err != "" {
+			return errors.New(resp.Err)
+		}
+		addr = resp.Addr
+		return nil
+	}(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Failed to listen on %s remotely: %w", addr, err)
+	}
+	ln := &remoteListener{
+		cc:    self,
+		c:     c,
+		p:     p,
+		addr:  remoteAddr(addr),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	go heartbeat(p, codec{}, ln.done)
+	go ln.run()
+	return ln, nil
+}
+
+func (self *remoteListener) run() {
+	defer self.Close()
+	for {
+		var b iovec.IoVec
+		if err := self.p.Unpack(&b); err != nil {
+			return
+		}
+		var rc RemoteConn
+		if err := (codec{}).decode(b.Consume(), &rc); err != nil {
+			log.Println(err)
+			return
+		}
+		if rc.Id != 0 {
+			go self.claim(rc.Id)
+		}
+	}
+}
+
+func (self *remoteListener) claim(id uint64) {
+	c, err := self.cc.InternalDial("tcp", self.cc.Next)
+	if err != nil {
+		core.RecordDialFailure(err)
+		log.Println(err)
+		return
+	}
+	pack, err := EncodeIntrinsic(ACCEPT_TCP, &AcceptRequest{Id: id})
+	if err != nil {
+		c.Close()
+		log.Println(err)
+		return
+	}
+	cp := core.NewPort(c, self.cc.GetProtocol())
+	if err := cp.Pack(iovec.FromSlice(pack)); err != nil {
+		c.Close()
+		log.Println(err)
+		return
+	}
+	local := core.MakePipe()
+	go func() {
+		defer c.Close()
+		defer local[1].Close()
+		core.NewSimpleSwitch(core.NewPort(local[1], nil), cp).Run(self.cc.ctx)
+	}()
+	select {
+	case self.conns <- local[0]:
+	case <-self.done:
+		local[0].Close()
+	}
+}
+
+func (self *remoteListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-self.conns:
+		return c, nil
+	case <-self.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the end relayer listening.
+func (self *remoteListener) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.done)
+		self.c.Close()
+	})
+	return nil
+}
+
+func (self *remoteListener) Addr() net.Addr {
+	return self.addr
+}
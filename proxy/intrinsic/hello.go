@@ -0,0 +1,205 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package intrinsic
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+)
+
+// Version of the intrinsic protocol. Peers work together if each one's
+// version is no older than the other's MIN_PROTOCOL_VERSION. Version 1 is the
+// wire format without hello.
+const PROTOCOL_VERSION = 2
+const MIN_PROTOCOL_VERSION = 2
+
+// Features the remote side of a tunnel supports.
+const (
+	FEATURE_UDP = 1 << iota
+	FEATURE_DNS
+	FEATURE_REMOTE_FORWARD
+	// Frames of relayed TCP traffic are compressed.
+	FEATURE_COMPRESSION
+	// TCP relays share a multiplexed connection.
+	FEATURE_MUX
+	// UDPMessages of PROBE_ROUTE_ID are echoed back over every transport.
+	FEATURE_UDP_PROBE
+	// TCPRequests asking for a TCPStatus are answered.
+	FEATURE_TCP_STATUS
+)
+
+// Seconds to wait for the remote side answering a hello.
+const HELLO_TIMEOUT = 10
+
+// Seconds a hello is trusted before the remote side is asked again, so that
+// upgrades of the remote side are noticed.
+const HELLO_TTL = 300
+
+// Hello is exchanged before other requests. The remote side answers with its
+// own Hello. Hellos are answered by end relayers, so features are the end
+// relayer's.
+type Hello struct {
+	Version    uint64
+	MinVersion uint64
+	Features   uint64
+}
+
+func (self *Hello) encodeWire(enc *wireEncoder) {
+	enc.putUint(1, self.Version)
+	enc.putUint(2, self.MinVersion)
+	enc.putUint(3, self.Features)
+}
+
+func (self *Hello) decodeWire(fields wireFields) error {
+	if err := fields.getUint(1, &self.Version); err != nil {
+		return err
+	}
+	if err := fields.getUint(2, &self.MinVersion); err != nil {
+		return err
+	}
+	return fields.getUint(3, &self.Features)
+}
+
+func localHello(features uint64) *Hello {
+	return &Hello{
+		Version:    PROTOCOL_VERSION,
+		MinVersion: MIN_PROTOCOL_VERSION,
+		Features:   features,
+	}
+}
+
+// checkVersion returns an error if peer can't work with this side.
+func checkVersion(peer *Hello, name string) error {
+	if peer.Version < MIN_PROTOCOL_VERSION || peer.MinVersion > PROTOCOL_VERSION {
+		return fmt.Errorf("Protocol version %d (min %d) of %s is incompatible with local version %d (min %d)",
+			peer.Version, peer.MinVersion, name, PROTOCOL_VERSION, MIN_PROTOCOL_VERSION)
+	}
+	return nil
+}
+
+func (self *Server) features() uint64 {
+	var f uint64 = FEATURE_UDP | FEATURE_UDP_PROBE | FEATURE_COMPRESSION | FEATURE_MUX | FEATURE_TCP_STATUS
+	if self.ExchangeDNS != nil {
+		f |= FEATURE_DNS
+	}
+	if self.Listeners != nil && self.Listeners.Listen != nil {
+		f |= FEATURE_REMOTE_FORWARD
+	}
+	return f
+}
+
+func (self *Server) hello(data []byte) error {
+	var req Hello
+	if err := self.codec.decode(data, &req); err != nil {
+		return err
+	}
+	// The client is answered anyway, so that it reports the mismatch.
+	if err := checkVersion(&req, "client"); err != nil {
+		log.Println(err)
+	}
+	return self.codec.pack(self.P, localHello(self.features()))
+}
+
+// features returns features this side uses if the remote side supports them.
+func (self *ClientContext) features() uint64 {
+	var f uint64 = FEATURE_DNS | FEATURE_REMOTE_FORWARD
+	if self.RelayUDP {
+		f |= FEATURE_UDP | FEATURE_UDP_PROBE
+	}
+	if self.framed {
+		f |= FEATURE_TCP_STATUS
+	}
+	if self.Mux && self.framed {
+		f |= FEATURE_MUX
+	}
+	if self.Compress && self.framed && len(self.Path) == 0 {
+		f |= FEATURE_COMPRESSION
+	}
+	return f
+}
+
+// negotiate returns the Hello of the remote side. Only dials before the first
+// Hello wait for hellos to be exchanged. An outdated Hello is still returned
+// while it's refreshed in background, so that dials aren't held up.
+func (self *ClientContext) negotiate() (*Hello, error) {
+	self.helloMu.Lock()
+	defer self.helloMu.Unlock()
+	if self.hello != nil {
+		if time.Since(self.helloTime) >= HELLO_TTL*time.Second && !self.refreshing {
+			self.refreshing = true
+			go self.refreshHello()
+		}
+		return self.hello, nil
+	}
+	hello, err := self.exchangeHello()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to negotiate with %s, it may be older than protocol version %d: %w", self.Next, PROTOCOL_VERSION, err)
+	}
+	if err := checkVersion(hello, self.Next); err != nil {
+		return nil, err
+	}
+	self.hello, self.helloTime = hello, time.Now()
+	return hello, nil
+}
+
+// refreshHello exchanges hellos again. The outdated Hello is kept if the
+// remote side doesn't answer, and dropped if the remote side turns out
+// incompatible, so that the next dial reports why.
+func (self *ClientContext) refreshHello() {
+	hello, err := self.exchangeHello()
+	self.helloMu.Lock()
+	defer self.helloMu.Unlock()
+	self.refreshing = false
+	if err != nil {
+		log.Println(fmt.Errorf("Failed to refresh hello of %s: %w", self.Next, err))
+		return
+	}
+	if err := checkVersion(hello, self.Next); err != nil {
+		log.Println(err)
+		self.hello = nil
+		return
+	}
+	self.hello, self.helloTime = hello, time.Now()
+}
+
+func (self *ClientContext) exchangeHello() (*Hello, error) {
+	c, err := self.InternalDial("tcp", self.Next)
+	if err != nil {
+		core.RecordDialFailure(err)
+		return nil, err
+	}
+	defer c.Close()
+	pack, err := EncodeIntrinsic(HELLO, localHello(self.features()))
+	if err != nil {
+		return nil, err
+	}
+	cp := core.NewPortWithTimeout(c, self.GetProtocol(), HELLO_TIMEOUT)
+	if err := cp.Pack(iovec.FromSlice(pack)); err != nil {
+		return nil, err
+	}
+	var b iovec.IoVec
+	if err := cp.Unpack(&b); err != nil {
+		return nil, err
+	}
+	var hello Hello
+	if err := (codec{}).decode(b.Consume(), &hello); err != nil {
+		return nil, err
+	}
+	return &hello, nil
+}
+
+// require returns an error unless the remote side supports feature.
+func (self *ClientContext) require(feature uint64, name string) error {
+	hello, err := self.negotiate()
+	if err != nil {
+		return err
+	}
+	if hello.Features&feature == 0 {
+		return fmt.Errorf("%s is not supported by %s", name, self.Next)
+	}
+	return nil
+}
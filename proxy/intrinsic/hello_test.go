@@ -0,0 +1,102 @@
+package intrinsic
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bx/core"
+)
+
+func TestCheckVersion(t *testing.T) {
+	for _, tc := range []struct {
+		peer Hello
+		ok   bool
+	}{
+		{Hello{Version: PROTOCOL_VERSION, MinVersion: MIN_PROTOCOL_VERSION}, true},
+		{Hello{Version: PROTOCOL_VERSION + 1, MinVersion: PROTOCOL_VERSION}, true},
+		{Hello{Version: PROTOCOL_VERSION + 1, MinVersion: PROTOCOL_VERSION + 1}, false},
+		{Hello{Version: MIN_PROTOCOL_VERSION - 1, MinVersion: 1}, false},
+		{Hello{}, false},
+	} {
+		if err := checkVersion(&tc.peer, "peer"); (err == nil) != tc.ok {
+			t.Fatalf("Expected compatibility of %+v to be %v, got %v", tc.peer, tc.ok, err)
+		}
+	}
+}
+
+// helloClient returns a client whose dials to Next are served by s, and the
+// number of dials made.
+func helloClient(t *testing.T, s *Server) (*ClientContext, *int32) {
+	var dials int32
+	client := &ClientContext{
+		Next:        "end",
+		GetProtocol: func() core.Protocol { return &core.LengthPrefixedProtocol{} },
+		InternalDial: func(network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			pipe := core.MakePipe()
+			server := *s
+			server.P = core.NewPort(pipe[1], &core.LengthPrefixedProtocol{})
+			go func() {
+				defer pipe[1].Close()
+				server.Run(context.Background())
+			}()
+			return pipe[0], nil
+		},
+	}
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return client, &dials
+}
+
+func TestFeatureIntersection(t *testing.T) {
+	client, _ := helloClient(t, &Server{ExchangeDNS: func(context.Context, []byte) ([]byte, error) { return nil, nil }})
+	client.Mux = true
+	hello, err := client.negotiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if common := hello.Features & client.features(); common != FEATURE_DNS|FEATURE_MUX|FEATURE_TCP_STATUS {
+		t.Fatalf("Expected DNS, mux and TCP status in common, got %#x", common)
+	}
+	if err := client.require(FEATURE_REMOTE_FORWARD, "Remote forwarding"); err == nil {
+		t.Fatal("Expected remote forwarding to be unsupported")
+	}
+	// Features need a protocol keeping frames.
+	client.framed = false
+	if common := hello.Features & client.features(); common != FEATURE_DNS {
+		t.Fatalf("Expected DNS in common, got %#x", common)
+	}
+}
+
+func TestHelloRefreshInBackground(t *testing.T) {
+	client, dials := helloClient(t, &Server{})
+	hello, err := client.negotiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.helloMu.Lock()
+	client.helloTime = time.Now().Add(-HELLO_TTL * time.Second)
+	client.helloMu.Unlock()
+	// The outdated hello is answered at once while it's refreshed.
+	if stale, err := client.negotiate(); err != nil || stale != hello {
+		t.Fatalf("Expected the outdated hello, got %v, %v", stale, err)
+	}
+	deadline := time.Now().Add(HELLO_TIMEOUT * time.Second)
+	for time.Now().Before(deadline) {
+		client.helloMu.Lock()
+		refreshed := client.hello != hello && !client.refreshing
+		client.helloMu.Unlock()
+		if refreshed {
+			if n := atomic.LoadInt32(dials); n != 2 {
+				t.Fatalf("Expected 2 hello exchanges, got %d", n)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Hello isn't refreshed")
+}
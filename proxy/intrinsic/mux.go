@@ -0,0 +1,77 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package intrinsic
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+	"github.com/bzEq/bx/core/mux"
+)
+
+// serveMux serves requests over streams of a multiplexed connection.
+func (self *Server) serveMux(ctx context.Context) error {
+	if self.inMux {
+		return fmt.Errorf("Nested multiplexing is not supported")
+	}
+	stop := core.CancelPortWhenDone(ctx, self.P)
+	defer stop()
+	session := mux.NewSession(self.P, false)
+	defer session.Close()
+	for {
+		s, err := session.Accept()
+		if err != nil {
+			return nil
+		}
+		server := *self
+		server.P = core.NewPort(s, &core.LengthPrefixedProtocol{})
+		server.inMux = true
+		go func(s net.Conn) {
+			defer s.Close()
+			server.Run(ctx)
+		}(s)
+	}
+}
+
+// muxSession returns the multiplexed connection to Next, establishing it if
+// there's none alive.
+func (self *ClientContext) muxSession() (*mux.Session, error) {
+	self.muxMu.Lock()
+	defer self.muxMu.Unlock()
+	if self.session != nil {
+		select {
+		case <-self.session.Done():
+		default:
+			return self.session, nil
+		}
+	}
+	c, err := self.InternalDial("tcp", self.Next)
+	if err != nil {
+		core.RecordDialFailure(err)
+		return nil, err
+	}
+	pack, err := EncodeIntrinsic(MUX, nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	cp := core.NewPort(c, self.GetProtocol())
+	if err := cp.Pack(iovec.FromSlice(pack)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	session := mux.NewSession(cp, true)
+	go func() {
+		select {
+		case <-session.Done():
+		case <-self.ctx.Done():
+			session.Close()
+		}
+		c.Close()
+	}()
+	self.session = session
+	return session, nil
+}
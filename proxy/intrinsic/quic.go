@@ -0,0 +1,391 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package intrinsic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN of relayers talking over QUIC.
+const QUIC_ALPN = "bx-intrinsic"
+
+// Seconds a QUIC connection lives without traffic. Dialing sides send
+// keep-alives every QUIC_KEEP_ALIVE_PERIOD seconds, so that connections
+// waiting for streams outlive NAT mappings.
+const QUIC_IDLE_TIMEOUT = 60
+const QUIC_KEEP_ALIVE_PERIOD = 15
+
+// Seconds to wait for a QUIC handshake or for a stream to be opened.
+const QUIC_DIAL_TIMEOUT = 10
+
+// Maximum number of concurrent streams a peer can open on a QUIC connection.
+const QUIC_MAX_STREAMS = 1024
+
+func newQUICConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: QUIC_DIAL_TIMEOUT * time.Second,
+		MaxIdleTimeout:       QUIC_IDLE_TIMEOUT * time.Second,
+		KeepAlivePeriod:      QUIC_KEEP_ALIVE_PERIOD * time.Second,
+		MaxIncomingStreams:   QUIC_MAX_STREAMS,
+		EnableDatagrams:      true,
+		Allow0RTT:            true,
+	}
+}
+
+// quicStream is a stream of a QUIC connection serving as a conn. Closing it
+// closes both directions, while CloseWrite only sends FIN.
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (self *quicStream) LocalAddr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+func (self *quicStream) RemoteAddr() net.Addr {
+	return self.conn.RemoteAddr()
+}
+
+func (self *quicStream) Close() error {
+	self.Stream.CancelRead(0)
+	return self.Stream.Close()
+}
+
+func (self *quicStream) CloseRead() error {
+	self.Stream.CancelRead(0)
+	return nil
+}
+
+func (self *quicStream) CloseWrite() error {
+	return self.Stream.Close()
+}
+
+// quicDatagramPort carries a message in each datagram of a QUIC connection.
+// Messages aren't encoded by a relay protocol, since QUIC protects them
+// already. Closing the port leaves the connection intact.
+type quicDatagramPort struct {
+	conn   *quic.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newQUICDatagramPort(conn *quic.Conn) *quicDatagramPort {
+	self := &quicDatagramPort{conn: conn}
+	self.ctx, self.cancel = context.WithCancel(conn.Context())
+	return self
+}
+
+// Pack drops messages too large for the path, the way a link of small MTU
+// drops UDP datagrams, rather than failing routes sharing the port.
+func (self *quicDatagramPort) Pack(b *iovec.IoVec) error {
+	if err := self.ctx.Err(); err != nil {
+		return err
+	}
+	err := self.conn.SendDatagram(b.Consume())
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return nil
+	}
+	return err
+}
+
+func (self *quicDatagramPort) Unpack(b *iovec.IoVec) error {
+	data, err := self.conn.ReceiveDatagram(self.ctx)
+	if err != nil {
+		return err
+	}
+	b.Take(data)
+	return nil
+}
+
+func (self *quicDatagramPort) Cancel() error {
+	self.cancel()
+	return nil
+}
+
+func (self *quicDatagramPort) Close() error {
+	self.cancel()
+	return nil
+}
+
+func (self *quicDatagramPort) CloseRead() error {
+	return nil
+}
+
+func (self *quicDatagramPort) CloseWrite() error {
+	return nil
+}
+
+// waitDatagrams waits for the handshake of conn and fails unless the peer
+// accepts datagrams.
+func waitDatagrams(conn *quic.Conn) error {
+	t := time.NewTimer(QUIC_DIAL_TIMEOUT * time.Second)
+	defer t.Stop()
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		return context.Cause(conn.Context())
+	case <-t.C:
+		return fmt.Errorf("QUIC handshake with %s timed out", conn.RemoteAddr())
+	}
+	if !conn.ConnectionState().SupportsDatagrams {
+		return fmt.Errorf("QUIC peer %s doesn't accept datagrams", conn.RemoteAddr())
+	}
+	return nil
+}
+
+// QUICTransport dials relayers over QUIC. Connections are shared, each Dial
+// opening a stream of the connection to addr, so that only the first dial to
+// a relayer pays for a handshake. Later connections to a relayer resume their
+// TLS sessions with 0-RTT. Since all connections go out of one unbound
+// socket, they survive local address changes, which the relayer validates as
+// migrations of the connections.
+//
+// Certificates of relayers aren't verified, since QUICServer presents one
+// generated at startup. TLS only keeps traffic from passive observers, the
+// way relay protocols over TCP do, and doesn't authenticate relayers against
+// an active attacker on the path.
+type QUICTransport struct {
+	mu        sync.Mutex
+	tr        *quic.Transport
+	tlsConfig *tls.Config
+	conns     map[string]*quic.Conn
+	closed    bool
+}
+
+// conn returns the live connection to addr, dialing it if there is none.
+func (self *QUICTransport) conn(addr string) (*quic.Conn, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return nil, net.ErrClosed
+	}
+	if conn, in := self.conns[addr]; in && conn.Context().Err() == nil {
+		return conn, nil
+	}
+	if self.tr == nil {
+		pc, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+		self.tr = &quic.Transport{Conn: pc}
+		self.tlsConfig = &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{QUIC_ALPN},
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		}
+		self.conns = make(map[string]*quic.Conn)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	config := self.tlsConfig.Clone()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		config.ServerName = host
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), QUIC_DIAL_TIMEOUT*time.Second)
+	defer cancel()
+	conn, err := self.tr.DialEarly(ctx, raddr, config, newQUICConfig())
+	if err != nil {
+		return nil, err
+	}
+	self.conns[addr] = conn
+	return conn, nil
+}
+
+// Dial opens a stream to the relayer at addr. It has the signature of a dial
+// function, so that it can be used in place of one.
+func (self *QUICTransport) Dial(network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("Unsupported network over QUIC: %s", network)
+	}
+	conn, err := self.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), QUIC_DIAL_TIMEOUT*time.Second)
+	defer cancel()
+	s, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{Stream: s, conn: conn}, nil
+}
+
+// DialDatagrams returns a port carrying UDPMessages in datagrams of the
+// connection to the relayer at addr. Closing the port leaves streams of the
+// connection intact.
+func (self *QUICTransport) DialDatagrams(addr string) (*core.SyncPort, io.Closer, error) {
+	conn, err := self.conn(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := waitDatagrams(conn); err != nil {
+		return nil, nil, err
+	}
+	p := newQUICDatagramPort(conn)
+	return &core.SyncPort{Port: p}, p, nil
+}
+
+// Close closes all connections, interrupting streams over them.
+func (self *QUICTransport) Close() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+	for _, conn := range self.conns {
+		conn.CloseWithError(0, "")
+	}
+	self.conns = nil
+	if self.tr == nil {
+		return nil
+	}
+	self.tr.Close()
+	return self.tr.Conn.Close()
+}
+
+// QUICServer accepts relayers over QUIC on Conn. Each stream is served by
+// Handle as a conn. Datagrams are UDPMessages relayed the way RELAY_UDP
+// does, whose replies go back in datagrams of the same connection.
+type QUICServer struct {
+	Conn   net.PacketConn
+	Handle func(ctx context.Context, c net.Conn)
+	// Relay UDP in datagrams. Datagrams aren't negotiated if it's false, so
+	// that peers relay UDP over streams served by Handle instead.
+	Datagrams bool
+	Dial      func(string, string) (net.Conn, error)
+	Permit    func(ctx context.Context, network, addr string) error
+	// Context of connections from addr. ctx of Serve is used if it's nil.
+	PeerContext func(ctx context.Context, addr net.Addr) context.Context
+	mu          sync.Mutex
+	ln          *quic.EarlyListener
+	stop        context.CancelFunc
+	closed      bool
+}
+
+// Serve accepts connections until Close is called. Connections stop
+// accepting streams then, and are closed once their streams are done. Conn is
+// closed once all connections are.
+func (self *QUICServer) Serve(ctx context.Context) error {
+	defer self.Conn.Close()
+	if self.Dial == nil {
+		self.Dial = net.Dial
+	}
+	tlsConfig, err := core.CreateBarebonesTLSConfig(QUIC_ALPN)
+	if err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: self.Conn}
+	defer tr.Close()
+	config := newQUICConfig()
+	config.EnableDatagrams = self.Datagrams
+	ln, err := tr.ListenEarly(tlsConfig, config)
+	if err != nil {
+		return err
+	}
+	accepting, stop := context.WithCancel(ctx)
+	defer stop()
+	self.mu.Lock()
+	if self.closed {
+		self.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	self.ln, self.stop = ln, stop
+	self.mu.Unlock()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept(accepting)
+		if err != nil {
+			if accepting.Err() != nil || errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			self.serveConn(ctx, accepting, conn)
+		}()
+	}
+}
+
+func (self *QUICServer) serveConn(ctx, accepting context.Context, conn *quic.Conn) {
+	if self.PeerContext != nil {
+		ctx = self.PeerContext(ctx, conn.RemoteAddr())
+	}
+	if self.Datagrams {
+		go self.serveDatagrams(ctx, conn)
+	}
+	var wg sync.WaitGroup
+	for {
+		s, err := conn.AcceptStream(accepting)
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			self.Handle(ctx, &quicStream{Stream: s, conn: conn})
+		}()
+	}
+	wg.Wait()
+	conn.CloseWithError(0, "")
+}
+
+func (self *QUICServer) serveDatagrams(ctx context.Context, conn *quic.Conn) {
+	if err := waitDatagrams(conn); err != nil {
+		return
+	}
+	p := newQUICDatagramPort(conn)
+	defer p.Close()
+	var sessions udpSessionTable
+	defer sessions.closeAll()
+	s := &Server{
+		P:      p,
+		Dial:   self.Dial,
+		Permit: self.Permit,
+	}
+	for {
+		var b iovec.IoVec
+		if err := p.Unpack(&b); err != nil {
+			return
+		}
+		var msg UDPMessage
+		if err := (codec{}).decode(b.Consume(), &msg); err != nil {
+			log.Println(err)
+			continue
+		}
+		s.dispatchUDP(ctx, &sessions, &msg)
+	}
+}
+
+// Close stops accepting connections and streams.
+func (self *QUICServer) Close() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.closed = true
+	if self.ln == nil {
+		return nil
+	}
+	self.stop()
+	return self.ln.Close()
+}
@@ -0,0 +1,118 @@
+package intrinsic
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/bzEq/bx/core/iovec"
+)
+
+func startQUICServer(t *testing.T, datagrams bool) (*QUICServer, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &QUICServer{
+		Conn:      pc,
+		Datagrams: datagrams,
+		Handle: func(ctx context.Context, c net.Conn) {
+			defer c.Close()
+			io.Copy(c, c)
+		},
+	}
+	go s.Serve(context.Background())
+	return s, pc.LocalAddr().String()
+}
+
+func TestQUICStreams(t *testing.T) {
+	s, addr := startQUICServer(t, false)
+	defer s.Close()
+	tr := &QUICTransport{}
+	defer tr.Close()
+	for _, msg := range []string{"wtf", "wtfwtf"} {
+		c, err := tr.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.(*quicStream).CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != msg {
+			t.Fatalf("Expected %q, got %q", msg, b)
+		}
+		c.Close()
+	}
+	if len(tr.conns) != 1 {
+		t.Fatalf("Expected streams sharing 1 connection, got %d", len(tr.conns))
+	}
+}
+
+func TestQUICDatagrams(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	s, addr := startQUICServer(t, true)
+	defer s.Close()
+	tr := &QUICTransport{}
+	defer tr.Close()
+	p, c, err := tr.DialDatagrams(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	pack, err := codec{}.encode(&UDPMessage{Id: 1, Addr: echo.LocalAddr().String(), Data: []byte("wtf")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Pack(iovec.FromSlice(pack)); err != nil {
+		t.Fatal(err)
+	}
+	var b iovec.IoVec
+	if err := p.Unpack(&b); err != nil {
+		t.Fatal(err)
+	}
+	var msg UDPMessage
+	if err := (codec{}).decode(b.Consume(), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != 1 || string(msg.Data) != "wtf" {
+		t.Fatalf("Unexpected reply: %v", msg)
+	}
+}
+
+func TestQUICDatagramsRefused(t *testing.T) {
+	s, addr := startQUICServer(t, false)
+	defer s.Close()
+	tr := &QUICTransport{}
+	defer tr.Close()
+	if _, _, err := tr.DialDatagrams(addr); err == nil {
+		t.Fatal("Expected datagrams to be refused")
+	}
+	// Streams of the connection are still served.
+	c, err := tr.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -3,14 +3,15 @@
 package intrinsic
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"time"
 
 	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/acl"
 	"github.com/bzEq/bx/core/iovec"
 )
 
@@ -22,10 +23,73 @@ type Intrinsic struct {
 const (
 	RELAY_UDP = iota + 1
 	RELAY_TCP
+	RESOLVE_DNS
+	LISTEN_TCP
+	ACCEPT_TCP
+	HELLO
+	MUX
 )
 
 type TCPRequest struct {
 	Addr string
+	// Relayers to go through before reaching Addr, in order.
+	Path []string
+	// Frames from and to the client are compressed.
+	Compress bool
+	// Addr is relayed once a TCPStatus is answered, so that the client learns
+	// whether Addr is reached.
+	Status bool
+}
+
+// Codes of TCPStatus.
+const (
+	TCP_STATUS_OK = iota
+	// Addr is refused by policies of a relayer, e.g. ACLs and quotas.
+	TCP_STATUS_NOT_ALLOWED
+	TCP_STATUS_UNREACHABLE
+)
+
+type TCPStatus struct {
+	Code uint64
+	Err  string
+}
+
+// dialStatus returns the TCPStatus code of a failed dial. Dials can be denied
+// by ACLs after the request is permitted, e.g., when the destination resolves
+// to other IPs.
+func dialStatus(err error) uint64 {
+	if errors.Is(err, acl.ErrDenied) {
+		return TCP_STATUS_NOT_ALLOWED
+	}
+	return TCP_STATUS_UNREACHABLE
+}
+
+// answerTCP answers req with code and err if a TCPStatus is requested.
+func (self *Server) answerTCP(req *TCPRequest, code uint64, err error) error {
+	if req == nil || !req.Status {
+		return nil
+	}
+	status := TCPStatus{Code: code}
+	if err != nil {
+		status.Err = err.Error()
+	}
+	pack, err := self.codec.encode(&status)
+	if err != nil {
+		return err
+	}
+	return self.P.Pack(iovec.FromSlice(pack))
+}
+
+// EncodeIntrinsic encodes an Intrinsic of function f carrying req in wire
+// format.
+func EncodeIntrinsic(f byte, req Message) ([]byte, error) {
+	return codec{}.encodeIntrinsic(f, req)
+}
+
+// DNSRequest carries a DNS query in wire format. The response is sent back
+// in wire format as a single frame.
+type DNSRequest struct {
+	Msg []byte
 }
 
 type UDPMessage struct {
@@ -36,99 +100,199 @@ type UDPMessage struct {
 
 type Server struct {
 	P core.Port
+	// Support custom dial.
+	Dial   func(string, string) (net.Conn, error)
+	Switch core.SwitchFunc
+	// If not nil, Permit is consulted before dialing and the request is
+	// refused if it returns an error.
+	Permit func(ctx context.Context, network, addr string) error
+	// DialRelayer dials relayers requests are forwarded to. Requests with
+	// path are refused if it's nil.
+	DialRelayer func(string, string) (net.Conn, error)
+	// Protocol to talk with relayers requests are forwarded to.
+	GetRelayProtocol func() core.Protocol
+	// If not empty, requests without path are forwarded to Next instead of
+	// being relayed to their destinations. UDP relays and DNS queries are
+	// forwarded as a whole.
+	Next string
+	// ExchangeDNS answers DNS queries. DNS queries are refused if it's nil.
+	ExchangeDNS func(ctx context.Context, query []byte) ([]byte, error)
+	// Listeners serves remote forwarding. Remote forwarding requests are
+	// refused if it's nil.
+	Listeners *ListenerTable
+	// Accept gob encoded requests of legacy clients, which are answered in
+	// gob.
+	AcceptGob bool
+	codec     codec
+	inMux     bool
 }
 
-func (self *Server) relayTCP(addr string) error {
-	c, err := net.Dial("tcp", addr)
+func (self *Server) resolveDNS(ctx context.Context, data []byte) error {
+	if self.ExchangeDNS == nil {
+		return fmt.Errorf("DNS is not supported")
+	}
+	var req DNSRequest
+	if err := self.codec.decode(data, &req); err != nil {
+		return err
+	}
+	resp, err := self.ExchangeDNS(ctx, req.Msg)
 	if err != nil {
 		return err
 	}
+	return self.P.Pack(iovec.FromSlice(resp))
+}
+
+// forward sends request encoded in pack to relayer hop and switches traffic
+// with it. Hops other than Next are chosen by clients, so they're subject to
+// Permit like destinations are. req is the TCPRequest forwarded if any, which
+// is answered if hop can't be reached, while hop answers it otherwise.
+func (self *Server) forward(ctx context.Context, hop string, pack []byte, target string, req *TCPRequest) error {
+	if self.DialRelayer == nil {
+		err := fmt.Errorf("Forwarding to %s is not supported", hop)
+		self.answerTCP(req, TCP_STATUS_UNREACHABLE, err)
+		return err
+	}
+	if self.Permit != nil && hop != self.Next {
+		if err := self.Permit(ctx, "tcp", hop); err != nil {
+			self.answerTCP(req, TCP_STATUS_NOT_ALLOWED, err)
+			return err
+		}
+	}
+	c, err := self.DialRelayer("tcp", hop)
+	if err != nil {
+		core.RecordDialFailure(err)
+		self.answerTCP(req, dialStatus(err), err)
+		return err
+	}
 	defer c.Close()
-	cp := core.NewPort(c, nil)
-	core.NewSimpleSwitch(cp, self.P).Run()
+	var proto core.Protocol
+	if self.GetRelayProtocol != nil {
+		proto = self.GetRelayProtocol()
+	}
+	cp := core.NewPort(c, proto)
+	if err := cp.Pack(iovec.FromSlice(pack)); err != nil {
+		return err
+	}
+	if self.Switch == nil {
+		self.Switch = core.DefaultSwitchFunc
+	}
+	self.Switch(ctx, self.P, cp, target)
 	return nil
 }
 
-func (self *Server) relayUDP() error {
-	self.P = core.AsSyncPort(self.P)
-	for {
-		var b iovec.IoVec
-		err := self.P.Unpack(&b)
+func (self *Server) relayTCP(ctx context.Context, req *TCPRequest) error {
+	if len(req.Path) != 0 || self.Next != "" {
+		hop := self.Next
+		next := TCPRequest{Addr: req.Addr, Compress: req.Compress, Status: req.Status}
+		if len(req.Path) != 0 {
+			hop = req.Path[0]
+			next.Path = req.Path[1:]
+		}
+		pack, err := self.codec.encodeIntrinsic(RELAY_TCP, &next)
 		if err != nil {
 			return err
 		}
-		go func(b iovec.IoVec) {
-			var msg UDPMessage
-			dec := gob.NewDecoder(&b)
-			if err := dec.Decode(&msg); err != nil {
-				log.Println(err)
-				return
-			}
-			c, err := net.Dial("udp", msg.Addr)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			defer c.Close()
-			_, err = c.Write(msg.Data)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			buf := make([]byte, core.DEFAULT_UDP_BUFFER_SIZE)
-			for {
-				if err := c.SetReadDeadline(time.Now().Add(core.DEFAULT_UDP_TIMEOUT * time.Second)); err != nil {
-					log.Println(err)
-					return
-				}
-				n, err := c.Read(buf)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				msg.Data = buf[:n]
-				var pack bytes.Buffer
-				enc := gob.NewEncoder(&pack)
-				if err := enc.Encode(&msg); err != nil {
-					log.Println(err)
-					return
-				}
-				if err := self.P.Pack(iovec.FromSlice(pack.Bytes())); err != nil {
-					log.Println(err)
-					return
-				}
-			}
-		}(b)
+		return self.forward(ctx, hop, pack, req.Addr, req)
+	}
+	addr := req.Addr
+	if self.Permit != nil {
+		if err := self.Permit(ctx, "tcp", addr); err != nil {
+			self.answerTCP(req, TCP_STATUS_NOT_ALLOWED, err)
+			return err
+		}
+	}
+	if self.Dial == nil {
+		self.Dial = net.Dial
 	}
+	c, err := self.Dial("tcp", addr)
+	if err != nil {
+		core.RecordDialFailure(err)
+		self.answerTCP(req, dialStatus(err), err)
+		return err
+	}
+	defer c.Close()
+	if err := self.answerTCP(req, TCP_STATUS_OK, nil); err != nil {
+		return err
+	}
+	cp := core.NewPort(c, nil)
+	if req.Compress {
+		self.P = newCompressedPort(self.P)
+	}
+	if self.Switch == nil {
+		self.Switch = core.DefaultSwitchFunc
+	}
+	self.Switch(ctx, self.P, cp, addr)
+	return nil
 }
 
-func (self *Server) Run() {
+func (self *Server) Run(ctx context.Context) {
+	start := time.Now()
 	var b iovec.IoVec
 	err := self.P.Unpack(&b)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	dec := gob.NewDecoder(&b)
+	pack := b.Consume()
+	if isGob(pack) {
+		if !self.AcceptGob {
+			log.Println(ErrGobRefused)
+			return
+		}
+		self.codec.gob = true
+	}
 	var i Intrinsic
-	if err := dec.Decode(&i); err != nil {
+	if err := self.codec.decode(pack, &i); err != nil {
 		log.Println(err)
 		return
 	}
+	core.RecordHandshake("intrinsic", start)
+	if self.Next != "" && i.Func != RELAY_TCP {
+		// The request is forwarded as is, so that Next answers in the format
+		// of the client.
+		if err := self.forward(ctx, self.Next, pack, self.Next, nil); err != nil {
+			log.Println(err)
+		}
+		return
+	}
 	switch i.Func {
 	case RELAY_UDP:
-		if err := self.relayUDP(); err != nil {
+		if err := self.relayUDP(ctx); err != nil {
 			log.Println(err)
 			return
 		}
 	case RELAY_TCP:
 		var req TCPRequest
-		dec := gob.NewDecoder(bytes.NewBuffer(i.Data))
-		if err := dec.Decode(&req); err != nil {
+		if err := self.codec.decode(i.Data, &req); err != nil {
+			log.Println(err)
+			return
+		}
+		if err := self.relayTCP(ctx, &req); err != nil {
+			log.Println(err)
+			return
+		}
+	case RESOLVE_DNS:
+		if err := self.resolveDNS(ctx, i.Data); err != nil {
+			log.Println(err)
+			return
+		}
+	case LISTEN_TCP:
+		if err := self.listenTCP(ctx, i.Data); err != nil {
+			log.Println(err)
+			return
+		}
+	case ACCEPT_TCP:
+		if err := self.acceptTCP(ctx, i.Data); err != nil {
+			log.Println(err)
+			return
+		}
+	case HELLO:
+		if err := self.hello(i.Data); err != nil {
 			log.Println(err)
 			return
 		}
-		if err := self.relayTCP(req.Addr); err != nil {
+	case MUX:
+		if err := self.serveMux(ctx); err != nil {
 			log.Println(err)
 			return
 		}
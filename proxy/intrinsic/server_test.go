@@ -0,0 +1,167 @@
+package intrinsic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/acl"
+	"github.com/bzEq/bx/core/iovec"
+)
+
+// serveTCP serves connections accepted on a loopback port with f.
+func serveTCP(t *testing.T, f func(c net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				f(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// relayVia sends a RELAY_TCP request to addr along path through server s
+// and returns the echo of msg.
+func relayVia(t *testing.T, s *Server, addr string, path []string, msg string) (string, error) {
+	pipe := core.MakePipe()
+	s.P = core.NewPort(pipe[1], &core.LengthPrefixedProtocol{})
+	go func() {
+		defer pipe[1].Close()
+		s.Run(context.Background())
+	}()
+	defer pipe[0].Close()
+	pack, err := EncodeIntrinsic(RELAY_TCP, &TCPRequest{Addr: addr, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := core.NewPort(pipe[0], &core.LengthPrefixedProtocol{})
+	if err := p.Pack(iovec.FromSlice(pack)); err != nil {
+		return "", err
+	}
+	if err := p.Pack(iovec.FromSlice([]byte(msg))); err != nil {
+		return "", err
+	}
+	var b iovec.IoVec
+	if err := p.Unpack(&b); err != nil {
+		return "", err
+	}
+	return string(b.Consume()), nil
+}
+
+func TestRelayAlongPath(t *testing.T) {
+	echo := serveTCP(t, func(c net.Conn) { io.Copy(c, c) })
+	end := serveTCP(t, func(c net.Conn) {
+		s := &Server{P: core.NewPort(c, &core.LengthPrefixedProtocol{})}
+		s.Run(context.Background())
+	})
+	_, port, _ := net.SplitHostPort(end)
+	// Only the end relayer is allowed among loopback addresses.
+	a, err := acl.Parse(strings.NewReader(fmt.Sprintf("allow cidr:127.0.0.1 port:%s\n", port)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate := func() *Server {
+		return &Server{
+			Permit:           a.Check,
+			DialRelayer:      a.Dial,
+			GetRelayProtocol: func() core.Protocol { return &core.LengthPrefixedProtocol{} },
+		}
+	}
+	got, err := relayVia(t, intermediate(), echo, []string{end}, "wtf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "wtf" {
+		t.Fatalf("Expected %q, got %q", "wtf", got)
+	}
+	// A hop to a loopback port other than the end relayer is refused
+	// without being dialed.
+	if got, err := relayVia(t, intermediate(), echo, []string{echo}, "wtf"); err == nil {
+		t.Fatalf("Expected hop %s to be refused, got %q", echo, got)
+	}
+}
+
+func TestForwardToNext(t *testing.T) {
+	echo := serveTCP(t, func(c net.Conn) { io.Copy(c, c) })
+	end := serveTCP(t, func(c net.Conn) {
+		s := &Server{P: core.NewPort(c, &core.LengthPrefixedProtocol{})}
+		s.Run(context.Background())
+	})
+	// Next is configured rather than requested, so it's reached even though
+	// default rules deny loopback.
+	a := &acl.ACL{}
+	s := &Server{
+		Permit:           a.Check,
+		DialRelayer:      net.Dial,
+		GetRelayProtocol: func() core.Protocol { return &core.LengthPrefixedProtocol{} },
+		Next:             end,
+	}
+	got, err := relayVia(t, s, echo, nil, "wtf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "wtf" {
+		t.Fatalf("Expected %q, got %q", "wtf", got)
+	}
+}
+
+func TestTCPStatus(t *testing.T) {
+	echo := serveTCP(t, func(c net.Conn) { io.Copy(c, c) })
+	client, _ := helloClient(t, &Server{})
+	c, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("wtf")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "wtf" {
+		t.Fatalf("Expected %q, got %q %v", "wtf", b, err)
+	}
+	// Refusals of the end relayer are reported by Dial.
+	refused := errors.New("Quota exceeded")
+	client, _ = helloClient(t, &Server{Permit: func(context.Context, string, string) error { return refused }})
+	if _, err := client.Dial("tcp", echo); !errors.Is(err, core.ErrNotAllowed) {
+		t.Fatalf("Expected %v, got %v", core.ErrNotAllowed, err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	client, _ = helloClient(t, &Server{})
+	if _, err := client.Dial("tcp", closed); err == nil || errors.Is(err, core.ErrNotAllowed) {
+		t.Fatalf("Expected %s to be unreachable, got %v", closed, err)
+	}
+}
+
+func TestTCPStatusDeniedByACL(t *testing.T) {
+	echo := serveTCP(t, func(c net.Conn) { io.Copy(c, c) })
+	// Default rules deny loopback, whether checked before or while dialing.
+	a := &acl.ACL{}
+	for _, s := range []*Server{{Permit: a.Check}, {Dial: a.Dial}} {
+		client, _ := helloClient(t, s)
+		if _, err := client.Dial("tcp", echo); !errors.Is(err, core.ErrNotAllowed) {
+			t.Fatalf("Expected %v, got %v", core.ErrNotAllowed, err)
+		}
+	}
+}
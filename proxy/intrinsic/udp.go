@@ -0,0 +1,221 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package intrinsic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+)
+
+// Maximum number of UDP sessions of a UDP relay. Datagrams opening more
+// sessions are dropped.
+const MAX_UDP_SESSIONS = 1024
+
+// Number of datagrams queued for a UDP session before they're dropped.
+const UDP_SESSION_QUEUE_SIZE = 64
+
+// udpSession relays datagrams of a route via a single socket, so that
+// replies come from the same source port.
+type udpSession struct {
+	id      core.RouteId
+	addr    string
+	packets chan []byte
+	done    chan struct{}
+	once    sync.Once
+	// Unix nanoseconds of last traffic.
+	active int64
+}
+
+func (self *udpSession) touch() {
+	atomic.StoreInt64(&self.active, time.Now().UnixNano())
+}
+
+func (self *udpSession) idle() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&self.active))) >= core.DEFAULT_UDP_TIMEOUT*time.Second
+}
+
+func (self *udpSession) close() {
+	self.once.Do(func() { close(self.done) })
+}
+
+// send queues b, dropping it if the session is congested.
+func (self *udpSession) send(b []byte) {
+	select {
+	case self.packets <- b:
+	default:
+	}
+}
+
+type udpSessionTable struct {
+	mu       sync.Mutex
+	sessions map[core.RouteId]*udpSession
+}
+
+// get returns the session of id to addr, creating it if needed. A session of
+// id to another addr is replaced. nil is returned if there are too many
+// sessions.
+func (self *udpSessionTable) get(id core.RouteId, addr string) (s *udpSession, created bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.sessions == nil {
+		self.sessions = make(map[core.RouteId]*udpSession)
+	}
+	if s, in := self.sessions[id]; in {
+		if s.addr == addr {
+			return s, false
+		}
+		s.close()
+		delete(self.sessions, id)
+	}
+	if len(self.sessions) >= MAX_UDP_SESSIONS {
+		return nil, false
+	}
+	s = &udpSession{
+		id:      id,
+		addr:    addr,
+		packets: make(chan []byte, UDP_SESSION_QUEUE_SIZE),
+		done:    make(chan struct{}),
+	}
+	s.touch()
+	self.sessions[id] = s
+	return s, true
+}
+
+func (self *udpSessionTable) size() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return len(self.sessions)
+}
+
+func (self *udpSessionTable) remove(s *udpSession) {
+	s.close()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.sessions[s.id] == s {
+		delete(self.sessions, s.id)
+	}
+}
+
+func (self *udpSessionTable) closeAll() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, s := range self.sessions {
+		s.close()
+	}
+	self.sessions = nil
+}
+
+func (self *Server) relayUDP(ctx context.Context) error {
+	if self.Dial == nil {
+		self.Dial = net.Dial
+	}
+	self.P = core.AsSyncPort(self.P)
+	stop := core.CancelPortWhenDone(ctx, self.P)
+	defer stop()
+	var sessions udpSessionTable
+	defer sessions.closeAll()
+	for {
+		var b iovec.IoVec
+		if err := self.P.Unpack(&b); err != nil {
+			return err
+		}
+		var msg UDPMessage
+		if err := self.codec.decode(b.Consume(), &msg); err != nil {
+			log.Println(err)
+			continue
+		}
+		self.dispatchUDP(ctx, &sessions, &msg)
+	}
+}
+
+// dispatchUDP sends msg via the session of its route. Probes are echoed back.
+func (self *Server) dispatchUDP(ctx context.Context, sessions *udpSessionTable, msg *UDPMessage) {
+	if msg.Id == PROBE_ROUTE_ID {
+		pack, err := self.codec.encode(msg)
+		if err == nil {
+			err = self.P.Pack(iovec.FromSlice(pack))
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	s, created := sessions.get(msg.Id, msg.Addr)
+	if s == nil {
+		log.Println(fmt.Errorf("Too many UDP sessions, datagram to %s is dropped", msg.Addr))
+		return
+	}
+	if created {
+		go self.serveUDPSession(ctx, sessions, s)
+	}
+	s.send(msg.Data)
+}
+
+func (self *Server) serveUDPSession(ctx context.Context, sessions *udpSessionTable, s *udpSession) {
+	defer sessions.remove(s)
+	if self.Permit != nil {
+		if err := self.Permit(ctx, "udp", s.addr); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	c, err := self.Dial("udp", s.addr)
+	if err != nil {
+		core.RecordDialFailure(err)
+		log.Println(err)
+		return
+	}
+	defer c.Close()
+	go func() {
+		// The socket is closed once the session is done, stopping reads.
+		defer c.Close()
+		for {
+			select {
+			case b := <-s.packets:
+				s.touch()
+				if _, err := c.Write(b); err != nil {
+					log.Println(err)
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	buf := make([]byte, core.DEFAULT_UDP_BUFFER_SIZE)
+	msg := UDPMessage{Id: s.id, Addr: s.addr}
+	for {
+		if err := c.SetReadDeadline(time.Now().Add(core.DEFAULT_UDP_TIMEOUT * time.Second)); err != nil {
+			return
+		}
+		n, err := c.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && !s.idle() {
+				continue
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, net.ErrClosed) {
+				log.Println(err)
+			}
+			return
+		}
+		s.touch()
+		msg.Data = buf[:n]
+		pack, err := self.codec.encode(&msg)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if err := self.P.Pack(iovec.FromSlice(pack)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package intrinsic
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+)
+
+func TestUDPSessionCap(t *testing.T) {
+	var sessions udpSessionTable
+	defer sessions.closeAll()
+	for i := 0; i < MAX_UDP_SESSIONS; i++ {
+		if s, created := sessions.get(core.RouteId(i+1), "127.0.0.1:53"); s == nil || !created {
+			t.Fatalf("Expected session %d to be created", i+1)
+		}
+	}
+	if s, _ := sessions.get(MAX_UDP_SESSIONS+1, "127.0.0.1:53"); s != nil {
+		t.Fatal("Expected sessions beyond the cap to be refused")
+	}
+	// Existing sessions are still reached.
+	if s, created := sessions.get(1, "127.0.0.1:53"); s == nil || created {
+		t.Fatal("Expected existing session to be returned")
+	}
+}
+
+func TestUDPSessionIdle(t *testing.T) {
+	var sessions udpSessionTable
+	defer sessions.closeAll()
+	s, _ := sessions.get(1, "127.0.0.1:53")
+	if s.idle() {
+		t.Fatal("Expected new session to be active")
+	}
+	atomic.StoreInt64(&s.active, time.Now().Add(-core.DEFAULT_UDP_TIMEOUT*time.Second).UnixNano())
+	if !s.idle() {
+		t.Fatal("Expected session to be idle")
+	}
+	s.touch()
+	if s.idle() {
+		t.Fatal("Expected touched session to be active")
+	}
+}
+
+func TestUDPSessionReplaced(t *testing.T) {
+	var sessions udpSessionTable
+	defer sessions.closeAll()
+	s0, _ := sessions.get(1, "127.0.0.1:53")
+	s1, created := sessions.get(1, "127.0.0.1:54")
+	if !created || s1 == s0 {
+		t.Fatal("Expected session to another address to replace the route's")
+	}
+	select {
+	case <-s0.done:
+	default:
+		t.Fatal("Expected replaced session to be closed")
+	}
+	if n := sessions.size(); n != 1 {
+		t.Fatalf("Expected 1 session, got %d", n)
+	}
+	// Removing the replaced session leaves its replacement intact.
+	sessions.remove(s0)
+	if s, created := sessions.get(1, "127.0.0.1:54"); s != s1 || created {
+		t.Fatal("Expected replacement to survive removal of the replaced session")
+	}
+}
+
+func TestUDPRepliesFromSameSourcePort(t *testing.T) {
+	// The echo replies the source address of each datagram.
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			_, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo([]byte(addr.String()), addr)
+		}
+	}()
+	pipe := core.MakePipe()
+	defer pipe[0].Close()
+	s := &Server{P: core.NewPort(pipe[1], &core.LengthPrefixedProtocol{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.relayUDP(ctx)
+	p := core.NewPort(pipe[0], &core.LengthPrefixedProtocol{})
+	var srcs []string
+	for i := 0; i < 3; i++ {
+		pack, err := codec{}.encode(&UDPMessage{Id: 1, Addr: echo.LocalAddr().String(), Data: []byte("wtf")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Pack(iovec.FromSlice(pack)); err != nil {
+			t.Fatal(err)
+		}
+		var b iovec.IoVec
+		if err := p.Unpack(&b); err != nil {
+			t.Fatal(err)
+		}
+		var msg UDPMessage
+		if err := (codec{}).decode(b.Consume(), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Id != 1 || msg.Addr != echo.LocalAddr().String() {
+			t.Fatalf("Unexpected reply: %v", msg)
+		}
+		srcs = append(srcs, string(msg.Data))
+	}
+	for _, src := range srcs[1:] {
+		if src != srcs[0] {
+			t.Fatalf("Expected datagrams of a route from one source port, got %v", srcs)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package intrinsic
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+	"github.com/bzEq/bx/core/metrics"
+)
+
+// Seconds to wait before reconnecting the UDP router. It doubles after each
+// failure until UDP_ROUTER_MAX_BACKOFF.
+const UDP_ROUTER_MIN_BACKOFF = 1
+const UDP_ROUTER_MAX_BACKOFF = 60
+
+// Seconds between probes of the UDP router's connection, if the remote side
+// answers them. The connection is replaced once UDP_ROUTER_HEARTBEAT_ATTEMPTS
+// probes in a row are unanswered, since a connection silently dropped on the
+// path can't be told from one without traffic otherwise.
+const UDP_ROUTER_HEARTBEAT_INTERVAL = 15
+const UDP_ROUTER_HEARTBEAT_ATTEMPTS = 3
+
+var udpRouterReconnects = metrics.Default.Counter("bx_udp_router_reconnects_total",
+	"Number of times UDP routers reconnected")
+
+// UDPRouterHealth reports the connection UDP routes are carried over.
+type UDPRouterHealth struct {
+	Connected bool
+	// "tcp", "datagram" or "quic".
+	Transport  string
+	Reconnects uint64
+	LastError  string
+	// When the router got connected or lost its connection.
+	Since time.Time
+}
+
+// udpRouterConn is a connection UDP routes are carried over.
+type udpRouterConn struct {
+	p         *core.SyncPort
+	c         io.Closer
+	transport string
+	// The remote side answers probes, so that heartbeats check the connection.
+	probed bool
+}
+
+// udpRouterPort is the port of the UDP router, reconnecting with backoff once
+// its connection is lost. Datagrams packed while it's disconnected are
+// dropped rather than failing their routes, so routes outlive connections.
+// The remote side binds routes again as their datagrams arrive on the new
+// connection, since each UDPMessage carries its route and address.
+type udpRouterPort struct {
+	dial       func() (*udpRouterConn, error)
+	heartbeat  time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	probe      []byte
+	mu         sync.Mutex
+	cond       *sync.Cond
+	p          *core.SyncPort
+	c          io.Closer
+	gen        uint64
+	closed     bool
+	health     UDPRouterHealth
+	// Unix nanoseconds of last message received.
+	heard int64
+}
+
+// newUDPRouterPort returns the port over the connection dial returns, probed
+// every heartbeat if the remote side answers probes.
+func newUDPRouterPort(dial func() (*udpRouterConn, error), heartbeat time.Duration) (*udpRouterPort, error) {
+	probe, err := codec{}.encode(&UDPMessage{Id: PROBE_ROUTE_ID})
+	if err != nil {
+		return nil, err
+	}
+	rc, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	self := &udpRouterPort{
+		dial:       dial,
+		heartbeat:  heartbeat,
+		minBackoff: UDP_ROUTER_MIN_BACKOFF * time.Second,
+		maxBackoff: UDP_ROUTER_MAX_BACKOFF * time.Second,
+		probe:      probe,
+		p:          rc.p,
+		c:          rc.c,
+		health: UDPRouterHealth{
+			Connected: true,
+			Transport: rc.transport,
+			Since:     time.Now(),
+		},
+	}
+	self.cond = sync.NewCond(&self.mu)
+	self.hear()
+	if rc.probed {
+		go self.beat(self.gen, rc.p)
+	}
+	return self, nil
+}
+
+func (self *udpRouterPort) hear() {
+	atomic.StoreInt64(&self.heard, time.Now().UnixNano())
+}
+
+// beat probes connection gen over p until it's dropped, failing it once
+// probes are unanswered for UDP_ROUTER_HEARTBEAT_ATTEMPTS heartbeats.
+func (self *udpRouterPort) beat(gen uint64, p *core.SyncPort) {
+	t := time.NewTicker(self.heartbeat)
+	defer t.Stop()
+	for range t.C {
+		if cur, curGen := self.current(); cur == nil || curGen != gen || self.isClosed() {
+			return
+		}
+		silent := time.Since(time.Unix(0, atomic.LoadInt64(&self.heard)))
+		if silent >= UDP_ROUTER_HEARTBEAT_ATTEMPTS*self.heartbeat {
+			self.fail(gen, fmt.Errorf("Probes are unanswered for %s", silent.Round(time.Millisecond)))
+			return
+		}
+		if err := p.Pack(iovec.FromSlice(append([]byte(nil), self.probe...))); err != nil {
+			self.fail(gen, err)
+			return
+		}
+	}
+}
+
+// current returns the port of the live connection, nil if it's disconnected.
+func (self *udpRouterPort) current() (*core.SyncPort, uint64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.p, self.gen
+}
+
+// fail drops connection gen due to err and reconnects.
+func (self *udpRouterPort) fail(gen uint64, err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed || gen != self.gen || self.p == nil {
+		return
+	}
+	log.Println(fmt.Errorf("UDP router lost its connection: %w", err))
+	self.c.Close()
+	self.p, self.c = nil, nil
+	self.health.Connected = false
+	self.health.LastError = err.Error()
+	self.health.Since = time.Now()
+	go self.reconnect()
+}
+
+func (self *udpRouterPort) reconnect() {
+	backoff := self.minBackoff
+	for {
+		time.Sleep(backoff)
+		if self.isClosed() {
+			return
+		}
+		rc, err := self.dial()
+		if err != nil {
+			log.Println(fmt.Errorf("Failed to reconnect UDP router: %w", err))
+			self.mu.Lock()
+			self.health.LastError = err.Error()
+			self.mu.Unlock()
+			if backoff *= 2; backoff > self.maxBackoff {
+				backoff = self.maxBackoff
+			}
+			continue
+		}
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		if self.closed {
+			rc.c.Close()
+			return
+		}
+		self.p, self.c = rc.p, rc.c
+		self.gen += 1
+		self.hear()
+		if rc.probed {
+			go self.beat(self.gen, rc.p)
+		}
+		self.health.Connected = true
+		self.health.Transport = rc.transport
+		self.health.Reconnects += 1
+		self.health.Since = time.Now()
+		udpRouterReconnects.Inc()
+		log.Printf("UDP router reconnected over %s\n", rc.transport)
+		self.cond.Broadcast()
+		return
+	}
+}
+
+func (self *udpRouterPort) isClosed() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.closed
+}
+
+func (self *udpRouterPort) Pack(b *iovec.IoVec) error {
+	p, gen := self.current()
+	if p == nil {
+		if self.isClosed() {
+			return net.ErrClosed
+		}
+		return nil
+	}
+	if err := p.Pack(b); err != nil {
+		self.fail(gen, err)
+	}
+	return nil
+}
+
+// Unpack waits for a connection if it's disconnected. It fails only once the
+// port is closed. Answers of probes are consumed.
+func (self *udpRouterPort) Unpack(b *iovec.IoVec) error {
+	for {
+		self.mu.Lock()
+		for self.p == nil && !self.closed {
+			self.cond.Wait()
+		}
+		if self.closed {
+			self.mu.Unlock()
+			return net.ErrClosed
+		}
+		p, gen := self.p, self.gen
+		self.mu.Unlock()
+		var r iovec.IoVec
+		if err := p.Unpack(&r); err != nil {
+			self.fail(gen, err)
+			continue
+		}
+		self.hear()
+		data := r.Consume()
+		if bytes.Equal(data, self.probe) {
+			continue
+		}
+		b.Take(data)
+		return nil
+	}
+}
+
+func (self *udpRouterPort) CloseRead() error {
+	return nil
+}
+
+func (self *udpRouterPort) CloseWrite() error {
+	return nil
+}
+
+func (self *udpRouterPort) Close() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.closed = true
+	self.cond.Broadcast()
+	if self.c == nil {
+		return nil
+	}
+	return self.c.Close()
+}
+
+func (self *udpRouterPort) Health() UDPRouterHealth {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.health
+}
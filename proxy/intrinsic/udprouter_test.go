@@ -0,0 +1,210 @@
+package intrinsic
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+)
+
+// pipeDial returns a dial function of connections over pipes, whose remote
+// sides echo what they get if answer is true.
+func pipeDial(t *testing.T, answer bool) (func() (*udpRouterConn, error), *int32) {
+	var dials int32
+	return func() (*udpRouterConn, error) {
+		atomic.AddInt32(&dials, 1)
+		pipe := core.MakePipe()
+		t.Cleanup(func() { pipe[1].Close() })
+		go func() {
+			remote := core.NewPort(pipe[1], &core.LengthPrefixedProtocol{})
+			for {
+				var b iovec.IoVec
+				if err := remote.Unpack(&b); err != nil {
+					return
+				}
+				if answer {
+					remote.Pack(&b)
+				}
+			}
+		}()
+		return &udpRouterConn{
+			p:         core.NewSyncPort(pipe[0], &core.LengthPrefixedProtocol{}),
+			c:         pipe[0],
+			transport: "tcp",
+			probed:    true,
+		}, nil
+	}, &dials
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if f() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+// drain unpacks rp until it's closed.
+func drain(rp *udpRouterPort) {
+	for {
+		var b iovec.IoVec
+		if err := rp.Unpack(&b); err != nil {
+			return
+		}
+	}
+}
+
+func TestUDPRouterFailGeneration(t *testing.T) {
+	dial, dials := pipeDial(t, false)
+	rp, err := newUDPRouterPort(dial, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rp.Close()
+	rp.minBackoff = 10 * time.Millisecond
+	// Failures of other connections are ignored.
+	rp.fail(1, net.ErrClosed)
+	if h := rp.Health(); !h.Connected || h.Transport != "tcp" {
+		t.Fatalf("Unexpected health: %+v", h)
+	}
+	rp.fail(0, net.ErrClosed)
+	if h := rp.Health(); h.Connected || h.LastError != net.ErrClosed.Error() {
+		t.Fatalf("Unexpected health: %+v", h)
+	}
+	waitFor(t, "reconnection", func() bool { return rp.Health().Connected })
+	if h := rp.Health(); h.Reconnects != 1 || atomic.LoadInt32(dials) != 2 {
+		t.Fatalf("Expected 1 reconnection, got %+v after %d dials", h, atomic.LoadInt32(dials))
+	}
+	// The failure of the dropped connection is reported late.
+	rp.fail(0, net.ErrClosed)
+	if _, gen := rp.current(); gen != 1 || !rp.Health().Connected {
+		t.Fatal("Expected the late failure to be ignored")
+	}
+}
+
+func TestUDPRouterBackoff(t *testing.T) {
+	succeed, _ := pipeDial(t, false)
+	var mu sync.Mutex
+	var attempts []time.Time
+	dial := func() (*udpRouterConn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, time.Now())
+		// The first dial connects, the next 4 fail.
+		if n := len(attempts); n == 1 || n > 5 {
+			return succeed()
+		}
+		return nil, net.ErrClosed
+	}
+	rp, err := newUDPRouterPort(dial, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rp.Close()
+	rp.minBackoff, rp.maxBackoff = 20*time.Millisecond, 80*time.Millisecond
+	rp.fail(0, net.ErrClosed)
+	waitFor(t, "reconnection", func() bool { return rp.Health().Connected })
+	mu.Lock()
+	defer mu.Unlock()
+	// Backoffs before each reconnection attempt double until the maximum.
+	for i, min := range []time.Duration{20, 40, 80, 80} {
+		if d := attempts[i+2].Sub(attempts[i+1]); d < min*time.Millisecond {
+			t.Fatalf("Expected backoff #%d of at least %dms, got %s", i+1, min, d)
+		}
+	}
+	if d := attempts[5].Sub(attempts[4]); d > 500*time.Millisecond {
+		t.Fatalf("Expected backoff capped, got %s", d)
+	}
+}
+
+func TestUDPRouterHeartbeat(t *testing.T) {
+	dial, dials := pipeDial(t, true)
+	rp, err := newUDPRouterPort(dial, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go drain(rp)
+	time.Sleep(200 * time.Millisecond)
+	if h := rp.Health(); !h.Connected || h.Reconnects != 0 {
+		t.Fatalf("Expected answered probes to keep the connection, got %+v", h)
+	}
+	rp.Close()
+	// A connection taking probes without answering is replaced.
+	dial, dials = pipeDial(t, false)
+	rp, err = newUDPRouterPort(dial, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rp.Close()
+	rp.minBackoff = 10 * time.Millisecond
+	go drain(rp)
+	waitFor(t, "reconnection", func() bool { return atomic.LoadInt32(dials) >= 2 })
+	if h := rp.Health(); !strings.Contains(h.LastError, "unanswered") {
+		t.Fatalf("Expected unanswered probes reported, got %+v", h)
+	}
+}
+
+func TestUDPRoutesResume(t *testing.T) {
+	echo := serveUDPEcho(t)
+	next := serveTCP(t, func(c net.Conn) {
+		s := &Server{
+			P:    core.NewPort(c, &core.LengthPrefixedProtocol{}),
+			Dial: net.Dial,
+		}
+		s.Run(context.Background())
+	})
+	var mu sync.Mutex
+	var conns []net.Conn
+	client := &ClientContext{
+		RelayUDP:    true,
+		Next:        next,
+		GetProtocol: func() core.Protocol { return &core.LengthPrefixedProtocol{} },
+		InternalDial: func(network, addr string) (net.Conn, error) {
+			c, err := net.Dial(network, addr)
+			if err == nil {
+				mu.Lock()
+				conns = append(conns, c)
+				mu.Unlock()
+			}
+			return c, err
+		},
+	}
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	c, err := client.Dial("udp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	roundTrip := func(msg string) bool {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := c.Read(buf)
+		return err == nil && string(buf[:n]) == msg
+	}
+	waitFor(t, "the route", func() bool { return roundTrip("wtf") })
+	// Kill every connection to Next, including the router's.
+	mu.Lock()
+	for _, c := range conns {
+		c.Close()
+	}
+	mu.Unlock()
+	waitFor(t, "the route to resume", func() bool { return roundTrip("wtfwtf") })
+	if h := client.UDPRouterHealth(); !h.Connected || h.Reconnects == 0 {
+		t.Fatalf("Expected the router reconnected, got %+v", h)
+	}
+}
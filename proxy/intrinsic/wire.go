@@ -0,0 +1,306 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package intrinsic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"github.com/bzEq/bx/core"
+)
+
+// Messages in wire format begin with a zero byte and the version, followed by
+// fields. A field is its tag and the length of its value as uvarints, then the
+// value. Integers are uvarints in values. Fields of unknown tags are skipped,
+// so that fields can be added without bumping the version. Gob encoded
+// messages never begin with a zero byte, which tells them apart. The version
+// only changes with the encoding itself, which is never negotiated. Peers
+// agree on features and protocol versions with Hello instead.
+const WIRE_VERSION = 1
+
+var ErrGobRefused = errors.New("Gob encoded message is refused, legacy peers need gob compatibility enabled")
+
+// Message is implemented by messages of the intrinsic protocol.
+type Message interface {
+	encodeWire(*wireEncoder)
+	decodeWire(wireFields) error
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+type wireEncoder struct {
+	b []byte
+}
+
+func newWireEncoder() *wireEncoder {
+	return &wireEncoder{b: []byte{0, WIRE_VERSION}}
+}
+
+func (self *wireEncoder) putBytes(tag uint64, v []byte) {
+	self.b = appendUvarint(self.b, tag)
+	self.b = appendUvarint(self.b, uint64(len(v)))
+	self.b = append(self.b, v...)
+}
+
+func (self *wireEncoder) putString(tag uint64, v string) {
+	self.putBytes(tag, []byte(v))
+}
+
+func (self *wireEncoder) putUint(tag uint64, v uint64) {
+	self.putBytes(tag, appendUvarint(nil, v))
+}
+
+type wireField struct {
+	tag   uint64
+	value []byte
+}
+
+type wireFields []wireField
+
+func parseWire(b []byte) (wireFields, error) {
+	if len(b) < 2 || b[0] != 0 {
+		return nil, fmt.Errorf("Malformed message")
+	}
+	if b[1] != WIRE_VERSION {
+		return nil, fmt.Errorf("Unsupported wire version %d, expected %d", b[1], WIRE_VERSION)
+	}
+	b = b[2:]
+	var l wireFields
+	for len(b) != 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("Malformed tag of field")
+		}
+		b = b[n:]
+		size, n := binary.Uvarint(b)
+		if n <= 0 || size > uint64(len(b)-n) {
+			return nil, fmt.Errorf("Malformed length of field #%d", tag)
+		}
+		b = b[n:]
+		l = append(l, wireField{tag: tag, value: b[:size]})
+		b = b[size:]
+	}
+	return l, nil
+}
+
+// each calls f with values of tag in order.
+func (self wireFields) each(tag uint64, f func([]byte) error) error {
+	for _, field := range self {
+		if field.tag == tag {
+			if err := f(field.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self wireFields) getBytes(tag uint64, v *[]byte) error {
+	return self.each(tag, func(b []byte) error {
+		*v = b
+		return nil
+	})
+}
+
+func (self wireFields) getString(tag uint64, v *string) error {
+	return self.each(tag, func(b []byte) error {
+		*v = string(b)
+		return nil
+	})
+}
+
+func (self wireFields) getUint(tag uint64, v *uint64) error {
+	return self.each(tag, func(b []byte) error {
+		x, n := binary.Uvarint(b)
+		if n != len(b) {
+			return fmt.Errorf("Malformed integer of field #%d", tag)
+		}
+		*v = x
+		return nil
+	})
+}
+
+// codec encodes messages in wire format, or in gob for legacy peers.
+type codec struct {
+	gob bool
+}
+
+func isGob(b []byte) bool {
+	return len(b) != 0 && b[0] != 0
+}
+
+func (self codec) encode(v Message) ([]byte, error) {
+	if self.gob {
+		buf := &bytes.Buffer{}
+		if err := gob.NewEncoder(buf).Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	enc := newWireEncoder()
+	v.encodeWire(enc)
+	return enc.b, nil
+}
+
+func (self codec) decode(b []byte, v Message) error {
+	if isGob(b) {
+		if !self.gob {
+			return ErrGobRefused
+		}
+		return gob.NewDecoder(bytes.NewBuffer(b)).Decode(v)
+	}
+	fields, err := parseWire(b)
+	if err != nil {
+		return err
+	}
+	return v.decodeWire(fields)
+}
+
+func (self codec) encodeIntrinsic(f byte, req Message) ([]byte, error) {
+	i := Intrinsic{Func: f}
+	if req != nil {
+		data, err := self.encode(req)
+		if err != nil {
+			return nil, err
+		}
+		i.Data = data
+	}
+	return self.encode(&i)
+}
+
+func (self *Intrinsic) encodeWire(enc *wireEncoder) {
+	enc.putUint(1, uint64(self.Func))
+	enc.putBytes(2, self.Data)
+}
+
+func (self *Intrinsic) decodeWire(fields wireFields) error {
+	var f uint64
+	if err := fields.getUint(1, &f); err != nil {
+		return err
+	}
+	if f > 0xff {
+		return fmt.Errorf("Invalid function: %d", f)
+	}
+	self.Func = byte(f)
+	return fields.getBytes(2, &self.Data)
+}
+
+func (self *TCPRequest) encodeWire(enc *wireEncoder) {
+	enc.putString(1, self.Addr)
+	for _, hop := range self.Path {
+		enc.putString(2, hop)
+	}
+	if self.Compress {
+		enc.putUint(3, 1)
+	}
+	if self.Status {
+		enc.putUint(4, 1)
+	}
+}
+
+func (self *TCPRequest) decodeWire(fields wireFields) error {
+	if err := fields.getString(1, &self.Addr); err != nil {
+		return err
+	}
+	if err := fields.each(2, func(b []byte) error {
+		self.Path = append(self.Path, string(b))
+		return nil
+	}); err != nil {
+		return err
+	}
+	var compress uint64
+	if err := fields.getUint(3, &compress); err != nil {
+		return err
+	}
+	self.Compress = compress != 0
+	var status uint64
+	if err := fields.getUint(4, &status); err != nil {
+		return err
+	}
+	self.Status = status != 0
+	return nil
+}
+
+func (self *TCPStatus) encodeWire(enc *wireEncoder) {
+	enc.putUint(1, self.Code)
+	enc.putString(2, self.Err)
+}
+
+func (self *TCPStatus) decodeWire(fields wireFields) error {
+	if err := fields.getUint(1, &self.Code); err != nil {
+		return err
+	}
+	return fields.getString(2, &self.Err)
+}
+
+func (self *DNSRequest) encodeWire(enc *wireEncoder) {
+	enc.putBytes(1, self.Msg)
+}
+
+func (self *DNSRequest) decodeWire(fields wireFields) error {
+	return fields.getBytes(1, &self.Msg)
+}
+
+func (self *UDPMessage) encodeWire(enc *wireEncoder) {
+	enc.putUint(1, uint64(self.Id))
+	enc.putString(2, self.Addr)
+	enc.putBytes(3, self.Data)
+}
+
+func (self *UDPMessage) decodeWire(fields wireFields) error {
+	var id uint64
+	if err := fields.getUint(1, &id); err != nil {
+		return err
+	}
+	self.Id = core.RouteId(id)
+	if err := fields.getString(2, &self.Addr); err != nil {
+		return err
+	}
+	return fields.getBytes(3, &self.Data)
+}
+
+func (self *ListenRequest) encodeWire(enc *wireEncoder) {
+	enc.putString(1, self.Addr)
+}
+
+func (self *ListenRequest) decodeWire(fields wireFields) error {
+	return fields.getString(1, &self.Addr)
+}
+
+func (self *ListenResponse) encodeWire(enc *wireEncoder) {
+	enc.putString(1, self.Addr)
+	enc.putString(2, self.Err)
+}
+
+func (self *ListenResponse) decodeWire(fields wireFields) error {
+	if err := fields.getString(1, &self.Addr); err != nil {
+		return err
+	}
+	return fields.getString(2, &self.Err)
+}
+
+func (self *RemoteConn) encodeWire(enc *wireEncoder) {
+	enc.putUint(1, self.Id)
+	enc.putString(2, self.From)
+}
+
+func (self *RemoteConn) decodeWire(fields wireFields) error {
+	if err := fields.getUint(1, &self.Id); err != nil {
+		return err
+	}
+	return fields.getString(2, &self.From)
+}
+
+func (self *AcceptRequest) encodeWire(enc *wireEncoder) {
+	enc.putUint(1, self.Id)
+}
+
+func (self *AcceptRequest) decodeWire(fields wireFields) error {
+	return fields.getUint(1, &self.Id)
+}
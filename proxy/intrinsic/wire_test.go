@@ -0,0 +1,108 @@
+package intrinsic
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestWireRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		in, out Message
+	}{
+		{&Intrinsic{Func: RELAY_TCP, Data: []byte("wtf")}, &Intrinsic{}},
+		{&TCPRequest{Addr: "example.com:443", Path: []string{"a:1", "b:2"}, Compress: true}, &TCPRequest{}},
+		{&DNSRequest{Msg: []byte("wtf")}, &DNSRequest{}},
+		{&UDPMessage{Id: 42, Addr: "1.1.1.1:53", Data: []byte("wtf")}, &UDPMessage{}},
+		{&ListenRequest{Addr: ":8080"}, &ListenRequest{}},
+		{&ListenResponse{Addr: "0.0.0.0:8080", Err: "wtf"}, &ListenResponse{}},
+		{&RemoteConn{Id: 42, From: "1.2.3.4:5678"}, &RemoteConn{}},
+		{&AcceptRequest{Id: 1 << 40}, &AcceptRequest{}},
+		{&Hello{Version: 3, MinVersion: 2, Features: FEATURE_UDP | FEATURE_MUX}, &Hello{}},
+	} {
+		b, err := codec{}.encode(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (codec{}).decode(b, tc.out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tc.in, tc.out) {
+			t.Fatalf("Expected %+v, got %+v", tc.in, tc.out)
+		}
+	}
+}
+
+func TestWireSkipsUnknownTags(t *testing.T) {
+	enc := newWireEncoder()
+	enc.putString(99, "from the future")
+	enc.putString(1, "wtf:1")
+	enc.putUint(100, 42)
+	var req ListenRequest
+	if err := (codec{}).decode(enc.b, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Addr != "wtf:1" {
+		t.Fatalf("Expected %q, got %q", "wtf:1", req.Addr)
+	}
+}
+
+func TestParseWireMalformed(t *testing.T) {
+	full, err := codec{}.encode(&UDPMessage{Id: 1, Addr: "1.1.1.1:53", Data: []byte("wtf")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range [][]byte{
+		nil,
+		{0},
+		// Unsupported version.
+		{0, WIRE_VERSION + 1},
+		// Truncated tag.
+		{0, WIRE_VERSION, 0x80},
+		// Missing length.
+		{0, WIRE_VERSION, 1},
+		// Length beyond the message.
+		{0, WIRE_VERSION, 1, 100, 'w'},
+		// Length overflowing int.
+		{0, WIRE_VERSION, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		// Truncated message.
+		full[:len(full)-1],
+	} {
+		if _, err := parseWire(b); err == nil {
+			t.Fatalf("Expected %v to be malformed", b)
+		}
+	}
+	if _, err := parseWire(full); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGobDetection(t *testing.T) {
+	legacy := codec{gob: true}
+	in := &TCPRequest{Addr: "example.com:443"}
+	g, err := legacy.encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := codec{}.encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGob(g) || isGob(w) {
+		t.Fatal("Gob and wire format are mistaken for each other")
+	}
+	var out TCPRequest
+	if err := (codec{}).decode(g, &out); !errors.Is(err, ErrGobRefused) {
+		t.Fatalf("Expected ErrGobRefused, got %v", err)
+	}
+	// Gob compatibility accepts both.
+	for _, b := range [][]byte{g, w} {
+		var out TCPRequest
+		if err := legacy.decode(b, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Addr != in.Addr {
+			t.Fatalf("Expected %q, got %q", in.Addr, out.Addr)
+		}
+	}
+}
@@ -3,13 +3,18 @@
 package socks5
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"syscall"
 	"time"
 
 	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/acl"
+	"github.com/bzEq/bx/core/iovec"
 )
 
 const VER = 5
@@ -44,6 +49,11 @@ type Server struct {
 	UDPAddr *net.UDPAddr
 	// Support custom dial.
 	Dial func(string, string) (net.Conn, error)
+	// Support custom switch.
+	Switch core.SwitchFunc
+	// If not nil, Permit is consulted before dialing and the request is
+	// refused if it returns an error.
+	Permit func(ctx context.Context, network, addr string) error
 }
 
 type Request struct {
@@ -157,34 +167,62 @@ func (self *Server) sendReply(w net.Conn, r Reply) (err error) {
 	return
 }
 
-func (self *Server) handleConnect(c net.Conn, req Request) error {
-	// Send reply concurrently to save 1-RTT.
-	runBar := make(chan struct{})
-	go func() {
-		defer close(runBar)
-		reply := Reply{
-			VER:      req.VER,
-			REP:      REP_SUCC,
-			ATYP:     1,
-			BND_ADDR: make([]byte, net.IPv4len),
-		}
-		self.sendReply(c, reply)
-	}()
+func (self *Server) handleConnect(ctx context.Context, c net.Conn, req Request) error {
 	addr := self.getDialAddress(req)
+	if self.Permit != nil {
+		if err := self.Permit(ctx, "tcp", addr); err != nil {
+			reply := Reply{
+				VER:      req.VER,
+				REP:      REP_CONNECTION_NOT_ALLOWED,
+				ATYP:     1,
+				BND_ADDR: make([]byte, net.IPv4len),
+			}
+			self.sendReply(c, reply)
+			return err
+		}
+	}
 	if self.Dial == nil {
 		self.Dial = net.Dial
 	}
+	// Reply after dialing so that refusals of the remote side reach the client.
 	remoteConn, err := self.Dial("tcp", addr)
+	reply := Reply{
+		VER:      req.VER,
+		REP:      replyOf(err),
+		ATYP:     1,
+		BND_ADDR: make([]byte, net.IPv4len),
+	}
 	if err != nil {
+		core.RecordDialFailure(err)
+		self.sendReply(c, reply)
 		return err
 	}
 	defer remoteConn.Close()
-	<-runBar
-	core.RunSimpleSwitch(core.NewPort(c, nil), core.NewPort(remoteConn, nil))
+	if err := self.sendReply(c, reply); err != nil {
+		return err
+	}
+	if self.Switch == nil {
+		self.Switch = core.DefaultSwitchFunc
+	}
+	self.Switch(ctx, core.NewPort(c, nil), core.NewPort(remoteConn, nil), addr)
 	return nil
 }
 
-func (self *Server) Serve(c net.Conn) error {
+func replyOf(err error) byte {
+	switch {
+	case err == nil:
+		return REP_SUCC
+	case errors.Is(err, core.ErrNotAllowed), errors.Is(err, acl.ErrDenied):
+		return REP_CONNECTION_NOT_ALLOWED
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return REP_CONNECTION_REFUSED
+	default:
+		return REP_HOST_UNREACHABLE
+	}
+}
+
+func (self *Server) Serve(ctx context.Context, c net.Conn) error {
+	start := time.Now()
 	if err := self.exchangeMetadata(c); err != nil {
 		return err
 	}
@@ -192,17 +230,18 @@ func (self *Server) Serve(c net.Conn) error {
 	if err != nil {
 		return err
 	}
+	core.RecordHandshake("socks5", start)
 	if req.VER != VER {
 		return fmt.Errorf("Unsupported SOCKS version: %v", req.VER)
 	}
 	switch req.CMD {
 	case CMD_CONNECT:
-		return self.handleConnect(c, req)
+		return self.handleConnect(ctx, c, req)
 	case CMD_UDP_ASSOCIATE:
 		if self.UDPAddr == nil {
 			return fmt.Errorf("UDP server is not initialized")
 		}
-		return self.handleUDPAssociate(c, req)
+		return self.handleUDPAssociate(ctx, c, req)
 	default:
 		reply := Reply{
 			VER:      req.VER,
@@ -215,7 +254,7 @@ func (self *Server) Serve(c net.Conn) error {
 	}
 }
 
-func (self *Server) handleUDPAssociate(c net.Conn, req Request) error {
+func (self *Server) handleUDPAssociate(ctx context.Context, c net.Conn, req Request) error {
 	reply := Reply{
 		VER:      req.VER,
 		REP:      REP_SUCC,
@@ -230,12 +269,17 @@ func (self *Server) handleUDPAssociate(c net.Conn, req Request) error {
 	if err := self.sendReply(c, reply); err != nil {
 		return err
 	}
-	c.SetReadDeadline(time.Now().Add(600 * time.Second))
-	_, err := c.Read(make([]byte, 8))
-	return err
+	// The association terminates when the TCP connection closes.
+	p := core.NewPortWithTimeout(c, nil, 600)
+	stop := core.CancelPortWhenDone(ctx, p)
+	defer stop()
+	var b iovec.IoVec
+	return p.Unpack(&b)
 }
 
-func (self *Server) ServeUDP(c *net.UDPConn, raddr *net.UDPAddr, buf []byte) error {
+// ServeUDP relays the datagram buf from raddr and its replies. ctx is the
+// context of raddr, which Permit is consulted in.
+func (self *Server) ServeUDP(ctx context.Context, c *net.UDPConn, raddr *net.UDPAddr, buf []byte) error {
 	if len(buf) < 6 {
 		return fmt.Errorf("Invalid length of udp request")
 	}
@@ -265,8 +309,15 @@ func (self *Server) ServeUDP(c *net.UDPConn, raddr *net.UDPAddr, buf []byte) err
 	if self.Dial == nil {
 		self.Dial = net.Dial
 	}
-	remoteConn, err := self.Dial("udp", net.JoinHostPort(addr, fmt.Sprintf("%d", port)))
+	raddrStr := net.JoinHostPort(addr, fmt.Sprintf("%d", port))
+	if self.Permit != nil {
+		if err := self.Permit(ctx, "udp", raddrStr); err != nil {
+			return err
+		}
+	}
+	remoteConn, err := self.Dial("udp", raddrStr)
 	if err != nil {
+		core.RecordDialFailure(err)
 		return err
 	}
 	defer remoteConn.Close()
@@ -0,0 +1,199 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/proxy/intrinsic"
+)
+
+var debugLogging uint32
+
+// SetDebugLogging turns logging on or off at runtime.
+func SetDebugLogging(on bool) {
+	if on {
+		atomic.StoreUint32(&debugLogging, 1)
+		log.SetOutput(os.Stderr)
+	} else {
+		atomic.StoreUint32(&debugLogging, 0)
+		log.SetOutput(ioutil.Discard)
+	}
+}
+
+func DebugLogging() bool {
+	return atomic.LoadUint32(&debugLogging) != 0
+}
+
+// Inspectable is implemented by relayers which can be inspected and
+// controlled via AdminServer.
+type Inspectable interface {
+	Stats() Stats
+	Sessions() []SessionInfo
+	KillSession(id uint64) error
+	UDPRoutes() map[core.RouteId]string
+	// Health of the connection UDP is relayed over, nil if there's none.
+	UDPRouter() *intrinsic.UDPRouterHealth
+	Upstreams() []UpstreamInfo
+}
+
+// AdminServer serves an HTTP/JSON API to inspect relayers. Relayers are
+// keyed by their names, usually their listen addresses.
+//
+//	GET  /stats
+//	GET  /sessions
+//	POST /sessions/kill?id=<session id>
+//	GET  /udp_routes
+//	GET  /udp_router
+//	GET  /upstreams
+//	GET  /log
+//	POST /log?debug=<true|false>
+//
+// Requests must carry header ADMIN_TOKEN_HEADER with Token, which browsers
+// don't send in cross-site requests, so that web pages can't drive the API.
+type AdminServer struct {
+	Relayers map[string]Inspectable
+	// Requests carrying the header with any value are served if it's empty.
+	Token string
+	mux   *http.ServeMux
+}
+
+const ADMIN_TOKEN_HEADER = "X-Bx-Admin-Token"
+
+func (self *AdminServer) init() {
+	self.mux = http.NewServeMux()
+	self.mux.HandleFunc("/stats", self.handleStats)
+	self.mux.HandleFunc("/sessions", self.handleSessions)
+	self.mux.HandleFunc("/sessions/kill", self.handleKill)
+	self.mux.HandleFunc("/udp_routes", self.handleUDPRoutes)
+	self.mux.HandleFunc("/udp_router", self.handleUDPRouter)
+	self.mux.HandleFunc("/upstreams", self.handleUpstreams)
+	self.mux.HandleFunc("/log", self.handleLog)
+}
+
+func (self *AdminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if self.mux == nil {
+		self.init()
+	}
+	token, in := req.Header[http.CanonicalHeaderKey(ADMIN_TOKEN_HEADER)]
+	if !in || (self.Token != "" && (len(token) != 1 || subtle.ConstantTimeCompare([]byte(token[0]), []byte(self.Token)) != 1)) {
+		http.Error(w, "Admin token is required", http.StatusForbidden)
+		return
+	}
+	self.mux.ServeHTTP(w, req)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func (self *AdminServer) handleStats(w http.ResponseWriter, req *http.Request) {
+	m := make(map[string]Stats)
+	for name, r := range self.Relayers {
+		m[name] = r.Stats()
+	}
+	writeJSON(w, m)
+}
+
+func (self *AdminServer) handleSessions(w http.ResponseWriter, req *http.Request) {
+	m := make(map[string][]SessionInfo)
+	for name, r := range self.Relayers {
+		m[name] = r.Sessions()
+	}
+	writeJSON(w, m)
+}
+
+func (self *AdminServer) handleKill(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(req.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, r := range self.Relayers {
+		if err := r.KillSession(id); err == nil {
+			writeJSON(w, map[string]uint64{"Killed": id})
+			return
+		}
+	}
+	http.Error(w, "Session not found", http.StatusNotFound)
+}
+
+func (self *AdminServer) handleUDPRoutes(w http.ResponseWriter, req *http.Request) {
+	m := make(map[string]map[core.RouteId]string)
+	for name, r := range self.Relayers {
+		m[name] = r.UDPRoutes()
+	}
+	writeJSON(w, m)
+}
+
+func (self *AdminServer) handleUDPRouter(w http.ResponseWriter, req *http.Request) {
+	m := make(map[string]*intrinsic.UDPRouterHealth)
+	for name, r := range self.Relayers {
+		m[name] = r.UDPRouter()
+	}
+	writeJSON(w, m)
+}
+
+func (self *AdminServer) handleUpstreams(w http.ResponseWriter, req *http.Request) {
+	m := make(map[string][]UpstreamInfo)
+	for name, r := range self.Relayers {
+		m[name] = r.Upstreams()
+	}
+	writeJSON(w, m)
+}
+
+func (self *AdminServer) handleLog(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		debug, err := strconv.ParseBool(req.FormValue("debug"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		SetDebugLogging(debug)
+	}
+	writeJSON(w, map[string]bool{"Debug": DebugLogging()})
+}
+
+// StartAdminServer serves the admin API on addr, requiring token as
+// AdminServer does. addr is treated as a path of unix socket if it contains
+// '/'. A stale socket at the path is removed, while other files are left
+// intact. TCP addresses other than loopback ones are refused, since local
+// users are all trusted with the API.
+func StartAdminServer(addr, token string, relayers map[string]Inspectable) (*http.Server, error) {
+	network := "tcp"
+	if strings.Contains(addr, "/") {
+		network = "unix"
+		if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if a, ok := ln.Addr().(*net.TCPAddr); ok && !a.IP.IsLoopback() {
+		ln.Close()
+		return nil, fmt.Errorf("Admin endpoint must listen on loopback or unix socket, got %s", addr)
+	}
+	server := &http.Server{Handler: &AdminServer{Relayers: relayers, Token: token}}
+	go server.Serve(ln)
+	return server, nil
+}
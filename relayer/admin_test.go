@@ -0,0 +1,145 @@
+package relayer
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/proxy/intrinsic"
+)
+
+func TestAdminServerListensOnLoopback(t *testing.T) {
+	for _, addr := range []string{":0", "0.0.0.0:0"} {
+		if server, err := StartAdminServer(addr, "", nil); err == nil {
+			server.Close()
+			t.Fatalf("Expected admin endpoint on %s to be refused", addr)
+		}
+	}
+	server, err := StartAdminServer("127.0.0.1:0", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+}
+
+func TestAdminServerKeepsFiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "admin")
+	if err := os.WriteFile(file, []byte("wtf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if server, err := StartAdminServer(file, "", nil); err == nil {
+		server.Close()
+		t.Fatal("Expected admin endpoint on a regular file to be refused")
+	}
+	if b, err := os.ReadFile(file); err != nil || string(b) != "wtf" {
+		t.Fatalf("Expected file to be left intact, got %q %v", b, err)
+	}
+}
+
+type fakeInspectable struct {
+	sessions []SessionInfo
+	killed   []uint64
+}
+
+func (self *fakeInspectable) Stats() Stats                          { return Stats{} }
+func (self *fakeInspectable) Sessions() []SessionInfo               { return self.sessions }
+func (self *fakeInspectable) UDPRoutes() map[core.RouteId]string    { return nil }
+func (self *fakeInspectable) UDPRouter() *intrinsic.UDPRouterHealth { return nil }
+func (self *fakeInspectable) Upstreams() []UpstreamInfo             { return nil }
+
+func (self *fakeInspectable) KillSession(id uint64) error {
+	for _, s := range self.sessions {
+		if s.Id == id {
+			self.killed = append(self.killed, id)
+			return nil
+		}
+	}
+	return errors.New("Session not found")
+}
+
+func adminRequest(s *AdminServer, method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set(ADMIN_TOKEN_HEADER, token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminToken(t *testing.T) {
+	s := &AdminServer{Relayers: map[string]Inspectable{"r": &fakeInspectable{}}, Token: "wtf"}
+	for _, token := range []string{"", "ftw"} {
+		if w := adminRequest(s, http.MethodGet, "/stats", token); w.Code != http.StatusForbidden {
+			t.Fatalf("Expected token %q to be refused, got %d", token, w.Code)
+		}
+	}
+	if w := adminRequest(s, http.MethodGet, "/stats", "wtf"); w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, w.Code)
+	}
+	// Without Token, the header is still required.
+	s = &AdminServer{Relayers: s.Relayers}
+	if w := adminRequest(s, http.MethodGet, "/stats", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected request without header to be refused, got %d", w.Code)
+	}
+	if w := adminRequest(s, http.MethodGet, "/stats", "1"); w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	r := &fakeInspectable{sessions: []SessionInfo{{Id: 1, Client: "a", Target: "example.com:443"}}}
+	s := &AdminServer{Relayers: map[string]Inspectable{"r": r}}
+	w := adminRequest(s, http.MethodGet, "/sessions", "1")
+	var m map[string][]SessionInfo
+	if err := json.NewDecoder(w.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m["r"]) != 1 || m["r"][0] != r.sessions[0] {
+		t.Fatalf("Unexpected sessions: %v", m)
+	}
+	if w := adminRequest(s, http.MethodGet, "/sessions/kill?id=1", "1"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected GET to be refused, got %d", w.Code)
+	}
+	if w := adminRequest(s, http.MethodPost, "/sessions/kill?id=2", "1"); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := adminRequest(s, http.MethodPost, "/sessions/kill?id=wtf", "1"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := adminRequest(s, http.MethodPost, "/sessions/kill?id=1", "1"); w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, w.Code)
+	}
+	if len(r.killed) != 1 || r.killed[0] != 1 {
+		t.Fatalf("Expected session 1 to be killed, got %v", r.killed)
+	}
+}
+
+func TestAdminLog(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	defer SetDebugLogging(DebugLogging())
+	s := &AdminServer{}
+	for _, debug := range []bool{true, false} {
+		target := "/log?debug=false"
+		if debug {
+			target = "/log?debug=true"
+		}
+		w := adminRequest(s, http.MethodPost, target, "1")
+		var m map[string]bool
+		if err := json.NewDecoder(w.Body).Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m["Debug"] != debug || DebugLogging() != debug {
+			t.Fatalf("Expected debug logging %v, got %v", debug, m)
+		}
+	}
+	if w := adminRequest(s, http.MethodPost, "/log?debug=wtf", "1"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -3,8 +3,15 @@
 package relayer
 
 import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
 	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/metrics"
 	"github.com/bzEq/bx/passes"
+	"github.com/bzEq/bx/proxy/socks5"
 )
 
 func createRandomCodec() (*passes.RandomEncoder, *passes.RandomDecoder) {
@@ -42,3 +49,36 @@ func CreateProtocol(name string) core.Protocol {
 		}
 	}
 }
+
+// StartMetricsServer serves metrics in Prometheus text format at /metrics.
+func StartMetricsServer(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	return server, nil
+}
+
+// clientIdentity identifies the peer of c by the common name of its TLS
+// client certificate if present, otherwise by its IP.
+func clientIdentity(c net.Conn) string {
+	if tc, ok := c.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(socks5.HANDSHAKE_TIMEOUT * time.Second))
+		err := tc.Handshake()
+		tc.SetDeadline(time.Time{})
+		if err != nil {
+			return hostOf(c.RemoteAddr().String())
+		}
+		state := tc.ConnectionState()
+		if len(state.PeerCertificates) != 0 {
+			if cn := state.PeerCertificates[0].Subject.CommonName; cn != "" {
+				return cn
+			}
+		}
+	}
+	return hostOf(c.RemoteAddr().String())
+}
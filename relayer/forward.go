@@ -0,0 +1,196 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bzEq/bx/core"
+)
+
+// Seconds to wait before asking the end relayer to listen again.
+const REMOTE_FORWARD_RETRY_INTERVAL = 5
+
+// Forward forwards connections accepted on Listen to Target.
+type Forward struct {
+	Network string
+	Listen  string
+	Target  string
+}
+
+// ParseForwards parses comma separated forwards in the form of
+// [tcp/|udp/]<listen>=<target>. Network defaults to tcp.
+func ParseForwards(s string) ([]Forward, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var l []Forward
+	for _, item := range strings.Split(s, ",") {
+		f := Forward{Network: "tcp"}
+		spec := item
+		if i := strings.Index(spec, "/"); i >= 0 {
+			f.Network = spec[:i]
+			spec = spec[i+1:]
+		}
+		if f.Network != "tcp" && f.Network != "udp" {
+			return nil, fmt.Errorf("Unsupported network of forward: %s", item)
+		}
+		lt := strings.SplitN(spec, "=", 2)
+		if len(lt) != 2 {
+			return nil, fmt.Errorf("Invalid forward: %s", item)
+		}
+		for _, addr := range lt {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, err
+			}
+		}
+		f.Listen, f.Target = lt[0], lt[1]
+		l = append(l, f)
+	}
+	return l, nil
+}
+
+func (self *IntrinsicRelayer) startLocalForward(f Forward) error {
+	if f.Network == "udp" {
+		laddr, err := net.ResolveUDPAddr("udp", f.Listen)
+		if err != nil {
+			return err
+		}
+		pc, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return err
+		}
+		if err := self.lc.AddCloser(func() { pc.Close() }); err != nil {
+			return err
+		}
+		go self.serveForwardUDP(pc, f.Target)
+		return nil
+	}
+	ln, err := self.Listen("tcp", f.Listen)
+	if err != nil {
+		return err
+	}
+	if err := self.lc.AddCloser(func() { ln.Close() }); err != nil {
+		return err
+	}
+	go self.serveForward(ln, f.Target, true)
+	return nil
+}
+
+// serveForward relays connections accepted from ln to target until ln is
+// closed. target is reached via Routes if routed, or dialed directly.
+func (self *IntrinsicRelayer) serveForward(ln net.Listener, target string, routed bool) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if !self.lc.IsClosing() {
+				log.Println(err)
+			}
+			return
+		}
+		if err := self.lc.Track(c); err != nil {
+			c.Close()
+			return
+		}
+		go func(c net.Conn) {
+			defer self.lc.Untrack(c)
+			defer c.Close()
+			ctx := withClient(self.lc.Context(), hostOf(c.RemoteAddr().String()))
+			dial := self.Dial
+			if routed {
+				rt := self.newRoute()
+				if err := rt.permit(ctx, "tcp", target); err != nil {
+					log.Println(err)
+					return
+				}
+				dial = rt.dial
+			}
+			remote, err := dial("tcp", target)
+			if err != nil {
+				core.RecordDialFailure(err)
+				log.Println(err)
+				return
+			}
+			defer remote.Close()
+			self.relays.switchTraffic(ctx, core.NewPort(c, nil), core.NewPort(remote, nil), target)
+		}(c)
+	}
+}
+
+func (self *IntrinsicRelayer) serveForwardUDP(pc *net.UDPConn, target string) {
+	var mu sync.Mutex
+	sessions := make(map[string]chan []byte)
+	buf := make([]byte, core.DEFAULT_UDP_BUFFER_SIZE)
+	for {
+		n, src, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			if self.lc.IsClosing() {
+				return
+			}
+			log.Println(err)
+			continue
+		}
+		key := src.String()
+		mu.Lock()
+		packets, in := sessions[key]
+		if !in {
+			packets = make(chan []byte, TRANSPARENT_UDP_QUEUE_SIZE)
+			sessions[key] = packets
+			go func(src *net.UDPAddr) {
+				if err := self.relayForwardUDP(pc, src, target, packets); err != nil {
+					log.Println(err)
+				}
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			}(src)
+		}
+		mu.Unlock()
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		select {
+		case packets <- packet:
+		default:
+		}
+	}
+}
+
+func (self *IntrinsicRelayer) relayForwardUDP(pc *net.UDPConn, src *net.UDPAddr, target string, packets <-chan []byte) error {
+	rt := self.newRoute()
+	if err := rt.permit(withClient(self.lc.Context(), src.IP.String()), "udp", target); err != nil {
+		return err
+	}
+	remote, err := rt.dial("udp", target)
+	if err != nil {
+		core.RecordDialFailure(err)
+		return err
+	}
+	defer remote.Close()
+	return pumpUDP(packets, remote, func(b []byte) error {
+		_, err := pc.WriteToUDP(b, src)
+		return err
+	})
+}
+
+// runRemoteForward keeps the end relayer listening on f.Listen and relays
+// inbound connections to f.Target, which is dialed directly.
+func (self *IntrinsicRelayer) runRemoteForward(f Forward) {
+	for !self.lc.IsClosing() {
+		ln, err := self.clientContext.Listen("tcp", f.Listen)
+		if err != nil {
+			log.Println(err)
+			time.Sleep(REMOTE_FORWARD_RETRY_INTERVAL * time.Second)
+			continue
+		}
+		if err := self.lc.AddCloser(func() { ln.Close() }); err != nil {
+			return
+		}
+		log.Printf("Remote %s is forwarded to %s\n", ln.Addr(), f.Target)
+		self.serveForward(ln, f.Target, false)
+	}
+}
@@ -3,12 +3,18 @@
 package relayer
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 
 	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/acl"
+	"github.com/bzEq/bx/core/dns"
+	"github.com/bzEq/bx/core/route"
 	h1p "github.com/bzEq/bx/proxy/http"
 	"github.com/bzEq/bx/proxy/intrinsic"
 	"github.com/bzEq/bx/proxy/socks5"
@@ -19,39 +25,203 @@ type IntrinsicRelayer struct {
 	Local          string
 	LocalUDP       string
 	LocalHTTPProxy string
-	Dial           func(string, string) (net.Conn, error)
-	Next           string
+	// Listen address of transparent proxy accepting connections iptables
+	// REDIRECTs, or TPROXYs if TProxy is set.
+	LocalTransparent string
+	TProxy           bool
+	// Name of TUN device whose IPv4 TCP and UDP flows are relayed.
+	LocalTUN string
+	// MTU of LocalTUN, netstack.DEFAULT_MTU if it's 0.
+	TUNMTU int
+	// Local ports forwarded to fixed targets through the tunnel.
+	LocalForwards []Forward
+	// Ports the end relayer listens on, whose inbound connections are
+	// forwarded back to local targets. Only TCP is supported.
+	RemoteForwards []Forward
+	// End relayer listens for remote forwarding requests.
+	AllowRemoteForward bool
+	// Serve gob encoded requests of legacy relayers.
+	AcceptGob bool
+	// Compress TCP traffic through the tunnel if the end relayer supports it.
+	Compress bool
+	// Relay TCP through the tunnel over a multiplexed connection to Next if
+	// the end relayer supports it.
+	Mux bool
+	// Listen address accepting registrations of end relayers behind NAT.
+	// Connections accepted on Local are relayed to the latest registered
+	// end relayer if it's set.
+	LocalRendezvous string
+	// Rendezvous relayer the end relayer registers to, serving connections
+	// relayed over the registration. Local isn't listened on if it's empty.
+	Rendezvous string
+	// Secret shared by the rendezvous relayer and end relayers registering
+	// to it. Registrations are refused unless they prove to know it.
+	RendezvousToken string
+	// UDP listen address of the end relayer's datagram transport, relaying
+	// UDP of local relayers without a TCP connection in between.
+	LocalDatagram string
+	// Datagram transport of the end relayer UDP is relayed over. UDP goes
+	// through a TCP connection to Next if it's empty or doesn't answer.
+	Datagram string
+	// Talk with Next and upstreams of Routes over QUIC instead of TCP, each
+	// connection being a stream and UDP going in datagrams. Relayers serving
+	// previous hops accept QUIC on the UDP port of Local as well. Relayers
+	// along Path are still dialed over TCP. Certificates of relayers aren't
+	// verified, see intrinsic.QUICTransport.
+	QUIC bool
+	// Listen address of DNS server resolving names via the remote side.
+	LocalDNS string
+	// Range of fake IPs LocalDNS answers with. Connections to fake IPs are
+	// relayed to the domains they stand for. Real IPs are answered if it's
+	// empty.
+	FakeIP string
+	Dial   func(string, string) (net.Conn, error)
+	// Comma separated addresses of next-hop relayers.
+	Next string
+	// How to choose among Next.
+	UpstreamPolicy UpstreamPolicy
 	RelayProtocol  string
+	// Protocol to talk with Next and relayers on paths of forwarded requests.
+	// Same as RelayProtocol if it's empty.
+	NextRelayProtocol string
+	// Intermediate relayer serves requests from previous hops and forwards
+	// them to Next, instead of serving clients via socks or http proxy.
+	Intermediate bool
+	// Relayers local relayer goes through after Next.
+	Path      []string
+	RateLimit RateLimit
+	Quota     Quota
+	// Destination ACL of end relayer, which intermediate relayers check hops
+	// of paths requested by clients against as well. acl.DefaultRules apply
+	// if it's nil.
+	ACL *acl.ACL
+	// Resolver of end relayer for dialing and DNS requests. The system
+	// resolver is used if it's nil.
+	Resolver *dns.Resolver
+	// Routing rules of local relayer. Everything goes through the tunnel to
+	// Next if it's nil.
+	Routes         *route.Table
 	udpAddr        *net.UDPAddr
 	clientContext  *intrinsic.ClientContext
+	lc             Lifecycle
+	relays         relayTable
+	next           *UpstreamGroup
+	dnsCache       dns.Cache
+	exchangeDNS    dns.ExchangeFunc
+	fakeIPs        *dns.FakeIPPool
+	listeners      *intrinsic.ListenerTable
+	registrationMu sync.Mutex
+	registration   *registration
+	upstreamsMu    sync.Mutex
+	upstreams      map[string]*intrinsic.ClientContext
+	quic           *intrinsic.QUICTransport
 }
 
+type connContextKey struct{}
+
 func (self *IntrinsicRelayer) init() error {
+	self.relays.setRateLimit(self.RateLimit)
+	if !self.isLocal() {
+		// Intermediate relayers check hops of paths requested by clients
+		// against the ACL, as end relayers check destinations.
+		self.relays.setACL(self.ACL)
+		self.relays.setResolver(self.Resolver)
+	}
+	if self.IsEndPoint() {
+		if self.AllowRemoteForward {
+			self.listeners = &intrinsic.ListenerTable{Listen: self.Listen}
+		}
+		if self.Resolver != nil {
+			self.exchangeDNS = self.dnsCache.Wrap(self.Resolver.Exchange)
+		} else {
+			self.exchangeDNS = self.dnsCache.Wrap(dns.ClassicExchange(dns.SystemServers()))
+		}
+	}
+	if err := self.relays.setQuota(self.Quota, nil); err != nil {
+		return err
+	}
+	internalDial := self.Dial
+	if !self.IsEndPoint() && self.QUIC {
+		self.quic = &intrinsic.QUICTransport{}
+	}
+	if !self.IsEndPoint() {
+		self.next = self.newUpstreamGroup(self.Next)
+		if err := self.lc.AddCloser(self.next.Close); err != nil {
+			return err
+		}
+		internalDial = self.next.DialNext
+	}
+	if self.Intermediate {
+		return nil
+	}
+	if self.FakeIP != "" {
+		pool, err := dns.NewFakeIPPool(self.FakeIP)
+		if err != nil {
+			return err
+		}
+		self.fakeIPs = pool
+	}
 	self.clientContext = &intrinsic.ClientContext{
 		GetProtocol:  func() core.Protocol { return CreateProtocol(self.RelayProtocol) },
 		RelayUDP:     self.LocalUDP != "",
 		Next:         self.Next,
-		InternalDial: self.Dial,
+		Path:         self.Path,
+		InternalDial: internalDial,
+		Compress:     self.Compress,
+		Mux:          self.Mux,
+		Datagram:     self.Datagram,
 	}
-	return self.clientContext.Init()
+	if self.quic != nil {
+		self.clientContext.DialQUICDatagrams = self.dialQUICDatagrams
+	}
+	if err := self.clientContext.Init(); err != nil {
+		return err
+	}
+	return self.lc.AddCloser(func() { self.clientContext.Close() })
 }
 
 func (self *IntrinsicRelayer) startLocalHTTPProxy() error {
-	context := self.clientContext
 	socksProxyURL, err := url.Parse("socks5://" + self.Local)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-	proxy := &h1p.HTTPProxy{
-		Dial:      context.Dial,
-		Transport: &http.Transport{Proxy: http.ProxyURL(socksProxyURL)},
+	transport := &http.Transport{Proxy: http.ProxyURL(socksProxyURL)}
+	ln, err := self.Listen("tcp", self.LocalHTTPProxy)
+	if err != nil {
+		return err
 	}
 	server := &http.Server{
-		Addr:    self.LocalHTTPProxy,
-		Handler: proxy,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			c := req.Context().Value(connContextKey{}).(net.Conn)
+			if err := self.lc.Track(c); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			defer self.lc.Untrack(c)
+			rt := self.newRoute()
+			proxy := &h1p.HTTPProxy{
+				Dial:      rt.dial,
+				Transport: transport,
+				Switch:    self.relays.switchTraffic,
+				Permit:    rt.permit,
+			}
+			proxy.ServeHTTP(w, req.WithContext(withClient(req.Context(), hostOf(req.RemoteAddr))))
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return self.lc.Context()
+		},
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
 	}
-	go server.ListenAndServe()
+	if err := self.lc.AddCloser(func() {
+		server.SetKeepAlivesEnabled(false)
+		ln.Close()
+	}); err != nil {
+		return err
+	}
+	go server.Serve(ln)
 	return nil
 }
 
@@ -64,23 +234,30 @@ func (self *IntrinsicRelayer) startLocalUDPServer() error {
 	if err != nil {
 		return err
 	}
+	if err := self.lc.AddCloser(func() { ln.Close() }); err != nil {
+		return err
+	}
 	self.udpAddr = ln.LocalAddr().(*net.UDPAddr)
 	go func() {
 		defer ln.Close()
-		context := self.clientContext
 		for {
 			req := make([]byte, core.DEFAULT_UDP_BUFFER_SIZE)
 			n, remoteAddr, err := ln.ReadFromUDP(req)
 			if err != nil {
+				if self.lc.IsClosing() {
+					return
+				}
 				log.Println(err)
 				continue
 			}
 			go func(remoteAddr *net.UDPAddr, req []byte) {
+				rt := self.newRoute()
 				s := socks5.Server{
 					UDPAddr: self.udpAddr,
-					Dial:    context.Dial,
+					Dial:    rt.dial,
+					Permit:  rt.permit,
 				}
-				if err := s.ServeUDP(ln, remoteAddr, req); err != nil {
+				if err := s.ServeUDP(withClient(self.lc.Context(), remoteAddr.IP.String()), ln, remoteAddr, req); err != nil {
 					log.Println(err)
 				}
 			}(remoteAddr, req[:n])
@@ -89,29 +266,137 @@ func (self *IntrinsicRelayer) startLocalUDPServer() error {
 	return nil
 }
 
+func (self *IntrinsicRelayer) startLocalDatagram() error {
+	ln, err := net.ListenPacket("udp", self.LocalDatagram)
+	if err != nil {
+		return err
+	}
+	if err := self.lc.AddCloser(func() { ln.Close() }); err != nil {
+		return err
+	}
+	s := &intrinsic.DatagramServer{
+		Conn:        ln,
+		GetProtocol: func() core.Protocol { return CreateProtocol(self.RelayProtocol) },
+		Dial:        self.relays.dial,
+		Permit:      self.relays.permit,
+		PeerContext: func(ctx context.Context, addr net.Addr) context.Context {
+			return withClient(ctx, hostOf(addr.String()))
+		},
+	}
+	go func() {
+		if err := s.Serve(self.lc.Context()); err != nil && !self.lc.IsClosing() {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
+func (self *IntrinsicRelayer) startLocalDNSServer() error {
+	s := &dns.Server{
+		Addr:     self.LocalDNS,
+		Exchange: self.dnsCache.Wrap(self.clientContext.ExchangeDNS),
+	}
+	if self.fakeIPs != nil {
+		s.Exchange = self.fakeIPs.Wrap(s.Exchange)
+	}
+	if err := s.Start(); err != nil {
+		return err
+	}
+	return self.lc.AddCloser(func() { s.Close() })
+}
+
 func (self *IntrinsicRelayer) IsEndPoint() bool {
 	return self.Next == ""
 }
 
+func (self *IntrinsicRelayer) isLocal() bool {
+	return !self.IsEndPoint() && !self.Intermediate
+}
+
 func (self *IntrinsicRelayer) Run() {
 	if err := self.init(); err != nil {
 		log.Println(err)
 		return
 	}
-	if !self.IsEndPoint() && self.LocalUDP != "" {
+	if self.isLocal() && self.LocalUDP != "" {
 		if err := self.startLocalUDPServer(); err != nil {
 			log.Println(err)
 			return
 		}
 	}
+	if self.isLocal() && self.LocalDNS != "" {
+		if err := self.startLocalDNSServer(); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if self.isLocal() && self.LocalTUN != "" {
+		if err := self.startLocalTUN(); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if self.isLocal() {
+		for _, f := range self.LocalForwards {
+			if err := self.startLocalForward(f); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		for _, f := range self.RemoteForwards {
+			if f.Network != "tcp" {
+				log.Println(fmt.Errorf("Unsupported network of remote forward: %s", f.Network))
+				return
+			}
+			go self.runRemoteForward(f)
+		}
+	}
+	if self.IsEndPoint() && self.LocalDatagram != "" {
+		if err := self.startLocalDatagram(); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if self.IsEndPoint() && self.LocalRendezvous != "" {
+		if err := self.startLocalRendezvous(); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if self.IsEndPoint() && self.Rendezvous != "" {
+		go self.runRendezvous()
+		if self.Local == "" {
+			stopped := make(chan struct{})
+			if err := self.lc.AddCloser(func() { close(stopped) }); err != nil {
+				return
+			}
+			<-stopped
+			return
+		}
+	}
+	if self.isLocal() && self.LocalTransparent != "" {
+		if err := self.startLocalTransparentProxy(); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if !self.isLocal() && self.QUIC {
+		if err := self.startLocalQUIC(); err != nil {
+			log.Println(err)
+			return
+		}
+	}
 	ln, err := self.Listen("tcp", self.Local)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer ln.Close()
+	if err := self.lc.AddCloser(func() { ln.Close() }); err != nil {
+		return
+	}
 	// self.LocalHTTPProxy relies on socks proxy.
-	if !self.IsEndPoint() && self.LocalHTTPProxy != "" {
+	if self.isLocal() && self.LocalHTTPProxy != "" {
 		if err := self.startLocalHTTPProxy(); err != nil {
 			log.Println(err)
 			return
@@ -120,33 +405,127 @@ func (self *IntrinsicRelayer) Run() {
 	for {
 		c, err := ln.Accept()
 		if err != nil {
-			log.Println(err)
+			if !self.lc.IsClosing() {
+				log.Println(err)
+			}
+			break
+		}
+		if err := self.lc.Track(c); err != nil {
+			c.Close()
 			break
 		}
-		if self.IsEndPoint() {
+		if self.IsEndPoint() && self.LocalRendezvous != "" {
 			go func(c net.Conn) {
+				defer self.lc.Untrack(c)
 				defer c.Close()
-				self.ServeAsEndRelayer(c)
+				self.ServeViaRendezvous(withClient(self.lc.Context(), clientIdentity(c)), c)
+			}(c)
+		} else if !self.isLocal() {
+			go func(c net.Conn) {
+				defer self.lc.Untrack(c)
+				defer c.Close()
+				self.ServeAsEndRelayer(withClient(self.lc.Context(), clientIdentity(c)), c)
 			}(c)
 		} else {
 			go func(c net.Conn) {
+				defer self.lc.Untrack(c)
 				defer c.Close()
-				self.ServeAsLocalRelayer(c)
+				self.ServeAsLocalRelayer(withClient(self.lc.Context(), clientIdentity(c)), c)
 			}(c)
 		}
 	}
 }
 
-func (self *IntrinsicRelayer) ServeAsLocalRelayer(c net.Conn) {
-	context := self.clientContext
+// Shutdown stops accepting new connections and waits for in-flight relays
+// to finish. Relays still running when ctx is done are closed forcibly.
+func (self *IntrinsicRelayer) Shutdown(ctx context.Context) error {
+	defer self.relays.close()
+	err := self.lc.Shutdown(ctx)
+	// Streams of in-flight relays share QUIC connections, which are closed
+	// once relays are done.
+	if self.quic != nil {
+		self.quic.Close()
+	}
+	return err
+}
+
+func (self *IntrinsicRelayer) ServeAsLocalRelayer(ctx context.Context, c net.Conn) {
+	rt := self.newRoute()
 	s := socks5.Server{
 		UDPAddr: self.udpAddr,
-		Dial:    context.Dial,
+		Dial:    rt.dial,
+		Switch:  self.relays.switchTraffic,
+		Permit:  rt.permit,
 	}
-	s.Serve(c)
+	s.Serve(ctx, c)
 }
 
-func (self *IntrinsicRelayer) ServeAsEndRelayer(c net.Conn) {
+// ServeAsEndRelayer serves requests from previous hops. Requests are relayed
+// to their destinations or forwarded along their paths, or to Next if this
+// relayer is intermediate.
+func (self *IntrinsicRelayer) ServeAsEndRelayer(ctx context.Context, c net.Conn) {
 	cp := core.NewPort(c, CreateProtocol(self.RelayProtocol))
-	(&intrinsic.Server{cp}).Run()
+	s := &intrinsic.Server{
+		P:                cp,
+		Dial:             self.relays.dial,
+		Switch:           self.relays.switchTraffic,
+		Permit:           self.relays.permit,
+		DialRelayer:      self.dialRelayer,
+		ExchangeDNS:      self.exchangeDNS,
+		Listeners:        self.listeners,
+		AcceptGob:        self.AcceptGob,
+		GetRelayProtocol: func() core.Protocol { return CreateProtocol(self.nextRelayProtocol()) },
+	}
+	if self.Intermediate {
+		s.Next = self.Next
+	}
+	s.Run(ctx)
+}
+
+func (self *IntrinsicRelayer) nextRelayProtocol() string {
+	if self.NextRelayProtocol != "" {
+		return self.NextRelayProtocol
+	}
+	return self.RelayProtocol
+}
+
+// dialRelayer dials Next via its upstream group and other relayers directly.
+func (self *IntrinsicRelayer) dialRelayer(network, addr string) (net.Conn, error) {
+	if self.next != nil && addr == self.Next {
+		return self.next.DialNext(network, addr)
+	}
+	return self.relays.dial(network, addr)
+}
+
+func (self *IntrinsicRelayer) Stats() Stats {
+	return self.relays.snapshot()
+}
+
+func (self *IntrinsicRelayer) Sessions() []SessionInfo {
+	return self.relays.sessions.list()
+}
+
+func (self *IntrinsicRelayer) KillSession(id uint64) error {
+	return self.relays.sessions.kill(id)
+}
+
+func (self *IntrinsicRelayer) Upstreams() []UpstreamInfo {
+	if self.next == nil {
+		return nil
+	}
+	return self.next.Upstreams()
+}
+
+func (self *IntrinsicRelayer) UDPRoutes() map[core.RouteId]string {
+	if self.clientContext == nil {
+		return nil
+	}
+	return self.clientContext.UDPRoutes()
+}
+
+func (self *IntrinsicRelayer) UDPRouter() *intrinsic.UDPRouterHealth {
+	if self.clientContext == nil {
+		return nil
+	}
+	return self.clientContext.UDPRouterHealth()
 }
@@ -0,0 +1,137 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const DEFAULT_SHUTDOWN_TIMEOUT = 30
+
+var ErrRelayerClosed = errors.New("Relayer is closed")
+
+// Lifecycle keeps track of listeners and in-flight connections of a server,
+// so that the server can stop accepting new connections and drain existing
+// ones on shutdown. The zero value is ready to use.
+type Lifecycle struct {
+	mu      sync.Mutex
+	closing bool
+	closers []func()
+	conns   map[net.Conn]int
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (self *Lifecycle) lazyInit() {
+	if self.conns == nil {
+		self.conns = make(map[net.Conn]int)
+		self.ctx, self.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// Context returns the context relays should run with. It's cancelled when
+// in-flight relays fail to drain before shutdown deadline.
+func (self *Lifecycle) Context() context.Context {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.lazyInit()
+	return self.ctx
+}
+
+func (self *Lifecycle) IsClosing() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.closing
+}
+
+// AddCloser registers f to be called when shutdown starts. If shutdown has
+// already started, f is called immediately and ErrRelayerClosed is returned.
+func (self *Lifecycle) AddCloser(f func()) error {
+	self.mu.Lock()
+	if self.closing {
+		self.mu.Unlock()
+		f()
+		return ErrRelayerClosed
+	}
+	self.closers = append(self.closers, f)
+	self.mu.Unlock()
+	return nil
+}
+
+// Track marks c as in-flight. It returns ErrRelayerClosed if shutdown has
+// started, in which case c is not tracked.
+func (self *Lifecycle) Track(c net.Conn) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.lazyInit()
+	if self.closing {
+		return ErrRelayerClosed
+	}
+	self.conns[c] += 1
+	self.wg.Add(1)
+	connectionsActive.Inc()
+	connectionsTotal.Inc()
+	return nil
+}
+
+// Untrack marks c as done.
+func (self *Lifecycle) Untrack(c net.Conn) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if n := self.conns[c]; n > 1 {
+		self.conns[c] = n - 1
+	} else {
+		delete(self.conns, c)
+	}
+	self.wg.Done()
+	connectionsActive.Dec()
+}
+
+func (self *Lifecycle) closeConns() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for c := range self.conns {
+		c.Close()
+	}
+}
+
+// Shutdown stops listeners and waits for in-flight connections to finish.
+// Connections still alive when ctx is done are closed forcibly.
+func (self *Lifecycle) Shutdown(ctx context.Context) error {
+	self.mu.Lock()
+	self.lazyInit()
+	if self.closing {
+		self.mu.Unlock()
+		return ErrRelayerClosed
+	}
+	self.closing = true
+	closers := self.closers
+	self.closers = nil
+	self.mu.Unlock()
+	for _, f := range closers {
+		f()
+	}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		self.wg.Wait()
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		self.cancel()
+		self.closeConns()
+		// Give cancelled relays a moment to unwind.
+		select {
+		case <-drained:
+		case <-time.After(time.Second):
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,73 @@
+package relayer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bx/core"
+)
+
+func TestLifecycleDrains(t *testing.T) {
+	var lc Lifecycle
+	closed := make(chan struct{})
+	if err := lc.AddCloser(func() { close(closed) }); err != nil {
+		t.Fatal(err)
+	}
+	pipe := core.MakePipe()
+	defer pipe[1].Close()
+	if err := lc.Track(pipe[0]); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- lc.Shutdown(context.Background()) }()
+	<-closed
+	if err := lc.Track(pipe[1]); !errors.Is(err, ErrRelayerClosed) {
+		t.Fatalf("Expected %v, got %v", ErrRelayerClosed, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown is done with in-flight connection: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	lc.Untrack(pipe[0])
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if lc.Context().Err() != nil {
+		t.Fatal("Expected drained relays not to be cancelled")
+	}
+	if err := lc.Shutdown(context.Background()); !errors.Is(err, ErrRelayerClosed) {
+		t.Fatalf("Expected %v, got %v", ErrRelayerClosed, err)
+	}
+	called := false
+	if err := lc.AddCloser(func() { called = true }); !errors.Is(err, ErrRelayerClosed) || !called {
+		t.Fatal("Expected closer added after shutdown to be called right away")
+	}
+}
+
+func TestLifecycleForcesClose(t *testing.T) {
+	var lc Lifecycle
+	pipe := core.MakePipe()
+	defer pipe[1].Close()
+	if err := lc.Track(pipe[0]); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer lc.Untrack(pipe[0])
+		io.Copy(io.Discard, pipe[0])
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := lc.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if lc.Context().Err() == nil {
+		t.Fatal("Expected relays to be cancelled")
+	}
+	if _, err := pipe[1].Write([]byte("wtf")); err == nil {
+		t.Fatal("Expected connection to be closed")
+	}
+}
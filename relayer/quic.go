@@ -0,0 +1,71 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/proxy/intrinsic"
+)
+
+// startLocalQUIC accepts previous hops over QUIC on the UDP port of Local.
+// Streams are served the way connections accepted on Local are. Only end
+// relayers relay UDP in datagrams, since intermediate and rendezvous relayers
+// must pass UDP on over streams to the relayer actually serving it.
+func (self *IntrinsicRelayer) startLocalQUIC() error {
+	pc, err := net.ListenPacket("udp", self.Local)
+	if err != nil {
+		return err
+	}
+	s := &intrinsic.QUICServer{
+		Conn:      pc,
+		Datagrams: self.IsEndPoint() && self.LocalRendezvous == "",
+		Dial:      self.relays.dial,
+		Permit:    self.relays.permit,
+		PeerContext: func(ctx context.Context, addr net.Addr) context.Context {
+			return withClient(ctx, hostOf(addr.String()))
+		},
+		Handle: func(ctx context.Context, c net.Conn) {
+			if err := self.lc.Track(c); err != nil {
+				c.Close()
+				return
+			}
+			defer self.lc.Untrack(c)
+			defer c.Close()
+			if self.LocalRendezvous != "" {
+				self.ServeViaRendezvous(ctx, c)
+			} else {
+				self.ServeAsEndRelayer(ctx, c)
+			}
+		},
+	}
+	// Connections are closed once their in-flight streams are done.
+	if err := self.lc.AddCloser(func() { s.Close() }); err != nil {
+		pc.Close()
+		return err
+	}
+	go func() {
+		if err := s.Serve(self.lc.Context()); err != nil && !self.lc.IsClosing() {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
+// dialQUICDatagrams returns QUIC datagrams of the first upstream of Next
+// accepting them.
+func (self *IntrinsicRelayer) dialQUICDatagrams() (*core.SyncPort, io.Closer, error) {
+	err := ErrNoUpstream
+	for _, u := range self.next.candidates() {
+		p, c, e := self.quic.DialDatagrams(u.addr)
+		if e == nil {
+			return p, c, nil
+		}
+		err = e
+	}
+	return nil, nil, err
+}
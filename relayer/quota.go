@@ -0,0 +1,262 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bzEq/bx/core"
+)
+
+var ErrQuotaExceeded = errors.New("Quota exceeded")
+
+const DEFAULT_QUOTA_SAVE_INTERVAL = 60
+
+type Quota struct {
+	// Bytes allowed per client in a period, counting both directions. Zero
+	// means unlimited unless overridden in the quota file.
+	Limit uint64
+	// One of "daily", "weekly" and "monthly".
+	Period string
+	// Usage is persisted to Path if it's not empty.
+	Path string
+}
+
+// quotaState is the content of the quota file.
+type quotaState struct {
+	PeriodStart time.Time
+	Usage       map[string]uint64
+	// Per client limits overriding Quota.Limit.
+	Limits map[string]uint64
+}
+
+// QuotaStore accounts traffic of clients against a Quota. Relayers sharing a
+// store share usage of clients, so that clients can't exceed their quota by
+// spreading traffic over relayers. Usage is persisted while relayers use it.
+type QuotaStore struct {
+	q     Quota
+	mu    sync.Mutex
+	state quotaState
+	dirty bool
+	users int
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+// ParseQuota parses quota limit like "100G" along with period and path of
+// quota file.
+func ParseQuota(limit, period, path string) (Quota, error) {
+	if limit == "" && path == "" {
+		return Quota{}, nil
+	}
+	q := Quota{Period: period, Path: path}
+	if limit == "" {
+		return q, nil
+	}
+	n, err := parseBytes(limit)
+	if err != nil {
+		return q, err
+	}
+	q.Limit = uint64(n)
+	if _, err := periodStart(time.Now(), period); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+func periodStart(t time.Time, period string) (time.Time, error) {
+	y, m, d := t.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	switch period {
+	case "daily":
+		return day, nil
+	case "weekly":
+		return day.AddDate(0, 0, -int(day.Weekday())), nil
+	case "monthly", "":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location()), nil
+	default:
+		return t, fmt.Errorf("Unknown quota period: %s", period)
+	}
+}
+
+func NewQuotaStore(q Quota) (*QuotaStore, error) {
+	start, err := periodStart(time.Now(), q.Period)
+	if err != nil {
+		return nil, err
+	}
+	self := &QuotaStore{q: q}
+	if q.Path != "" {
+		buf, err := ioutil.ReadFile(q.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(buf, &self.state); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if self.state.Usage == nil {
+		self.state.Usage = make(map[string]uint64)
+	}
+	if !self.state.PeriodStart.Equal(start) {
+		self.reset(start)
+	}
+	return self, nil
+}
+
+func (self *QuotaStore) reset(start time.Time) {
+	self.state.PeriodStart = start
+	self.state.Usage = make(map[string]uint64)
+	self.dirty = true
+}
+
+func (self *QuotaStore) limit(client string) uint64 {
+	if l, in := self.state.Limits[client]; in {
+		return l
+	}
+	return self.q.Limit
+}
+
+func (self *QuotaStore) exceeded(client string) bool {
+	l := self.limit(client)
+	return l != 0 && self.state.Usage[client] >= l
+}
+
+func (self *QuotaStore) check(client string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.exceeded(client) {
+		return fmt.Errorf("%w: %s", ErrQuotaExceeded, client)
+	}
+	return nil
+}
+
+// add accounts n bytes to client and tells if the client is over quota.
+func (self *QuotaStore) add(client string, n int) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.state.Usage[client] += uint64(n)
+	self.dirty = true
+	return self.exceeded(client)
+}
+
+// tick resets usage when a new period begins and persists usage if changed.
+func (self *QuotaStore) tick(now time.Time) error {
+	start, err := periodStart(now, self.q.Period)
+	if err != nil {
+		return err
+	}
+	self.mu.Lock()
+	if start.After(self.state.PeriodStart) {
+		self.reset(start)
+	}
+	if !self.dirty || self.q.Path == "" {
+		self.mu.Unlock()
+		return nil
+	}
+	buf, err := json.MarshalIndent(&self.state, "", "  ")
+	self.dirty = false
+	self.mu.Unlock()
+	if err == nil {
+		err = self.save(buf)
+	}
+	if err != nil {
+		// Usage is saved again on next tick.
+		self.mu.Lock()
+		self.dirty = true
+		self.mu.Unlock()
+	}
+	return err
+}
+
+// save replaces the quota file with buf.
+func (self *QuotaStore) save(buf []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(self.q.Path), filepath.Base(self.q.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), self.q.Path)
+}
+
+// acquire starts ticking the store for a relayer using it.
+func (self *QuotaStore) acquire() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.users += 1
+	if self.users > 1 {
+		return
+	}
+	self.quit, self.done = make(chan struct{}), make(chan struct{})
+	go func(quit, done chan struct{}) {
+		defer close(done)
+		self.run(quit)
+	}(self.quit, self.done)
+}
+
+// release stops ticking the store once no relayer uses it, saving usage a
+// final time.
+func (self *QuotaStore) release() {
+	self.mu.Lock()
+	self.users -= 1
+	if self.users > 0 {
+		self.mu.Unlock()
+		return
+	}
+	quit, done := self.quit, self.done
+	self.mu.Unlock()
+	close(quit)
+	<-done
+}
+
+// run ticks the store periodically until quit is closed, then saves usage
+// a final time.
+func (self *QuotaStore) run(quit <-chan struct{}) {
+	t := time.NewTicker(DEFAULT_QUOTA_SAVE_INTERVAL * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			if err := self.tick(now); err != nil {
+				log.Println(err)
+			}
+		case <-quit:
+			if err := self.tick(time.Now()); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+	}
+}
+
+// quotaObserver accounts traffic of a relay to its client and stops the
+// relay once the client runs out of quota.
+type quotaObserver struct {
+	store  *QuotaStore
+	client string
+	sw     *core.SimpleSwitch
+}
+
+func (self *quotaObserver) OnTraffic(dir int, n int) {
+	if self.store.add(self.client, n) {
+		self.sw.Stop(ErrQuotaExceeded)
+	}
+}
+
+func (self *quotaObserver) OnDone(s *core.SwitchStats) {}
@@ -0,0 +1,108 @@
+package relayer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotaRefusal(t *testing.T) {
+	store, err := NewQuotaStore(Quota{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.state.Limits = map[string]uint64{"vip": 100}
+	if store.add("a", 5) {
+		t.Fatal("Expected a within quota")
+	}
+	if err := store.check("a"); err != nil {
+		t.Fatal(err)
+	}
+	if !store.add("a", 5) {
+		t.Fatal("Expected a over quota")
+	}
+	if err := store.check("a"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if store.add("vip", 50) || store.check("b") != nil {
+		t.Fatal("Expected other clients within quota")
+	}
+}
+
+func TestQuotaPeriodReset(t *testing.T) {
+	store, err := NewQuotaStore(Quota{Limit: 10, Period: "daily"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.add("a", 10)
+	if err := store.tick(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if store.check("a") == nil {
+		t.Fatal("Expected a over quota within the period")
+	}
+	if err := store.tick(time.Now().AddDate(0, 0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.check("a"); err != nil {
+		t.Fatalf("Expected usage reset in a new period, got %v", err)
+	}
+}
+
+func TestQuotaPersistence(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "quota")
+	q := Quota{Limit: 10, Path: filepath.Join(dir, "usage.json")}
+	store, err := NewQuotaStore(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.add("a", 10)
+	// Usage is kept dirty until it's saved.
+	if err := store.tick(time.Now()); err == nil {
+		t.Fatal("Expected saving into a missing directory to fail")
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.tick(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewQuotaStore(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.check("a"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected usage of a loaded, got %v", err)
+	}
+}
+
+func TestSharedQuota(t *testing.T) {
+	q := Quota{Limit: 10, Path: filepath.Join(t.TempDir(), "usage.json")}
+	store, err := NewQuotaStore(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r0, r1 relayTable
+	r0.setQuota(Quota{}, store)
+	r1.setQuota(Quota{}, store)
+	r0.quota.add("a", 5)
+	r1.quota.add("a", 5)
+	if err := r0.permit(withClient(context.Background(), "a"), "tcp", "example.com:443"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected usage shared by relayers, got %v", err)
+	}
+	r0.close()
+	if _, err := os.Stat(q.Path); !os.IsNotExist(err) {
+		t.Fatal("Expected the store in use until the last relayer is closed")
+	}
+	r1.close()
+	loaded, err := NewQuotaStore(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.state.Usage["a"] != 10 {
+		t.Fatalf("Expected usage saved, got %v", loaded.state.Usage)
+	}
+}
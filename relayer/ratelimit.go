@@ -0,0 +1,181 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bzEq/bx/core"
+)
+
+// Bandwidth in bytes per second. Zero means unlimited.
+type Bandwidth struct {
+	Up   int
+	Down int
+}
+
+type RateLimit struct {
+	Global         Bandwidth
+	PerClient      Bandwidth
+	PerDestination Bandwidth
+}
+
+func parseBytes(s string) (int, error) {
+	unit := 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("Negative bandwidth: %d", n)
+	}
+	return n * unit, nil
+}
+
+// ParseRateLimit parses specs like "global=10M/100M,client=1M/10M,dest=512K/5M",
+// where each scope is given as up/down bytes per second.
+func ParseRateLimit(spec string) (RateLimit, error) {
+	var r RateLimit
+	if spec == "" {
+		return r, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return r, fmt.Errorf("Invalid rate limit: %s", item)
+		}
+		ud := strings.SplitN(kv[1], "/", 2)
+		if len(ud) != 2 {
+			return r, fmt.Errorf("Invalid bandwidth: %s", kv[1])
+		}
+		var b Bandwidth
+		var err error
+		if b.Up, err = parseBytes(ud[0]); err != nil {
+			return r, err
+		}
+		if b.Down, err = parseBytes(ud[1]); err != nil {
+			return r, err
+		}
+		switch kv[0] {
+		case "global":
+			r.Global = b
+		case "client":
+			r.PerClient = b
+		case "dest":
+			r.PerDestination = b
+		default:
+			return r, fmt.Errorf("Unknown rate limit scope: %s", kv[0])
+		}
+	}
+	return r, nil
+}
+
+type bucketPair struct {
+	up, down *core.TokenBucket
+	refs     int
+}
+
+func newBucketPair(b Bandwidth) *bucketPair {
+	p := &bucketPair{}
+	if b.Up > 0 {
+		p.up = core.NewTokenBucket(b.Up, 0)
+	}
+	if b.Down > 0 {
+		p.down = core.NewTokenBucket(b.Down, 0)
+	}
+	return p
+}
+
+// bucketGroup shares buckets among relays with the same key and drops them
+// once no relay refers to them.
+type bucketGroup struct {
+	bw      Bandwidth
+	mu      sync.Mutex
+	buckets map[string]*bucketPair
+}
+
+func (self *bucketGroup) acquire(key string) *bucketPair {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.buckets == nil {
+		self.buckets = make(map[string]*bucketPair)
+	}
+	p, in := self.buckets[key]
+	if !in {
+		p = newBucketPair(self.bw)
+		self.buckets[key] = p
+	}
+	p.refs += 1
+	return p
+}
+
+func (self *bucketGroup) release(key string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	p := self.buckets[key]
+	p.refs -= 1
+	if p.refs == 0 {
+		delete(self.buckets, key)
+	}
+}
+
+type rateLimiter struct {
+	global  *bucketPair
+	clients bucketGroup
+	dests   bucketGroup
+}
+
+func newRateLimiter(r RateLimit) *rateLimiter {
+	return &rateLimiter{
+		global:  newBucketPair(r.Global),
+		clients: bucketGroup{bw: r.PerClient},
+		dests:   bucketGroup{bw: r.PerDestination},
+	}
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// wrap throttles p facing client. Uploads are read from p and downloads are
+// written to p. Calling the returned function releases shared buckets.
+func (self *rateLimiter) wrap(p core.Port, client, target string) (core.Port, func()) {
+	dest := hostOf(target)
+	pairs := []*bucketPair{self.global, self.clients.acquire(client), self.dests.acquire(dest)}
+	release := func() {
+		self.clients.release(client)
+		self.dests.release(dest)
+	}
+	var up, down []*core.TokenBucket
+	for _, p := range pairs {
+		if p.up != nil {
+			up = append(up, p.up)
+		}
+		if p.down != nil {
+			down = append(down, p.down)
+		}
+	}
+	if len(up) == 0 && len(down) == 0 {
+		return p, release
+	}
+	return core.NewRateLimitedPort(p, down, up), release
+}
@@ -0,0 +1,114 @@
+package relayer
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/bzEq/bx/core"
+)
+
+func TestParseBytes(t *testing.T) {
+	for _, tc := range []struct {
+		s  string
+		n  int
+		ok bool
+	}{
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512K", 512 << 10, true},
+		{"10M", 10 << 20, true},
+		{"2G", 2 << 30, true},
+		{"", 0, false},
+		{"K", 0, false},
+		{"-1", 0, false},
+		{"-1K", 0, false},
+		{"1.5M", 0, false},
+		{"10m", 0, false},
+		{"10T", 0, false},
+	} {
+		n, err := parseBytes(tc.s)
+		if (err == nil) != tc.ok || n != tc.n {
+			t.Fatalf("Expected %q to be parsed as %d (%v), got %d %v", tc.s, tc.n, tc.ok, n, err)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		r    RateLimit
+		ok   bool
+	}{
+		{"", RateLimit{}, true},
+		{"global=10M/100M", RateLimit{Global: Bandwidth{10 << 20, 100 << 20}}, true},
+		{
+			"global=10M/100M,client=1M/10M,dest=512K/5M",
+			RateLimit{
+				Global:         Bandwidth{10 << 20, 100 << 20},
+				PerClient:      Bandwidth{1 << 20, 10 << 20},
+				PerDestination: Bandwidth{512 << 10, 5 << 20},
+			},
+			true,
+		},
+		{"client=0/1K", RateLimit{PerClient: Bandwidth{0, 1 << 10}}, true},
+		{"global", RateLimit{}, false},
+		{"global=10M", RateLimit{}, false},
+		{"global=10M/", RateLimit{}, false},
+		{"global=wtf/10M", RateLimit{}, false},
+		{"host=1M/1M", RateLimit{}, false},
+		{"global=1M/1M,", RateLimit{}, false},
+	} {
+		r, err := ParseRateLimit(tc.spec)
+		if (err == nil) != tc.ok {
+			t.Fatalf("Expected %q to be parsed (%v), got %v", tc.spec, tc.ok, err)
+		}
+		if tc.ok && r != tc.r {
+			t.Fatalf("Expected %q to be parsed as %+v, got %+v", tc.spec, tc.r, r)
+		}
+	}
+}
+
+func TestRateLimitSharedByClient(t *testing.T) {
+	var relays relayTable
+	relays.setRateLimit(RateLimit{PerClient: Bandwidth{1 << 20, 1 << 20}})
+	buckets := func() (int, int) {
+		g := &relays.limiter.clients
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		p := g.buckets["a"]
+		if p == nil {
+			return len(g.buckets), 0
+		}
+		return len(g.buckets), p.refs
+	}
+	ctx := withClient(context.Background(), "a")
+	var ends [][2]net.Conn
+	done := make(chan struct{}, 2)
+	for _, target := range []string{"a.example.com:443", "b.example.com:443"} {
+		client, remote := core.MakePipe(), core.MakePipe()
+		ends = append(ends, [2]net.Conn{client[0], remote[0]})
+		go func(target string) {
+			defer func() { done <- struct{}{} }()
+			defer client[1].Close()
+			defer remote[1].Close()
+			relays.switchTraffic(ctx, core.NewPort(client[1], nil), core.NewPort(remote[1], nil), target)
+		}(target)
+	}
+	waitFor(t, func() bool {
+		n, refs := buckets()
+		return n == 1 && refs == 2
+	})
+	ends[0][0].Close()
+	ends[0][1].Close()
+	<-done
+	if n, refs := buckets(); n != 1 || refs != 1 {
+		t.Fatalf("Expected 1 bucket with 1 reference, got %d buckets with %d", n, refs)
+	}
+	ends[1][0].Close()
+	ends[1][1].Close()
+	<-done
+	if n, _ := buckets(); n != 0 {
+		t.Fatalf("Expected buckets to be released, got %d", n)
+	}
+}
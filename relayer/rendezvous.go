@@ -0,0 +1,271 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+	"github.com/bzEq/bx/core/mux"
+	"github.com/bzEq/bx/proxy/socks5"
+)
+
+// Seconds to wait before registering to the rendezvous relayer again.
+const RENDEZVOUS_RETRY_INTERVAL = 5
+
+// Bytes of the challenge end relayers prove to know RendezvousToken with.
+const RENDEZVOUS_CHALLENGE_SIZE = 32
+
+var ErrRegistrationRefused = errors.New("Registration is refused")
+
+// registration is an end relayer registered to the rendezvous relayer.
+type registration struct {
+	session *mux.Session
+	addr    string
+}
+
+// framedProtocol is the protocol of name, or a plain framing if it's raw,
+// since sessions rely on frame boundaries.
+func framedProtocol(name string) core.Protocol {
+	if p := CreateProtocol(name); p != nil {
+		return p
+	}
+	return &core.HTTPProtocol{}
+}
+
+// rendezvousProof is the answer to challenge of end relayers knowing token.
+func rendezvousProof(token string, challenge []byte) []byte {
+	h := hmac.New(sha256.New, []byte(token))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// authenticateRegistration challenges the end relayer over p, which must
+// answer with the proof of RendezvousToken before the handshake times out.
+func (self *IntrinsicRelayer) authenticateRegistration(c net.Conn, p core.Port) error {
+	c.SetDeadline(time.Now().Add(socks5.HANDSHAKE_TIMEOUT * time.Second))
+	defer c.SetDeadline(time.Time{})
+	challenge := make([]byte, RENDEZVOUS_CHALLENGE_SIZE)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	// Passes of the protocol may encode packed buffers in place.
+	if err := p.Pack(iovec.FromSlice(append([]byte(nil), challenge...))); err != nil {
+		return err
+	}
+	var b iovec.IoVec
+	if err := p.Unpack(&b); err != nil {
+		return err
+	}
+	if !hmac.Equal(b.Consume(), rendezvousProof(self.RendezvousToken, challenge)) {
+		return ErrRegistrationRefused
+	}
+	return nil
+}
+
+// answerRendezvous answers the challenge of Rendezvous over p.
+func (self *IntrinsicRelayer) answerRendezvous(c net.Conn, p core.Port) error {
+	c.SetDeadline(time.Now().Add(socks5.HANDSHAKE_TIMEOUT * time.Second))
+	defer c.SetDeadline(time.Time{})
+	var b iovec.IoVec
+	if err := p.Unpack(&b); err != nil {
+		return err
+	}
+	return p.Pack(iovec.FromSlice(rendezvousProof(self.RendezvousToken, b.Consume())))
+}
+
+// startLocalRendezvous accepts registrations of end relayers on
+// LocalRendezvous.
+func (self *IntrinsicRelayer) startLocalRendezvous() error {
+	if self.RendezvousToken == "" {
+		return fmt.Errorf("Rendezvous relayer requires a token to authenticate registrations")
+	}
+	ln, err := self.Listen("tcp", self.LocalRendezvous)
+	if err != nil {
+		return err
+	}
+	if err := self.lc.AddCloser(func() { ln.Close() }); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if !self.lc.IsClosing() {
+					log.Println(err)
+				}
+				return
+			}
+			go self.serveRegistration(c)
+		}
+	}()
+	return nil
+}
+
+// serveRegistration keeps the registration over c until the session is lost.
+// The latest authenticated registration takes over new connections, so that
+// an end relayer can register again once its NAT mapping changes.
+// Connections relayed over earlier registrations are left intact.
+func (self *IntrinsicRelayer) serveRegistration(c net.Conn) {
+	defer c.Close()
+	p := core.NewPort(c, framedProtocol(self.RelayProtocol))
+	if err := self.authenticateRegistration(c, p); err != nil {
+		log.Println(fmt.Errorf("Registration of %s is refused: %w", c.RemoteAddr(), err))
+		return
+	}
+	r := &registration{
+		session: mux.NewSession(p, true),
+		addr:    c.RemoteAddr().String(),
+	}
+	self.registrationMu.Lock()
+	self.registration = r
+	self.registrationMu.Unlock()
+	log.Printf("End relayer %s is registered\n", r.addr)
+	select {
+	case <-r.session.Done():
+	case <-self.lc.Context().Done():
+	}
+	r.session.Close()
+	self.registrationMu.Lock()
+	if self.registration == r {
+		self.registration = nil
+	}
+	self.registrationMu.Unlock()
+	log.Println(fmt.Errorf("Registration of %s is lost: %w", r.addr, r.session.Err()))
+}
+
+// ServeViaRendezvous relays c to the registered end relayer. Traffic is
+// relayed as is, so the client talks with the end relayer directly.
+func (self *IntrinsicRelayer) ServeViaRendezvous(ctx context.Context, c net.Conn) {
+	self.registrationMu.Lock()
+	r := self.registration
+	self.registrationMu.Unlock()
+	if r == nil {
+		log.Println(fmt.Errorf("No end relayer is registered"))
+		return
+	}
+	s, err := r.session.Open(c.RemoteAddr().String())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer s.Close()
+	self.relays.switchTraffic(ctx, core.NewPort(c, nil), core.NewPort(s, nil), r.addr)
+}
+
+// rendezvousLink is the connection of a registration to Rendezvous. On
+// shutdown, it's closed once connections relayed over it are drained.
+type rendezvousLink struct {
+	mu      sync.Mutex
+	c       net.Conn
+	streams int
+	closing bool
+}
+
+func (self *rendezvousLink) enter() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.streams += 1
+}
+
+func (self *rendezvousLink) leave() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.streams -= 1
+	if self.closing && self.streams == 0 {
+		self.c.Close()
+	}
+}
+
+func (self *rendezvousLink) shutdown() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.closing = true
+	if self.streams == 0 {
+		self.c.Close()
+	}
+}
+
+// runRendezvous keeps the end relayer registered to Rendezvous. Only the
+// link of the current registration is drained on shutdown, since links of
+// lost registrations are closed already.
+func (self *IntrinsicRelayer) runRendezvous() {
+	var mu sync.Mutex
+	var link *rendezvousLink
+	closing := false
+	if err := self.lc.AddCloser(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		closing = true
+		if link != nil {
+			link.shutdown()
+		}
+	}); err != nil {
+		return
+	}
+	attach := func(l *rendezvousLink) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if closing {
+			return false
+		}
+		link = l
+		return true
+	}
+	for !self.lc.IsClosing() {
+		if err := self.register(attach); err != nil && !self.lc.IsClosing() {
+			log.Println(err)
+		}
+		time.Sleep(RENDEZVOUS_RETRY_INTERVAL * time.Second)
+	}
+}
+
+// register serves connections relayed over a registration to Rendezvous
+// until the registration is lost. The link of the registration is handed to
+// attach, which refuses it once the relayer is shutting down.
+func (self *IntrinsicRelayer) register(attach func(*rendezvousLink) bool) error {
+	c, err := self.Dial("tcp", self.Rendezvous)
+	if err != nil {
+		core.RecordDialFailure(err)
+		return err
+	}
+	defer c.Close()
+	link := &rendezvousLink{c: c}
+	if !attach(link) {
+		return ErrRelayerClosed
+	}
+	p := core.NewPort(c, framedProtocol(self.RelayProtocol))
+	if err := self.answerRendezvous(c, p); err != nil {
+		return fmt.Errorf("Failed to register to %s: %w", self.Rendezvous, err)
+	}
+	session := mux.NewSession(p, false)
+	defer session.Close()
+	log.Printf("Registered to rendezvous relayer %s\n", self.Rendezvous)
+	for {
+		s, err := session.Accept()
+		if err != nil {
+			return fmt.Errorf("Registration to %s is lost: %w", self.Rendezvous, session.Err())
+		}
+		if err := self.lc.Track(s); err != nil {
+			s.Close()
+			continue
+		}
+		link.enter()
+		go func(s net.Conn) {
+			defer link.leave()
+			defer self.lc.Untrack(s)
+			defer s.Close()
+			self.ServeAsEndRelayer(withClient(self.lc.Context(), hostOf(s.RemoteAddr().String())), s)
+		}(s)
+	}
+}
@@ -0,0 +1,153 @@
+package relayer
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/iovec"
+	"github.com/bzEq/bx/proxy/intrinsic"
+)
+
+func serveEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// shutdown shuts r down, closing connections left by relays right away.
+func shutdown(r *IntrinsicRelayer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r.lc.Shutdown(ctx)
+}
+
+// startRendezvous starts a rendezvous relayer on a loopback port and returns
+// its address.
+func startRendezvous(t *testing.T, token string) (*IntrinsicRelayer, string) {
+	addr := make(chan string, 1)
+	r := &IntrinsicRelayer{
+		LocalRendezvous: "127.0.0.1:0",
+		RendezvousToken: token,
+		Listen: func(network, address string) (net.Listener, error) {
+			ln, err := net.Listen(network, address)
+			if err == nil {
+				addr <- ln.Addr().String()
+			}
+			return ln, err
+		},
+	}
+	if err := r.startLocalRendezvous(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdown(r) })
+	return r, <-addr
+}
+
+// waitRegistration waits for a registration to r other than old.
+func waitRegistration(t *testing.T, r *IntrinsicRelayer, old *registration) *registration {
+	deadline := time.Now().Add(3 * RENDEZVOUS_RETRY_INTERVAL * time.Second)
+	for time.Now().Before(deadline) {
+		r.registrationMu.Lock()
+		cur := r.registration
+		r.registrationMu.Unlock()
+		if cur != nil && cur != old {
+			return cur
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("End relayer isn't registered")
+	return nil
+}
+
+// relayViaRendezvous relays msg to echo over the registration to r.
+func relayViaRendezvous(t *testing.T, r *IntrinsicRelayer, echo, msg string) string {
+	pipe := core.MakePipe()
+	go func() {
+		defer pipe[1].Close()
+		r.ServeViaRendezvous(context.Background(), pipe[1])
+	}()
+	defer pipe[0].Close()
+	pack, err := intrinsic.EncodeIntrinsic(intrinsic.RELAY_TCP, &intrinsic.TCPRequest{Addr: echo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := core.NewPort(pipe[0], CreateProtocol(""))
+	if err := p.Pack(iovec.FromSlice(pack)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Pack(iovec.FromSlice([]byte(msg))); err != nil {
+		t.Fatal(err)
+	}
+	var b iovec.IoVec
+	if err := p.Unpack(&b); err != nil {
+		t.Fatal(err)
+	}
+	return string(b.Consume())
+}
+
+func TestRendezvousReregistration(t *testing.T) {
+	echo := serveEcho(t)
+	rendezvous, addr := startRendezvous(t, "wtf")
+	end := &IntrinsicRelayer{Rendezvous: addr, RendezvousToken: "wtf", Dial: net.Dial}
+	go end.runRendezvous()
+	defer shutdown(end)
+	r := waitRegistration(t, rendezvous, nil)
+	if got := relayViaRendezvous(t, rendezvous, echo, "wtf"); got != "wtf" {
+		t.Fatalf("Expected %q, got %q", "wtf", got)
+	}
+	// The end relayer registers again once its registration is lost.
+	r.session.Close()
+	waitRegistration(t, rendezvous, r)
+	if got := relayViaRendezvous(t, rendezvous, echo, "wtfwtf"); got != "wtfwtf" {
+		t.Fatalf("Expected %q, got %q", "wtfwtf", got)
+	}
+	end.lc.mu.Lock()
+	n := len(end.lc.closers)
+	end.lc.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("Expected 1 closer across registrations, got %d", n)
+	}
+}
+
+func TestRendezvousRefusesUnknownToken(t *testing.T) {
+	rendezvous, addr := startRendezvous(t, "wtf")
+	end := &IntrinsicRelayer{Rendezvous: addr, RendezvousToken: "wtf", Dial: net.Dial}
+	go end.runRendezvous()
+	defer shutdown(end)
+	r := waitRegistration(t, rendezvous, nil)
+	impostor := &IntrinsicRelayer{Rendezvous: addr, RendezvousToken: "ftw", Dial: net.Dial}
+	if err := impostor.register(func(*rendezvousLink) bool { return true }); err == nil {
+		t.Fatal("Expected registration with unknown token to be refused")
+	}
+	rendezvous.registrationMu.Lock()
+	defer rendezvous.registrationMu.Unlock()
+	if rendezvous.registration != r {
+		t.Fatal("Registration is taken over by unknown token")
+	}
+}
+
+func TestRendezvousRequiresToken(t *testing.T) {
+	r := &IntrinsicRelayer{LocalRendezvous: "127.0.0.1:0", Listen: net.Listen}
+	if err := r.startLocalRendezvous(); err == nil {
+		t.Fatal("Expected rendezvous relayer without token to fail")
+	}
+}
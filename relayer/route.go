@@ -0,0 +1,147 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/metrics"
+	"github.com/bzEq/bx/core/route"
+	"github.com/bzEq/bx/proxy/intrinsic"
+)
+
+var routeDecisions = metrics.Default.CounterVec("bx_route_decisions_total",
+	"Number of routing decisions of local relayer by action", "action")
+
+// localRoute routes a request of a local client. Its destination is decided
+// once by permit, and dial reaches it the way decided, so that domains aren't
+// resolved again by Routes. A route serves a single request at a time.
+type localRoute struct {
+	r       *IntrinsicRelayer
+	ctx     context.Context
+	network string
+	addr    string
+	d       route.Decision
+}
+
+func (self *IntrinsicRelayer) newRoute() *localRoute {
+	return &localRoute{r: self, ctx: self.lc.Context()}
+}
+
+// restoreAddr maps fake IPs handed out by the local DNS server back to their
+// domains, so that routing rules match domains and the end relayer resolves
+// them.
+func (self *IntrinsicRelayer) restoreAddr(addr string) (string, error) {
+	if self.fakeIPs == nil {
+		return addr, nil
+	}
+	return self.fakeIPs.RestoreAddr(addr)
+}
+
+// decide decides how to reach addr, which has fake IPs restored already.
+// Requests are tunneled to Next if there are no Routes.
+func (self *localRoute) decide(ctx context.Context, network, addr string) error {
+	d := route.Decision{Action: route.TUNNEL}
+	if self.r.Routes != nil {
+		var err error
+		if d, err = self.r.Routes.Decide(ctx, network, addr); err != nil {
+			return err
+		}
+		routeDecisions.With(d.Action.String()).Inc()
+	}
+	self.ctx, self.network, self.addr, self.d = ctx, network, addr, d
+	return nil
+}
+
+// permit refuses destinations rejected by Routes, so that clients are told
+// the connection is not allowed instead of seeing it closed after dialing.
+func (self *localRoute) permit(ctx context.Context, network, addr string) error {
+	addr, err := self.r.restoreAddr(addr)
+	if err != nil {
+		return err
+	}
+	if err := self.decide(ctx, network, addr); err != nil {
+		return err
+	}
+	if self.d.Action == route.REJECT {
+		return fmt.Errorf("%w: %s", route.ErrRejected, addr)
+	}
+	return self.r.relays.permit(ctx, network, addr)
+}
+
+// dial reaches addr directly, via the tunnel to Next or via an upstream
+// relayer, the way permit decided. addr is decided in the context of the
+// route if permit wasn't consulted about it.
+func (self *localRoute) dial(network, addr string) (net.Conn, error) {
+	addr, err := self.r.restoreAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network != self.network || addr != self.addr {
+		if err := self.decide(self.ctx, network, addr); err != nil {
+			return nil, err
+		}
+	}
+	switch self.d.Action {
+	case route.DIRECT:
+		return self.r.Dial(network, addr)
+	case route.UPSTREAM:
+		cc, err := self.r.upstream(self.d.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		return cc.Dial(network, addr)
+	case route.REJECT:
+		return nil, fmt.Errorf("%w: %s", route.ErrRejected, addr)
+	default:
+		return self.r.clientContext.Dial(network, addr)
+	}
+}
+
+func (self *IntrinsicRelayer) newUpstreamGroup(next string) *UpstreamGroup {
+	dial := self.Dial
+	if self.quic != nil {
+		dial = self.quic.Dial
+	}
+	g := NewUpstreamGroup(strings.Split(next, ","), self.UpstreamPolicy, dial)
+	g.Start()
+	return g
+}
+
+// upstream returns the client context relaying to next, which is comma
+// separated addresses of relayers, creating it on first use. UDP isn't
+// relayed via upstreams.
+func (self *IntrinsicRelayer) upstream(next string) (*intrinsic.ClientContext, error) {
+	self.upstreamsMu.Lock()
+	defer self.upstreamsMu.Unlock()
+	if cc, in := self.upstreams[next]; in {
+		return cc, nil
+	}
+	g := self.newUpstreamGroup(next)
+	cc := &intrinsic.ClientContext{
+		GetProtocol:  func() core.Protocol { return CreateProtocol(self.RelayProtocol) },
+		Next:         next,
+		InternalDial: g.DialNext,
+		Compress:     self.Compress,
+		Mux:          self.Mux,
+	}
+	if err := cc.Init(); err != nil {
+		g.Close()
+		return nil, err
+	}
+	if err := self.lc.AddCloser(func() {
+		cc.Close()
+		g.Close()
+	}); err != nil {
+		return nil, err
+	}
+	if self.upstreams == nil {
+		self.upstreams = make(map[string]*intrinsic.ClientContext)
+	}
+	self.upstreams[next] = cc
+	return cc, nil
+}
@@ -0,0 +1,75 @@
+package relayer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bzEq/bx/core/route"
+)
+
+// countingResolver resolves every host to loopback and records clients of
+// its queries.
+type countingResolver struct {
+	mu      sync.Mutex
+	clients []string
+}
+
+func (self *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.clients = append(self.clients, clientFromContext(ctx))
+	return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+}
+
+func routedRelayer(t *testing.T, rules string) (*IntrinsicRelayer, *countingResolver) {
+	parsed, err := route.Parse(strings.NewReader(rules), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &countingResolver{}
+	table := route.NewTable(parsed)
+	table.Resolver = res
+	return &IntrinsicRelayer{Routes: table}, res
+}
+
+func TestRouteDecidedOnce(t *testing.T) {
+	echo := serveEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+	r, res := routedRelayer(t, "direct cidr:127.0.0.0/8\n")
+	var dialed []string
+	r.Dial = func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return net.Dial(network, echo)
+	}
+	rt := r.newRoute()
+	addr := net.JoinHostPort("echo.example.com", port)
+	if err := rt.permit(withClient(context.Background(), "a"), "tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	c, err := rt.dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(dialed) != 1 || dialed[0] != addr {
+		t.Fatalf("Expected %s to be dialed directly, got %v", addr, dialed)
+	}
+	if len(res.clients) != 1 || res.clients[0] != "a" {
+		t.Fatalf("Expected 1 query in the context of the request, got %v", res.clients)
+	}
+}
+
+func TestRouteRejected(t *testing.T) {
+	r, _ := routedRelayer(t, "reject domain:example.com\n")
+	rt := r.newRoute()
+	if err := rt.permit(context.Background(), "tcp", "www.example.com:443"); !errors.Is(err, route.ErrRejected) {
+		t.Fatalf("Expected %v, got %v", route.ErrRejected, err)
+	}
+	if _, err := rt.dial("tcp", "www.example.com:443"); !errors.Is(err, route.ErrRejected) {
+		t.Fatalf("Expected %v, got %v", route.ErrRejected, err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/bzEq/bx/core"
+)
+
+var ErrSessionKilled = errors.New("Session is killed")
+
+type clientKey struct{}
+
+func withClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+func clientFromContext(ctx context.Context) string {
+	if client, ok := ctx.Value(clientKey{}).(string); ok {
+		return client
+	}
+	return ""
+}
+
+// Session ids are unique across relayers in a process.
+var lastSessionId uint64
+
+type session struct {
+	id     uint64
+	client string
+	target string
+	sw     *core.SimpleSwitch
+}
+
+type SessionInfo struct {
+	Id     uint64
+	Client string
+	Target string
+	Up     uint64
+	Down   uint64
+	// In seconds.
+	Age float64
+}
+
+type sessionTable struct {
+	m core.Map[uint64, *session]
+}
+
+func (self *sessionTable) add(ctx context.Context, target string, sw *core.SimpleSwitch) *session {
+	s := &session{
+		id:     atomic.AddUint64(&lastSessionId, 1),
+		client: clientFromContext(ctx),
+		target: target,
+		sw:     sw,
+	}
+	self.m.Store(s.id, s)
+	return s
+}
+
+func (self *sessionTable) remove(id uint64) {
+	self.m.Delete(id)
+}
+
+func (self *sessionTable) list() []SessionInfo {
+	var l []SessionInfo
+	now := time.Now()
+	self.m.Range(func(id uint64, s *session) bool {
+		stats := s.sw.Stats()
+		l = append(l, SessionInfo{
+			Id:     id,
+			Client: s.client,
+			Target: s.target,
+			Up:     stats.Bytes[core.SWITCH_FORWARD],
+			Down:   stats.Bytes[core.SWITCH_BACKWARD],
+			Age:    now.Sub(stats.Start).Seconds(),
+		})
+		return true
+	})
+	sort.Slice(l, func(i, j int) bool { return l[i].Id < l[j].Id })
+	return l
+}
+
+func (self *sessionTable) kill(id uint64) error {
+	s, in := self.m.Load(id)
+	if !in {
+		return fmt.Errorf("Session #%d doesn't exist", id)
+	}
+	s.sw.Stop(ErrSessionKilled)
+	return nil
+}
@@ -3,68 +3,151 @@
 package relayer
 
 import (
+	"context"
 	"log"
-	"math/rand"
 	"net"
 
 	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/acl"
+	"github.com/bzEq/bx/core/dns"
+	"github.com/bzEq/bx/proxy/intrinsic"
 	"github.com/bzEq/bx/proxy/socks5"
 )
 
 type SocksRelayer struct {
-	Listen        func(string, string) (net.Listener, error)
-	Local         string
-	Dial          func(string, string) (net.Conn, error)
-	Next          []string
-	RelayProtocol string
+	Listen func(string, string) (net.Listener, error)
+	Local  string
+	Dial   func(string, string) (net.Conn, error)
+	Next   []string
+	// How to choose among Next.
+	UpstreamPolicy UpstreamPolicy
+	RelayProtocol  string
+	RateLimit      RateLimit
+	Quota          Quota
+	// Store shared with other relayers, in place of one of Quota.
+	QuotaStore *QuotaStore
+	// Destination ACL of end relayer. acl.DefaultRules apply if it's nil.
+	ACL *acl.ACL
+	// Resolver of end relayer for dialing. The system resolver is used if
+	// it's nil.
+	Resolver *dns.Resolver
+	lc       Lifecycle
+	relays   relayTable
+	next     *UpstreamGroup
 }
 
 func (self *SocksRelayer) Run() {
+	self.relays.setRateLimit(self.RateLimit)
+	if len(self.Next) == 0 {
+		self.relays.setACL(self.ACL)
+		self.relays.setResolver(self.Resolver)
+	} else {
+		self.next = NewUpstreamGroup(self.Next, self.UpstreamPolicy, self.Dial)
+		self.next.Start()
+		if err := self.lc.AddCloser(self.next.Close); err != nil {
+			return
+		}
+	}
+	if err := self.relays.setQuota(self.Quota, self.QuotaStore); err != nil {
+		log.Println(err)
+		return
+	}
 	l, err := self.Listen("tcp", self.Local)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer l.Close()
+	if err := self.lc.AddCloser(func() { l.Close() }); err != nil {
+		return
+	}
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			log.Println(err)
+			if !self.lc.IsClosing() {
+				log.Println(err)
+			}
+			break
+		}
+		if err := self.lc.Track(c); err != nil {
+			c.Close()
 			break
 		}
 		if len(self.Next) == 0 {
 			go func(c net.Conn) {
+				defer self.lc.Untrack(c)
 				defer c.Close()
-				self.ServeAsEndRelayer(c)
+				self.ServeAsEndRelayer(withClient(self.lc.Context(), clientIdentity(c)), c)
 			}(c)
 		} else {
 			go func(c net.Conn) {
+				defer self.lc.Untrack(c)
 				defer c.Close()
-				self.ServeAsIntermediateRelayer(c)
+				self.ServeAsIntermediateRelayer(withClient(self.lc.Context(), clientIdentity(c)), c)
 			}(c)
 		}
 	}
 }
 
-func (self *SocksRelayer) ServeAsIntermediateRelayer(red net.Conn) {
-	blue, err := self.Dial("tcp", self.Next[rand.Uint64()%uint64(len(self.Next))])
+// Shutdown stops accepting new connections and waits for in-flight relays
+// to finish. Relays still running when ctx is done are closed forcibly.
+func (self *SocksRelayer) Shutdown(ctx context.Context) error {
+	defer self.relays.close()
+	return self.lc.Shutdown(ctx)
+}
+
+func (self *SocksRelayer) ServeAsIntermediateRelayer(ctx context.Context, red net.Conn) {
+	blue, next, err := self.next.DialUpstream("tcp", func(addr string) error {
+		return self.relays.permit(ctx, "tcp", addr)
+	})
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer blue.Close()
-	core.RunSimpleSwitch(core.NewPort(red, nil),
-		core.NewPort(blue, CreateProtocol(self.RelayProtocol)))
+	self.relays.switchTraffic(ctx, core.NewPort(red, nil),
+		core.NewPort(blue, CreateProtocol(self.RelayProtocol)), next)
 }
 
-func (self *SocksRelayer) ServeAsEndRelayer(red net.Conn) {
+func (self *SocksRelayer) ServeAsEndRelayer(ctx context.Context, red net.Conn) {
 	blue := core.MakePipe()
 	go func() {
 		defer blue[0].Close()
-		core.RunSimpleSwitch(core.NewPort(red, CreateProtocol(self.RelayProtocol)),
+		core.RunSimpleSwitch(ctx, core.NewPort(red, CreateProtocol(self.RelayProtocol)),
 			core.NewPort(blue[0], nil))
 	}()
 	defer blue[1].Close()
-	server := &socks5.Server{}
-	server.Serve(blue[1])
+	server := &socks5.Server{
+		Dial:   self.relays.dial,
+		Switch: self.relays.switchTraffic,
+		Permit: self.relays.permit,
+	}
+	server.Serve(ctx, blue[1])
+}
+
+func (self *SocksRelayer) Stats() Stats {
+	return self.relays.snapshot()
+}
+
+func (self *SocksRelayer) Sessions() []SessionInfo {
+	return self.relays.sessions.list()
+}
+
+func (self *SocksRelayer) KillSession(id uint64) error {
+	return self.relays.sessions.kill(id)
+}
+
+func (self *SocksRelayer) UDPRoutes() map[core.RouteId]string {
+	return nil
+}
+
+func (self *SocksRelayer) UDPRouter() *intrinsic.UDPRouterHealth {
+	return nil
+}
+
+func (self *SocksRelayer) Upstreams() []UpstreamInfo {
+	if self.next == nil {
+		return nil
+	}
+	return self.next.Upstreams()
 }
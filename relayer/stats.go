@@ -0,0 +1,257 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/acl"
+	"github.com/bzEq/bx/core/dns"
+	"github.com/bzEq/bx/core/metrics"
+)
+
+var (
+	connectionsActive = metrics.Default.Gauge("bx_connections_active",
+		"Number of connections being served")
+	connectionsTotal = metrics.Default.Counter("bx_connections_total",
+		"Number of accepted connections")
+	relaysActive = metrics.Default.Gauge("bx_relays_active",
+		"Number of relays in progress")
+	relayedBytes = metrics.Default.CounterVec("bx_relayed_bytes_total",
+		"Number of bytes relayed", "direction")
+	relayedBytesByDir = [2]*metrics.Counter{
+		relayedBytes.With("up"),
+		relayedBytes.With("down"),
+	}
+)
+
+// Stats aggregates switch statistics of all relays of a relayer.
+type Stats struct {
+	Bytes  [2]uint64
+	Frames [2]uint64
+	// Number of relays ever started.
+	Total uint64
+	// Number of relays in progress.
+	Active int64
+}
+
+func (self Stats) String() string {
+	return fmt.Sprintf("relays: %d active/%d total, up: %d bytes/%d frames, down: %d bytes/%d frames",
+		self.Active, self.Total,
+		self.Bytes[core.SWITCH_FORWARD], self.Frames[core.SWITCH_FORWARD],
+		self.Bytes[core.SWITCH_BACKWARD], self.Frames[core.SWITCH_BACKWARD])
+}
+
+// Seconds IPs checked by permit are dialed in place of their domain.
+const CHECKED_IPS_TTL = 10
+
+type checkedIPs struct {
+	ips []net.IP
+	at  time.Time
+}
+
+type relayTable struct {
+	s         Stats
+	sessions  sessionTable
+	limiter   *rateLimiter
+	acl       *acl.ACL
+	resolver  *dns.Resolver
+	quota     *QuotaStore
+	closeOnce sync.Once
+	// IPs of domains checked by permit, keyed by network and address, so
+	// that dial connects to the IPs checked instead of resolving again.
+	checkedMu sync.Mutex
+	checked   map[string]checkedIPs
+}
+
+func (self *relayTable) setRateLimit(r RateLimit) {
+	if r != (RateLimit{}) {
+		self.limiter = newRateLimiter(r)
+	}
+}
+
+func (self *relayTable) setACL(a *acl.ACL) {
+	if a == nil {
+		a = &acl.ACL{}
+	}
+	self.acl = a
+}
+
+// setResolver makes dials and ACL checks resolve names by r instead of the
+// system resolver. It should be called after setACL.
+func (self *relayTable) setResolver(r *dns.Resolver) {
+	if r == nil {
+		return
+	}
+	self.resolver = r
+	if self.acl != nil && self.acl.Resolver == nil {
+		// The ACL may be shared with other relayers, which resolve by
+		// their own resolvers.
+		a := *self.acl
+		a.Resolver = r
+		self.acl = &a
+	}
+}
+
+// setQuota accounts relays to shared if it's not nil, otherwise to a store of
+// q of its own.
+func (self *relayTable) setQuota(q Quota, shared *QuotaStore) error {
+	if shared == nil {
+		if q == (Quota{}) {
+			return nil
+		}
+		store, err := NewQuotaStore(q)
+		if err != nil {
+			return err
+		}
+		shared = store
+	}
+	self.quota = shared
+	shared.acquire()
+	return nil
+}
+
+// close persists state of relays. It should be called after relays drain.
+func (self *relayTable) close() {
+	self.closeOnce.Do(func() {
+		if self.quota != nil {
+			self.quota.release()
+		}
+	})
+}
+
+func (self *relayTable) remember(network, addr string, ips []net.IP) {
+	self.checkedMu.Lock()
+	defer self.checkedMu.Unlock()
+	now := time.Now()
+	for k, c := range self.checked {
+		if now.Sub(c.at) > CHECKED_IPS_TTL*time.Second {
+			delete(self.checked, k)
+		}
+	}
+	if self.checked == nil {
+		self.checked = make(map[string]checkedIPs)
+	}
+	self.checked[network+" "+addr] = checkedIPs{ips: ips, at: now}
+}
+
+func (self *relayTable) checkedIPs(network, addr string) []net.IP {
+	self.checkedMu.Lock()
+	defer self.checkedMu.Unlock()
+	c, in := self.checked[network+" "+addr]
+	if !in || time.Since(c.at) > CHECKED_IPS_TTL*time.Second {
+		return nil
+	}
+	return c.ips
+}
+
+// dial dials addr, rechecking ACL against the connected IP if any. Domains
+// checked by permit are dialed by the IPs checked.
+func (self *relayTable) dial(network, addr string) (net.Conn, error) {
+	if self.acl != nil {
+		if ips := self.checkedIPs(network, addr); ips != nil {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			d := &dns.Dialer{Timeout: 30 * time.Second, Control: self.acl.Control(host)}
+			return d.DialIPs(context.Background(), network, ips, port)
+		}
+	}
+	if self.resolver != nil {
+		d := &dns.Dialer{Resolver: self.resolver, Timeout: 30 * time.Second}
+		if self.acl != nil {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			d.Control = self.acl.Control(host)
+		}
+		return d.Dial(network, addr)
+	}
+	if self.acl != nil {
+		return self.acl.Dial(network, addr)
+	}
+	return net.Dial(network, addr)
+}
+
+// permit decides whether a relay to addr can be started.
+func (self *relayTable) permit(ctx context.Context, network, addr string) error {
+	if self.acl != nil {
+		ips, err := self.acl.CheckIPs(ctx, network, addr)
+		if err != nil {
+			return err
+		}
+		if host, _, _ := net.SplitHostPort(addr); len(ips) != 0 && net.ParseIP(host) == nil {
+			self.remember(network, addr, ips)
+		}
+	}
+	if self.quota != nil {
+		if err := self.quota.check(clientFromContext(ctx)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *relayTable) OnTraffic(dir int, n int) {
+	atomic.AddUint64(&self.s.Bytes[dir], uint64(n))
+	atomic.AddUint64(&self.s.Frames[dir], 1)
+	relayedBytesByDir[dir].Add(uint64(n))
+}
+
+func (self *relayTable) OnDone(s *core.SwitchStats) {
+	atomic.AddInt64(&self.s.Active, -1)
+	relaysActive.Dec()
+}
+
+func (self *relayTable) snapshot() Stats {
+	var s Stats
+	for i := range s.Bytes {
+		s.Bytes[i] = atomic.LoadUint64(&self.s.Bytes[i])
+		s.Frames[i] = atomic.LoadUint64(&self.s.Frames[i])
+	}
+	s.Total = atomic.LoadUint64(&self.s.Total)
+	s.Active = atomic.LoadInt64(&self.s.Active)
+	return s
+}
+
+type switchLogger struct {
+	target string
+}
+
+func (self *switchLogger) OnTraffic(dir int, n int) {}
+
+func (self *switchLogger) OnDone(s *core.SwitchStats) {
+	log.Printf("Relay to %s done in %v, up: %d bytes/%d frames (%v), down: %d bytes/%d frames (%v)\n",
+		self.target, s.Duration(),
+		s.Bytes[core.SWITCH_FORWARD], s.Frames[core.SWITCH_FORWARD], s.Reason[core.SWITCH_FORWARD],
+		s.Bytes[core.SWITCH_BACKWARD], s.Frames[core.SWITCH_BACKWARD], s.Reason[core.SWITCH_BACKWARD])
+}
+
+func (self *relayTable) switchTraffic(ctx context.Context, client, remote core.Port, target string) {
+	atomic.AddUint64(&self.s.Total, 1)
+	atomic.AddInt64(&self.s.Active, 1)
+	relaysActive.Inc()
+	if self.limiter != nil {
+		var release func()
+		client, release = self.limiter.wrap(client, clientFromContext(ctx), target)
+		defer release()
+	}
+	sw := core.NewSimpleSwitch(client, remote).
+		AddObserver(self).
+		AddObserver(&switchLogger{target: target})
+	if self.quota != nil {
+		sw.AddObserver(&quotaObserver{store: self.quota, client: clientFromContext(ctx), sw: sw})
+	}
+	s := self.sessions.add(ctx, target, sw)
+	defer self.sessions.remove(s.id)
+	sw.Run(ctx)
+}
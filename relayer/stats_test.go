@@ -0,0 +1,50 @@
+package relayer
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bzEq/bx/core/acl"
+	"github.com/bzEq/bx/core/dns"
+)
+
+func TestDialCheckedIPs(t *testing.T) {
+	echo := serveEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+	a, err := acl.Parse(strings.NewReader("allow cidr:127.0.0.1 port:"+port+"\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &countingResolver{}
+	a.Resolver = res
+	var relays relayTable
+	relays.setACL(a)
+	addr := net.JoinHostPort("echo.example.com", port)
+	if err := relays.permit(withClient(context.Background(), "a"), "tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	c, err := relays.dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(res.clients) != 1 {
+		t.Fatalf("Expected 1 query, got %d", len(res.clients))
+	}
+}
+
+func TestSetResolverKeepsACL(t *testing.T) {
+	a := &acl.ACL{}
+	var relays relayTable
+	relays.setACL(a)
+	r := &dns.Resolver{}
+	relays.setResolver(r)
+	if a.Resolver != nil {
+		t.Fatal("Expected ACL of the caller to be left intact")
+	}
+	if relays.acl.Resolver != r {
+		t.Fatal("Expected ACL checks to resolve by the relayer's resolver")
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bzEq/bx/core"
+)
+
+// Number of packets queued for a UDP session while its remote side is being
+// dialed.
+const TRANSPARENT_UDP_QUEUE_SIZE = 64
+
+// Maximum number of transparent UDP sessions relayed at a time. Packets of
+// new sessions are dropped beyond it.
+const MAX_TRANSPARENT_UDP_SESSIONS = 1024
+
+// startLocalTransparentProxy accepts connections iptables REDIRECTs or TPROXYs
+// to LocalTransparent and relays them to their original destinations. UDP is
+// relayed only with TPROXY.
+func (self *IntrinsicRelayer) startLocalTransparentProxy() error {
+	ln, err := listenTransparent(self.LocalTransparent, self.TProxy)
+	if err != nil {
+		return err
+	}
+	if err := self.lc.AddCloser(func() { ln.Close() }); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if !self.lc.IsClosing() {
+					log.Println(err)
+				}
+				return
+			}
+			if err := self.lc.Track(c); err != nil {
+				c.Close()
+				return
+			}
+			go func(c net.Conn) {
+				defer self.lc.Untrack(c)
+				defer c.Close()
+				if err := self.serveTransparent(ln.Addr(), c); err != nil {
+					log.Println(err)
+				}
+			}(c)
+		}
+	}()
+	if !self.TProxy {
+		return nil
+	}
+	pc, err := listenTransparentUDP(self.LocalTransparent)
+	if err != nil {
+		return err
+	}
+	if err := self.lc.AddCloser(func() { pc.Close() }); err != nil {
+		return err
+	}
+	go self.serveTransparentUDP(pc)
+	return nil
+}
+
+func (self *IntrinsicRelayer) serveTransparent(laddr net.Addr, c net.Conn) error {
+	dst := c.LocalAddr()
+	if !self.TProxy {
+		var err error
+		if dst, err = originalDst(c); err != nil {
+			return err
+		}
+	}
+	// Connecting to the listener itself would loop forever.
+	if dst.String() == laddr.String() {
+		return fmt.Errorf("Connection from %v isn't redirected", c.RemoteAddr())
+	}
+	ctx := withClient(self.lc.Context(), hostOf(c.RemoteAddr().String()))
+	addr := dst.String()
+	rt := self.newRoute()
+	if err := rt.permit(ctx, "tcp", addr); err != nil {
+		return err
+	}
+	remote, err := rt.dial("tcp", addr)
+	if err != nil {
+		core.RecordDialFailure(err)
+		return err
+	}
+	defer remote.Close()
+	self.relays.switchTraffic(ctx, core.NewPort(c, nil), core.NewPort(remote, nil), addr)
+	return nil
+}
+
+type transparentUDPSession struct {
+	key     string
+	src     *net.UDPAddr
+	dst     *net.UDPAddr
+	packets chan []byte
+}
+
+// transparentUDPSessions tracks UDP sessions by their source and original
+// destination.
+type transparentUDPSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*transparentUDPSession
+}
+
+// dispatch queues packet to the session of src->dst. A new session is
+// relayed by relay, and is removed once relay returns. The packet is dropped
+// if there are MAX_TRANSPARENT_UDP_SESSIONS sessions already or the queue of
+// the session is full.
+func (self *transparentUDPSessions) dispatch(src, dst *net.UDPAddr, packet []byte, relay func(*transparentUDPSession)) {
+	key := src.String() + "->" + dst.String()
+	self.mu.Lock()
+	s, in := self.sessions[key]
+	if !in {
+		if len(self.sessions) >= MAX_TRANSPARENT_UDP_SESSIONS {
+			self.mu.Unlock()
+			log.Println(fmt.Errorf("Too many transparent UDP sessions, packet from %v to %v is dropped", src, dst))
+			return
+		}
+		s = &transparentUDPSession{
+			key:     key,
+			src:     src,
+			dst:     dst,
+			packets: make(chan []byte, TRANSPARENT_UDP_QUEUE_SIZE),
+		}
+		if self.sessions == nil {
+			self.sessions = make(map[string]*transparentUDPSession)
+		}
+		self.sessions[key] = s
+		go func() {
+			defer self.remove(s)
+			relay(s)
+		}()
+	}
+	self.mu.Unlock()
+	select {
+	case s.packets <- packet:
+	default:
+		// Drop the packet as a congested router does.
+	}
+}
+
+func (self *transparentUDPSessions) remove(s *transparentUDPSession) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.sessions[s.key] == s {
+		delete(self.sessions, s.key)
+	}
+}
+
+func (self *transparentUDPSessions) size() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return len(self.sessions)
+}
+
+func (self *IntrinsicRelayer) serveTransparentUDP(pc *net.UDPConn) {
+	var sessions transparentUDPSessions
+	buf := make([]byte, core.DEFAULT_UDP_BUFFER_SIZE)
+	oob := make([]byte, 256)
+	for {
+		n, src, dst, err := readFromUDPWithDst(pc, buf, oob)
+		if err != nil {
+			if self.lc.IsClosing() {
+				return
+			}
+			log.Println(err)
+			continue
+		}
+		if dst.String() == pc.LocalAddr().String() {
+			log.Printf("Packet from %v isn't redirected\n", src)
+			continue
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		sessions.dispatch(src, dst, packet, func(s *transparentUDPSession) {
+			if err := self.relayTransparentUDP(s); err != nil {
+				log.Println(err)
+			}
+		})
+	}
+}
+
+// relayTransparentUDP relays packets of s until its remote side is idle for
+// core.DEFAULT_UDP_TIMEOUT seconds. Replies are sent from the original
+// destination, so that clients take them as from the remote side.
+func (self *IntrinsicRelayer) relayTransparentUDP(s *transparentUDPSession) error {
+	addr := s.dst.String()
+	rt := self.newRoute()
+	if err := rt.permit(withClient(self.lc.Context(), s.src.IP.String()), "udp", addr); err != nil {
+		return err
+	}
+	remote, err := rt.dial("udp", addr)
+	if err != nil {
+		core.RecordDialFailure(err)
+		return err
+	}
+	defer remote.Close()
+	reply, err := dialTransparentUDP(s.dst, s.src)
+	if err != nil {
+		return err
+	}
+	defer reply.Close()
+	return pumpUDP(s.packets, remote, func(b []byte) error {
+		_, err := reply.Write(b)
+		return err
+	})
+}
+
+// pumpUDP sends packets to remote and replies from remote via reply, until
+// remote is idle for core.DEFAULT_UDP_TIMEOUT seconds.
+func pumpUDP(packets <-chan []byte, remote net.Conn, reply func([]byte) error) error {
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, core.DEFAULT_UDP_BUFFER_SIZE)
+		for {
+			remote.SetReadDeadline(time.Now().Add(core.DEFAULT_UDP_TIMEOUT * time.Second))
+			n, err := remote.Read(buf)
+			if err != nil {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					err = nil
+				}
+				done <- err
+				return
+			}
+			if err := reply(buf[:n]); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case packet := <-packets:
+			if _, err := remote.Write(packet); err != nil {
+				return err
+			}
+		case err := <-done:
+			return err
+		}
+	}
+}
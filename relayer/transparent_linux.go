@@ -0,0 +1,171 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Not defined by package syscall.
+const (
+	SO_ORIGINAL_DST      = 80
+	IP6T_SO_ORIGINAL_DST = 80
+	IPV6_RECVORIGDSTADDR = 74
+	IPV6_ORIGDSTADDR     = 74
+	IPV6_TRANSPARENT     = 75
+)
+
+// setTransparent allows the socket to accept connections and packets
+// addressed to others and bind to non-local addresses. IPv6 options fail on
+// IPv4 sockets, so their errors are ignored.
+func setTransparent(fd int, recvOrigDst bool) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+		return fmt.Errorf("Failed to set IP_TRANSPARENT: %w", err)
+	}
+	syscall.SetsockoptInt(fd, syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+	if recvOrigDst {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
+			return err
+		}
+		syscall.SetsockoptInt(fd, syscall.SOL_IPV6, IPV6_RECVORIGDSTADDR, 1)
+	}
+	return nil
+}
+
+func transparentControl(recvOrigDst bool) func(string, string, syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = setTransparent(int(fd), recvOrigDst)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// listenTransparent listens for TCP connections redirected by iptables. With
+// tproxy, the listener accepts connections of TPROXY target.
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if tproxy {
+		lc.Control = transparentControl(false)
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns destination of c before iptables REDIRECT.
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("Not a TCP connection: %v", c.RemoteAddr())
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	isV4 := c.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var dst *net.TCPAddr
+	if cerr := rc.Control(func(fd uintptr) {
+		if isV4 {
+			// sockaddr_in fits in ipv6_mreq.
+			var mreq *syscall.IPv6Mreq
+			if mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, SO_ORIGINAL_DST); err == nil {
+				dst = &net.TCPAddr{
+					IP:   net.IP(append([]byte(nil), mreq.Multiaddr[4:8]...)),
+					Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+				}
+			}
+			return
+		}
+		// sockaddr_in6 fits in ip6_mtuinfo.
+		var info *syscall.IPv6MTUInfo
+		if info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, IP6T_SO_ORIGINAL_DST); err == nil {
+			// Port is in network byte order.
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			dst = &net.TCPAddr{
+				IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+				Port: int(binary.BigEndian.Uint16(port[:])),
+			}
+		}
+	}); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get original destination: %w", err)
+	}
+	return dst, nil
+}
+
+// listenTransparentUDP listens for UDP packets of TPROXY target.
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(true)}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// readFromUDPWithDst reads a packet along with its original destination.
+func readFromUDPWithDst(c *net.UDPConn, b, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	n, oobn, _, src, err := c.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_ORIGDSTADDR && len(m.Data) >= 8:
+			// struct sockaddr_in
+			return n, src, &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[4:8]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == IPV6_ORIGDSTADDR && len(m.Data) >= 24:
+			// struct sockaddr_in6
+			return n, src, &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		}
+	}
+	return 0, nil, nil, fmt.Errorf("No original destination of packet from %v", src)
+}
+
+// dialTransparentUDP creates a socket sending packets from laddr, which is
+// usually not local, to raddr.
+func dialTransparentUDP(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	d := &net.Dialer{
+		LocalAddr: laddr,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err == nil {
+					err = setTransparent(int(fd), false)
+				}
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	network := "udp6"
+	if laddr.IP.To4() != nil {
+		network = "udp4"
+		raddr = &net.UDPAddr{IP: raddr.IP.To4(), Port: raddr.Port}
+	}
+	c, err := d.Dial(network, raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
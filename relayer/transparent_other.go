@@ -0,0 +1,32 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+//go:build !linux
+
+package relayer
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("Transparent proxy is only supported on Linux")
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func readFromUDPWithDst(c *net.UDPConn, b, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, errTransparentUnsupported
+}
+
+func dialTransparentUDP(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
@@ -0,0 +1,104 @@
+package relayer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func udpAddr(port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func TestTransparentUDPSessionCap(t *testing.T) {
+	var sessions transparentUDPSessions
+	release := make(chan struct{})
+	relay := func(s *transparentUDPSession) { <-release }
+	dst := udpAddr(53)
+	for i := 0; i <= MAX_TRANSPARENT_UDP_SESSIONS; i++ {
+		sessions.dispatch(udpAddr(1024+i), dst, []byte("wtf"), relay)
+	}
+	if n := sessions.size(); n != MAX_TRANSPARENT_UDP_SESSIONS {
+		t.Fatalf("Expected %d sessions, got %d", MAX_TRANSPARENT_UDP_SESSIONS, n)
+	}
+	// Packets of existing sessions are still queued.
+	sessions.dispatch(udpAddr(1024), dst, []byte("wtfwtf"), relay)
+	s := sessions.sessions[udpAddr(1024).String()+"->"+dst.String()]
+	if len(s.packets) != 2 {
+		t.Fatalf("Expected 2 packets queued, got %d", len(s.packets))
+	}
+	close(release)
+	waitFor(t, func() bool { return sessions.size() == 0 })
+}
+
+func TestTransparentUDPSessionRenewed(t *testing.T) {
+	var sessions transparentUDPSessions
+	relayed := make(chan *transparentUDPSession, 2)
+	relay := func(s *transparentUDPSession) { relayed <- s }
+	src, dst := udpAddr(1024), udpAddr(53)
+	sessions.dispatch(src, dst, []byte("wtf"), relay)
+	s0 := <-relayed
+	waitFor(t, func() bool { return sessions.size() == 0 })
+	// A session done is relayed anew by its next packet.
+	sessions.dispatch(src, dst, []byte("wtf"), relay)
+	if s1 := <-relayed; s1 == s0 {
+		t.Fatal("Expected a new session")
+	}
+}
+
+func TestPumpUDP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", udpAddr(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	remote, err := net.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := make(chan []byte, 1)
+	replies := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- pumpUDP(packets, remote, func(b []byte) error {
+			replies <- string(b)
+			return nil
+		})
+	}()
+	packets <- []byte("wtf")
+	select {
+	case r := <-replies:
+		if r != "wtf" {
+			t.Fatalf("Expected %q, got %q", "wtf", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No reply is pumped")
+	}
+	// Pumping stops once remote fails.
+	remote.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Pumping doesn't stop")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition isn't met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/bzEq/bx/core"
+	"github.com/bzEq/bx/core/netstack"
+	"github.com/bzEq/bx/core/tun"
+)
+
+// startLocalTUN relays TCP and UDP flows of IPv4 packets routed to TUN device
+// LocalTUN. Routes to Next must bypass the device, otherwise the tunnel loops
+// into itself.
+func (self *IntrinsicRelayer) startLocalTUN() error {
+	dev, err := tun.Open(self.LocalTUN)
+	if err != nil {
+		return err
+	}
+	if err := self.lc.AddCloser(func() { dev.Close() }); err != nil {
+		return err
+	}
+	s := &netstack.Stack{
+		Dev:       dev,
+		MTU:       self.TUNMTU,
+		HandleTCP: self.serveTUNConn,
+		HandleUDP: self.serveTUNPacketConn,
+	}
+	go func() {
+		if err := s.Run(); err != nil && !self.lc.IsClosing() {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
+func (self *IntrinsicRelayer) serveTUNConn(c net.Conn) {
+	if err := self.lc.Track(c); err != nil {
+		c.Close()
+		return
+	}
+	defer self.lc.Untrack(c)
+	defer c.Close()
+	ctx := withClient(self.lc.Context(), hostOf(c.RemoteAddr().String()))
+	addr := c.LocalAddr().String()
+	rt := self.newRoute()
+	if err := rt.permit(ctx, "tcp", addr); err != nil {
+		log.Println(err)
+		return
+	}
+	remote, err := rt.dial("tcp", addr)
+	if err != nil {
+		core.RecordDialFailure(err)
+		log.Println(err)
+		return
+	}
+	defer remote.Close()
+	self.relays.switchTraffic(ctx, core.NewPort(c, nil), core.NewPort(remote, nil), addr)
+}
+
+// serveTUNPacketConn relays datagrams of c until either side is idle for
+// core.DEFAULT_UDP_TIMEOUT seconds.
+func (self *IntrinsicRelayer) serveTUNPacketConn(c net.Conn) {
+	if err := self.lc.Track(c); err != nil {
+		c.Close()
+		return
+	}
+	defer self.lc.Untrack(c)
+	defer c.Close()
+	ctx := withClient(self.lc.Context(), hostOf(c.RemoteAddr().String()))
+	addr := c.LocalAddr().String()
+	rt := self.newRoute()
+	if err := rt.permit(ctx, "udp", addr); err != nil {
+		log.Println(err)
+		return
+	}
+	remote, err := rt.dial("udp", addr)
+	if err != nil {
+		core.RecordDialFailure(err)
+		log.Println(err)
+		return
+	}
+	defer remote.Close()
+	relay := func(dst, src net.Conn, done chan<- struct{}) {
+		defer close(done)
+		buf := make([]byte, core.DEFAULT_UDP_BUFFER_SIZE)
+		for {
+			src.SetReadDeadline(time.Now().Add(core.DEFAULT_UDP_TIMEOUT * time.Second))
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+	up, down := make(chan struct{}), make(chan struct{})
+	go relay(remote, c, up)
+	go relay(c, remote, down)
+	select {
+	case <-up:
+	case <-down:
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bzEq/bx/core"
+)
+
+const (
+	DEFAULT_PROBE_INTERVAL = 10
+	DEFAULT_PROBE_TIMEOUT  = 5
+	DEFAULT_DIAL_TIMEOUT   = 10
+	// Consecutive failures before an upstream is considered down.
+	DEFAULT_MAX_FAILS = 3
+)
+
+var ErrNoUpstream = errors.New("No upstream available")
+
+type UpstreamPolicy int
+
+const (
+	// Use upstreams in the given order.
+	FAILOVER UpstreamPolicy = iota
+	ROUND_ROBIN
+	LEAST_CONNECTIONS
+	// Prefer the upstream with the lowest connect latency. Upstreams whose
+	// latency isn't measured yet come after measured ones.
+	LATENCY
+	// Start with a random upstream.
+	RANDOM
+)
+
+func ParseUpstreamPolicy(s string) (UpstreamPolicy, error) {
+	switch s {
+	case "failover":
+		return FAILOVER, nil
+	case "round_robin":
+		return ROUND_ROBIN, nil
+	case "least_conn":
+		return LEAST_CONNECTIONS, nil
+	case "latency":
+		return LATENCY, nil
+	case "random":
+		return RANDOM, nil
+	default:
+		return FAILOVER, fmt.Errorf("Unknown upstream policy: %s", s)
+	}
+}
+
+func (self UpstreamPolicy) String() string {
+	switch self {
+	case FAILOVER:
+		return "failover"
+	case ROUND_ROBIN:
+		return "round_robin"
+	case LEAST_CONNECTIONS:
+		return "least_conn"
+	case LATENCY:
+		return "latency"
+	case RANDOM:
+		return "random"
+	default:
+		return "unknown"
+	}
+}
+
+type UpstreamInfo struct {
+	Addr    string
+	Healthy bool
+	Active  int64
+	Latency time.Duration
+}
+
+type upstream struct {
+	addr   string
+	active int64
+	mu     sync.Mutex
+	down   bool
+	fails  int
+	// Smoothed connect latency.
+	latency time.Duration
+}
+
+func (self *upstream) info() UpstreamInfo {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return UpstreamInfo{
+		Addr:    self.addr,
+		Healthy: !self.down,
+		Active:  atomic.LoadInt64(&self.active),
+		Latency: self.latency,
+	}
+}
+
+func (self *upstream) succeed(latency time.Duration) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.latency == 0 {
+		self.latency = latency
+	} else {
+		self.latency = (self.latency*7 + latency) / 8
+	}
+	self.fails = 0
+	if self.down {
+		self.down = false
+		log.Printf("Upstream %s is up\n", self.addr)
+	}
+}
+
+func (self *upstream) fail(maxFails int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.fails += 1
+	if !self.down && self.fails >= maxFails {
+		self.down = true
+		log.Printf("Upstream %s is down\n", self.addr)
+	}
+}
+
+// upstreamConn releases its upstream's connection count on Close.
+type upstreamConn struct {
+	net.Conn
+	u    *upstream
+	once sync.Once
+}
+
+func (self *upstreamConn) Close() error {
+	self.once.Do(func() { atomic.AddInt64(&self.u.active, -1) })
+	return self.Conn.Close()
+}
+
+func (self *upstreamConn) CloseRead() error {
+	return core.CloseRead(self.Conn)
+}
+
+func (self *upstreamConn) CloseWrite() error {
+	return core.CloseWrite(self.Conn)
+}
+
+// UpstreamGroup dials one of several next-hop relayers chosen by Policy.
+// Upstreams failing MaxFails consecutive dials or probes are avoided until a
+// dial or probe succeeds again. If all upstreams are down, all are tried.
+type UpstreamGroup struct {
+	Policy        UpstreamPolicy
+	Dial          func(network, addr string) (net.Conn, error)
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	// Dials taking longer fail, so that the next upstream is tried.
+	DialTimeout time.Duration
+	MaxFails    int
+	upstreams   []*upstream
+	rr          uint64
+	quit        chan struct{}
+	closeOnce   sync.Once
+}
+
+func NewUpstreamGroup(addrs []string, policy UpstreamPolicy, dial func(string, string) (net.Conn, error)) *UpstreamGroup {
+	if dial == nil {
+		dial = net.Dial
+	}
+	self := &UpstreamGroup{
+		Policy:        policy,
+		Dial:          dial,
+		ProbeInterval: DEFAULT_PROBE_INTERVAL * time.Second,
+		ProbeTimeout:  DEFAULT_PROBE_TIMEOUT * time.Second,
+		DialTimeout:   DEFAULT_DIAL_TIMEOUT * time.Second,
+		MaxFails:      DEFAULT_MAX_FAILS,
+		quit:          make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		self.upstreams = append(self.upstreams, &upstream{addr: addr})
+	}
+	return self
+}
+
+// Start probes upstreams periodically. Nothing is probed if there is only
+// one upstream, since there is no other choice.
+func (self *UpstreamGroup) Start() {
+	if len(self.upstreams) < 2 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(self.ProbeInterval)
+		defer t.Stop()
+		for {
+			self.probeAll()
+			select {
+			case <-t.C:
+			case <-self.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (self *UpstreamGroup) Close() {
+	self.closeOnce.Do(func() { close(self.quit) })
+}
+
+func (self *UpstreamGroup) probeAll() {
+	var wg sync.WaitGroup
+	for _, u := range self.upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			self.probe(u)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// dial dials addr, giving up after timeout or once the group is closed. A
+// conn connected after giving up is closed.
+func (self *UpstreamGroup) dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := self.Dial(network, addr)
+		done <- result{c, err}
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	var err error
+	select {
+	case r := <-done:
+		return r.c, r.err
+	case <-t.C:
+		err = fmt.Errorf("Dialing upstream %s timed out after %s", addr, timeout)
+	case <-self.quit:
+		err = net.ErrClosed
+	}
+	go func() {
+		if r := <-done; r.err == nil {
+			r.c.Close()
+		}
+	}()
+	return nil, err
+}
+
+// probe connects to u and closes the connection at once.
+func (self *UpstreamGroup) probe(u *upstream) {
+	start := time.Now()
+	c, err := self.dial("tcp", u.addr, self.ProbeTimeout)
+	if errors.Is(err, net.ErrClosed) {
+		return
+	}
+	if err != nil {
+		u.fail(self.MaxFails)
+		return
+	}
+	c.Close()
+	u.succeed(time.Since(start))
+}
+
+// candidates returns upstreams in the order they should be tried.
+func (self *UpstreamGroup) candidates() []*upstream {
+	n := len(self.upstreams)
+	l := make([]*upstream, n)
+	infos := make(map[*upstream]UpstreamInfo)
+	start := 0
+	if self.Policy == RANDOM && n > 0 {
+		start = rand.Intn(n)
+	} else if self.Policy != FAILOVER && n > 0 {
+		start = int(atomic.AddUint64(&self.rr, 1) % uint64(n))
+	}
+	for i := range l {
+		l[i] = self.upstreams[(start+i)%n]
+		infos[l[i]] = l[i].info()
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := infos[l[i]], infos[l[j]]
+		if a.Healthy != b.Healthy {
+			return a.Healthy
+		}
+		switch self.Policy {
+		case LEAST_CONNECTIONS:
+			return a.Active < b.Active
+		case LATENCY:
+			if (a.Latency == 0) != (b.Latency == 0) {
+				return b.Latency == 0
+			}
+			return a.Latency < b.Latency
+		}
+		return false
+	})
+	return l
+}
+
+// DialUpstream dials candidates in order until one succeeds and returns the
+// conn along with the upstream's address. Candidates permit refuses are
+// skipped without being dialed. permit can be nil.
+func (self *UpstreamGroup) DialUpstream(network string, permit func(addr string) error) (net.Conn, string, error) {
+	err := ErrNoUpstream
+	for _, u := range self.candidates() {
+		if permit != nil {
+			if e := permit(u.addr); e != nil {
+				err = e
+				continue
+			}
+		}
+		start := time.Now()
+		c, e := self.dial(network, u.addr, self.DialTimeout)
+		if e != nil {
+			core.RecordDialFailure(e)
+			u.fail(self.MaxFails)
+			err = e
+			continue
+		}
+		u.succeed(time.Since(start))
+		atomic.AddInt64(&u.active, 1)
+		return &upstreamConn{Conn: c, u: u}, u.addr, nil
+	}
+	return nil, "", err
+}
+
+// DialNext has the signature of a dial function, so that it can be used in
+// place of one. addr is ignored.
+func (self *UpstreamGroup) DialNext(network, addr string) (net.Conn, error) {
+	c, _, err := self.DialUpstream(network, nil)
+	return c, err
+}
+
+func (self *UpstreamGroup) Upstreams() []UpstreamInfo {
+	var l []UpstreamInfo
+	for _, u := range self.upstreams {
+		l = append(l, u.info())
+	}
+	return l
+}
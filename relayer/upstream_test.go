@@ -0,0 +1,146 @@
+package relayer
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeDial connects to addrs of up over pipes and fails others.
+func fakeDial(up map[string]bool) func(string, string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		if !up[addr] {
+			return nil, errors.New("Connection refused")
+		}
+		c0, c1 := net.Pipe()
+		c1.Close()
+		return c0, nil
+	}
+}
+
+func candidateAddrs(g *UpstreamGroup) []string {
+	var l []string
+	for _, u := range g.candidates() {
+		l = append(l, u.addr)
+	}
+	return l
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	up := map[string]bool{"a": true, "b": true}
+	g := NewUpstreamGroup([]string{"a", "b"}, FAILOVER, fakeDial(up))
+	g.MaxFails = 2
+	for i := 0; i < 2; i++ {
+		if _, addr, err := g.DialUpstream("tcp", nil); err != nil || addr != "a" {
+			t.Fatalf("Expected a, got %q, %v", addr, err)
+		}
+	}
+	up["a"] = false
+	// a is tried first until it fails MaxFails dials in a row.
+	for i := 0; i < 3; i++ {
+		if _, addr, err := g.DialUpstream("tcp", nil); err != nil || addr != "b" {
+			t.Fatalf("Expected b, got %q, %v", addr, err)
+		}
+	}
+	if l := candidateAddrs(g); l[0] != "b" {
+		t.Fatalf("Expected a down, got %v", l)
+	}
+	// A successful probe brings a back.
+	up["a"] = true
+	g.probeAll()
+	if l := candidateAddrs(g); l[0] != "a" {
+		t.Fatalf("Expected a up, got %v", l)
+	}
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	g := NewUpstreamGroup([]string{"a", "b", "c"}, ROUND_ROBIN, nil)
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		seen[candidateAddrs(g)[0]] += 1
+	}
+	for _, addr := range []string{"a", "b", "c"} {
+		if seen[addr] != 2 {
+			t.Fatalf("Expected upstreams taking turns, got %v", seen)
+		}
+	}
+}
+
+func TestUpstreamLeastConnections(t *testing.T) {
+	g := NewUpstreamGroup([]string{"a", "b"}, LEAST_CONNECTIONS, fakeDial(map[string]bool{"a": true, "b": true}))
+	c0, first, err := g.DialUpstream("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := g.DialUpstream("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("Expected the idle upstream, got %s twice", first)
+	}
+	c0.Close()
+	if l := candidateAddrs(g); l[0] != first {
+		t.Fatalf("Expected %s released, got %v", first, l)
+	}
+}
+
+func TestUpstreamLatency(t *testing.T) {
+	g := NewUpstreamGroup([]string{"a", "b", "c"}, LATENCY, nil)
+	g.upstreams[0].succeed(30 * time.Millisecond)
+	g.upstreams[2].succeed(10 * time.Millisecond)
+	// b isn't measured yet, so it comes last.
+	for i := 0; i < 3; i++ {
+		if l := candidateAddrs(g); l[0] != "c" || l[1] != "a" || l[2] != "b" {
+			t.Fatalf("Expected [c a b], got %v", l)
+		}
+	}
+}
+
+func TestUpstreamDialTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	g := NewUpstreamGroup([]string{"a", "b"}, FAILOVER, func(network, addr string) (net.Conn, error) {
+		if addr == "a" {
+			<-hang
+			return nil, errors.New("Connection refused")
+		}
+		return fakeDial(map[string]bool{"b": true})(network, addr)
+	})
+	g.DialTimeout = 50 * time.Millisecond
+	if _, addr, err := g.DialUpstream("tcp", nil); err != nil || addr != "b" {
+		t.Fatalf("Expected b after a timed out, got %q, %v", addr, err)
+	}
+}
+
+func TestUpstreamPermit(t *testing.T) {
+	dials := 0
+	g := NewUpstreamGroup([]string{"a", "b"}, FAILOVER, func(network, addr string) (net.Conn, error) {
+		dials += 1
+		return fakeDial(map[string]bool{"a": true, "b": true})(network, addr)
+	})
+	refused := errors.New("Refused")
+	if _, _, err := g.DialUpstream("tcp", func(string) error { return refused }); err != refused {
+		t.Fatalf("Expected refusal, got %v", err)
+	}
+	if dials != 0 {
+		t.Fatalf("Expected refused upstreams not dialed, got %d dials", dials)
+	}
+	if _, addr, err := g.DialUpstream("tcp", func(addr string) error {
+		if addr == "a" {
+			return refused
+		}
+		return nil
+	}); err != nil || addr != "b" {
+		t.Fatalf("Expected b, got %q, %v", addr, err)
+	}
+}
+
+func TestParseUpstreamPolicy(t *testing.T) {
+	for _, p := range []UpstreamPolicy{FAILOVER, ROUND_ROBIN, LEAST_CONNECTIONS, LATENCY, RANDOM} {
+		if q, err := ParseUpstreamPolicy(p.String()); err != nil || q != p {
+			t.Fatalf("Expected %s, got %s, %v", p, q, err)
+		}
+	}
+}
@@ -3,20 +3,29 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/bzEq/bx/core"
 	"github.com/bzEq/bx/proxy/socks5"
+	"github.com/bzEq/bx/relayer"
 )
 
 func main() {
 	var localAddr string
+	var shutdownTimeout int
 	flag.StringVar(&localAddr, "l", "localhost:1080", "Address of local server")
+	flag.IntVar(&shutdownTimeout, "shutdown_timeout", relayer.DEFAULT_SHUTDOWN_TIMEOUT, "Seconds to wait for in-flight connections on shutdown")
 	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	udpAddrChan := make(chan *net.UDPAddr)
+	var lc relayer.Lifecycle
+	udpLnChan := make(chan *net.UDPConn)
 	go func() {
 		laddr, err := net.ResolveUDPAddr("udp", localAddr)
 		if err != nil {
@@ -28,12 +37,17 @@ func main() {
 			log.Println(err)
 			return
 		}
-		defer ln.Close()
-		udpAddrChan <- ln.LocalAddr().(*net.UDPAddr)
+		if err := lc.AddCloser(func() { ln.Close() }); err != nil {
+			return
+		}
+		udpLnChan <- ln
 		for {
 			req := make([]byte, core.DEFAULT_UDP_BUFFER_SIZE)
 			n, remoteAddr, err := ln.ReadFromUDP(req)
 			if err != nil {
+				if lc.IsClosing() {
+					return
+				}
 				log.Println(err)
 				continue
 			}
@@ -41,7 +55,7 @@ func main() {
 				s := socks5.Server{
 					UDPAddr: ln.LocalAddr().(*net.UDPAddr),
 				}
-				if err := s.ServeUDP(ln, remoteAddr, req); err != nil {
+				if err := s.ServeUDP(lc.Context(), ln, remoteAddr, req); err != nil {
 					log.Println(err)
 				}
 			}(remoteAddr, req[:n])
@@ -52,22 +66,47 @@ func main() {
 		log.Println(err)
 		return
 	}
-	defer ln.Close()
-	udpAddr := <-udpAddrChan
-	for {
-		c, err := ln.Accept()
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		go func(c net.Conn) {
-			defer c.Close()
-			s := socks5.Server{
-				UDPAddr: udpAddr,
+	if err := lc.AddCloser(func() { ln.Close() }); err != nil {
+		return
+	}
+	udpAddr := (<-udpLnChan).LocalAddr().(*net.UDPAddr)
+	failed := make(chan struct{})
+	go func() {
+		defer close(failed)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if !lc.IsClosing() {
+					log.Println(err)
+				}
+				return
 			}
-			if err := s.Serve(c); err != nil {
-				log.Println(err)
+			if err := lc.Track(c); err != nil {
+				c.Close()
+				continue
 			}
-		}(c)
+			go func(c net.Conn) {
+				defer lc.Untrack(c)
+				defer c.Close()
+				s := socks5.Server{
+					UDPAddr: udpAddr,
+				}
+				if err := s.Serve(lc.Context(), c); err != nil {
+					log.Println(err)
+				}
+			}(c)
+		}
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case s := <-sig:
+		log.Printf("Received %v, shutting down\n", s)
+	case <-failed:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdownTimeout)*time.Second)
+	defer cancel()
+	if err := lc.Shutdown(ctx); err != nil {
+		log.Println(err)
 	}
 }